@@ -0,0 +1,101 @@
+package pcp
+
+import (
+	"net"
+	"net/netip"
+)
+
+//PCP always carries addresses in 16 octet fields. IPv4 addresses are sent in
+//their IPv4-mapped IPv6 form (::ffff:a.b.c.d), see 5 of RFC6887. Addresses
+//read from the wire are unmapped again, so an IPv4 address always compares
+//equal to the same address parsed from a string.
+
+//appendAddr appends the 16 octet wire form of addr. The zone is dropped, and
+//the zero Addr is written as all zeros.
+func appendAddr(b []byte, addr netip.Addr) []byte {
+	a := addr.WithZone("").As16()
+	return append(b, a[:]...)
+}
+
+//getAddr reads a 16 octet wire address, returning IPv4-mapped addresses as IPv4.
+func getAddr(b []byte) netip.Addr {
+	var a [16]byte
+	copy(a[:], b[:16])
+	return netip.AddrFrom16(a).Unmap()
+}
+
+//AddrFromIP converts a net.IP of either length to a netip.Addr, unmapping
+//IPv4-mapped addresses. It returns the zero Addr for nil or invalid input.
+func AddrFromIP(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+//unspecifiedFor returns the all-zeros address in the family of addr, which is
+//what a client sends when it has no preference (11.1 of RFC6887). For IPv4
+//this is ::ffff:0.0.0.0 on the wire rather than ::.
+func unspecifiedFor(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
+
+//IPFromAddr converts addr to a net.IP, 4 bytes long for IPv4. The zone is
+//dropped, and the zero Addr gives nil.
+func IPFromAddr(addr netip.Addr) net.IP {
+	if !addr.IsValid() {
+		return nil
+	}
+	return net.IP(addr.AsSlice())
+}
+
+//AddrPortFromUDPAddr converts a *net.UDPAddr, keeping any IPv6 zone.
+func AddrPortFromUDPAddr(u *net.UDPAddr) netip.AddrPort {
+	if u == nil {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(AddrFromIP(u.IP).WithZone(u.Zone), uint16(u.Port))
+}
+
+//suggestedAddr returns the address to put in a suggested external address
+//field: addr if set, otherwise the all-zeros address in the client's family.
+func suggestedAddr(addr netip.Addr, clientAddr netip.Addr) netip.Addr {
+	if addr.IsValid() {
+		return addr
+	}
+	return unspecifiedFor(clientAddr)
+}
+
+//sameAddr compares two addresses ignoring IPv4 mapping and IPv6 zones, e.g. when
+//checking that a response came from the server the request was sent to.
+func sameAddr(a, b netip.Addr) bool {
+	return a.Unmap().WithZone("") == b.Unmap().WithZone("")
+}
+
+//linkLocalZone returns the name of an interface with an IPv6 link-local address,
+//used to scope a link-local server address that was discovered without a zone.
+func linkLocalZone() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if x, ok := a.(*net.IPNet); ok && x.IP.To4() == nil && x.IP.IsLinkLocalUnicast() {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
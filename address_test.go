@@ -0,0 +1,61 @@
+package pcp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestAddrRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		wire string
+		read string
+	}{
+		{"192.0.2.1", "::ffff:192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "::ffff:192.0.2.1", "192.0.2.1"},
+		{"0.0.0.0", "::ffff:0.0.0.0", "0.0.0.0"},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1", "fe80::1"},
+		{"fe80::1%2", "fe80::1", "fe80::1"},
+		{"::", "::", "::"},
+	} {
+		b := appendAddr([]byte{0xaa}, netip.MustParseAddr(c.addr))
+		wire := netip.MustParseAddr(c.wire).As16()
+		if len(b) != 17 || b[0] != 0xaa || !bytes.Equal(b[1:], wire[:]) {
+			t.Errorf("%s written as %x, want %x", c.addr, b[1:], wire)
+			continue
+		}
+		if got := getAddr(b[1:]); got != netip.MustParseAddr(c.read) {
+			t.Errorf("%s read back as %s, want %s", c.addr, got, c.read)
+		}
+	}
+	//The zero Addr is sent as all zeros
+	if b := appendAddr(nil, netip.Addr{}); !bytes.Equal(b, make([]byte, 16)) {
+		t.Errorf("zero Addr written as %x", b)
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		same bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "::ffff:192.0.2.1", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.2", false},
+		{"192.0.2.1", "::c000:201", false},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"fe80::1%eth0", "fe80::1%eth1", true},
+		{"fe80::1%eth0", "fe80::2%eth0", false},
+		{"2001:db8::1", "2001:db8::1", true},
+	} {
+		if got := sameAddr(netip.MustParseAddr(c.a), netip.MustParseAddr(c.b)); got != c.same {
+			t.Errorf("sameAddr(%s, %s) = %v", c.a, c.b, got)
+		}
+	}
+	if !sameAddr(netip.Addr{}, netip.Addr{}) || sameAddr(netip.Addr{}, netip.IPv6Unspecified()) {
+		t.Error("zero Addr compared wrongly")
+	}
+}
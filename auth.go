@@ -0,0 +1,394 @@
+package pcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"net/netip"
+	"sync"
+)
+
+//Prf is a pseudo-random function for PCP authentication key derivation,
+//numbered as IKEv2 transform type 2, see 5.3.5 of RFC7652.
+type Prf uint32
+
+const (
+	PrfHmacSha1   Prf = 2
+	PrfHmacSha256 Prf = 5
+)
+
+//MacAlgorithm computes authentication tags, numbered as IKEv2 transform type
+//3, see 5.3.6 of RFC7652.
+type MacAlgorithm uint32
+
+const (
+	MacHmacSha1_96    MacAlgorithm = 2
+	MacHmacSha256_128 MacAlgorithm = 12
+)
+
+//DefaultPrfs and DefaultMacAlgorithms are the algorithms offered by a
+//PAServer and accepted by the client, most preferred first.
+var (
+	DefaultPrfs          = []Prf{PrfHmacSha256, PrfHmacSha1}
+	DefaultMacAlgorithms = []MacAlgorithm{MacHmacSha256_128, MacHmacSha1_96}
+)
+
+func (p Prf) hash() func() hash.Hash {
+	switch p {
+	case PrfHmacSha1:
+		return sha1.New
+	case PrfHmacSha256:
+		return sha256.New
+	}
+	return nil
+}
+
+func (m MacAlgorithm) hash() func() hash.Hash {
+	switch m {
+	case MacHmacSha1_96:
+		return sha1.New
+	case MacHmacSha256_128:
+		return sha256.New
+	}
+	return nil
+}
+
+//keySize is the length of the key the algorithm is used with.
+func (m MacAlgorithm) keySize() int {
+	switch m {
+	case MacHmacSha1_96:
+		return sha1.Size
+	case MacHmacSha256_128:
+		return sha256.Size
+	}
+	return 0
+}
+
+//tagSize is the length of the truncated MAC carried in a tag.
+func (m MacAlgorithm) tagSize() int {
+	switch m {
+	case MacHmacSha1_96:
+		return 12
+	case MacHmacSha256_128:
+		return 16
+	}
+	return 0
+}
+
+//prfPlus is prf+ of 2.13 of RFC7296, stretching prf output to n octets.
+func prfPlus(prf Prf, key, seed []byte, n int) []byte {
+	var out, t []byte
+	for i := byte(1); len(out) < n; i++ {
+		h := hmac.New(prf.hash(), key)
+		h.Write(t)
+		h.Write(seed)
+		h.Write([]byte{i})
+		t = h.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+//deriveKey derives the key protecting a PCP authentication session from the
+//EAP MSK, as described in 6.1 of RFC7652:
+//
+//	prf+(MSK, "IETF PCP" | Session ID | Nonce1 | Nonce2 | Key ID)
+func deriveKey(prf Prf, mac MacAlgorithm, msk []byte, sessionID, nonce1, nonce2, keyID uint32) []byte {
+	seed := []byte("IETF PCP")
+	seed = appendUint32(seed, sessionID)
+	seed = appendUint32(seed, nonce1)
+	seed = appendUint32(seed, nonce2)
+	seed = appendUint32(seed, keyID)
+	return prfPlus(prf, msk, seed, mac.keySize())
+}
+
+//computeTag writes the MAC of msg into msg[off:off+size]. The tag covers the
+//whole message with the field itself zeroed.
+func computeTag(mac MacAlgorithm, key, msg []byte, off int) {
+	size := mac.tagSize()
+	for i := off; i < off+size; i++ {
+		msg[i] = 0
+	}
+	h := hmac.New(mac.hash(), key)
+	h.Write(msg)
+	copy(msg[off:off+size], h.Sum(nil))
+}
+
+//checkTag reports whether msg[off:off+size] is the MAC of msg. msg is left
+//as it was.
+func checkTag(mac MacAlgorithm, key, msg []byte, off int) bool {
+	size := mac.tagSize()
+	if size == 0 || off+size != len(msg) {
+		return false
+	}
+	var saved [32]byte
+	copy(saved[:], msg[off:])
+	computeTag(mac, key, msg, off)
+	ok := hmac.Equal(saved[:size], msg[off:])
+	copy(msg[off:], saved[:size])
+	return ok
+}
+
+//replayWindow rejects sequence numbers already seen or older than the last
+//64, allowing for reordering, like the anti-replay window of IPsec.
+type replayWindow struct {
+	started bool
+	last    uint32
+	seen    uint64
+}
+
+func (w *replayWindow) accept(seq uint32) bool {
+	if !w.started {
+		w.started, w.last, w.seen = true, seq, 1
+		return true
+	}
+	if seq > w.last {
+		shift := seq - w.last
+		if shift >= 64 {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.last = seq
+		return true
+	}
+	back := w.last - seq
+	if back >= 64 || w.seen&(1<<back) != 0 {
+		return false
+	}
+	w.seen |= 1 << back
+	return true
+}
+
+//paKey is a key protecting a PCP authentication session.
+type paKey struct {
+	mac   MacAlgorithm
+	key   []byte
+	keyID uint32
+}
+
+//paState is the security association of a PCP authentication session, held
+//by both the client and the server. seq counts the messages sent, recv the
+//ones received; both continue over re-authentications.
+type paState struct {
+	mu          sync.Mutex
+	sessionID   uint32
+	established bool
+	paKey
+	prf Prf
+	//renew is the Unix time the client re-authenticates, 3/4 through the
+	//session lifetime, and expires the time the lifetime ends. Zero is never.
+	renew   int64
+	expires int64
+	seq     uint32
+	recv    replayWindow
+}
+
+//currentKey returns the key of the established session, or nil.
+func (st *paState) currentKey() *paKey {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.established {
+		return nil
+	}
+	k := st.paKey
+	return &k
+}
+
+func (st *paState) nextSeq() uint32 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq++
+	return st.seq
+}
+
+//reset starts a new session, forgetting the old key.
+func (st *paState) reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sessionID, st.established, st.paKey, st.prf = 0, false, paKey{}, 0
+	st.renew, st.expires, st.seq, st.recv = 0, 0, 0, replayWindow{}
+}
+
+//appendAuthTag appends an AUTHENTICATION_TAG option to msg, a common PCP
+//message, using the next sequence number.
+func (st *paState) appendAuthTag(msg []byte) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.established {
+		return msg, ErrNotAuthenticated
+	}
+	st.seq++
+	size := st.mac.tagSize()
+	msg = append(msg, byte(OptionOpAuthenticationTag), 0)
+	msg = appendUint16(msg, uint16(12+size))
+	msg = appendUint32(msg, st.sessionID)
+	msg = appendUint32(msg, st.seq)
+	msg = appendUint32(msg, st.keyID)
+	off := len(msg)
+	msg = append(msg, make([]byte, size)...)
+	computeTag(st.mac, st.key, msg, off)
+	return msg, nil
+}
+
+//verifyAuthTag checks the AUTHENTICATION_TAG ending msg, whose options start
+//at optionsStart, and that its sequence number has not been seen before.
+func (st *paState) verifyAuthTag(msg []byte, optionsStart int) (err error) {
+	opt, off, err := lastOption(msg, optionsStart)
+	if err != nil || opt.opCode != OptionOpAuthenticationTag || len(opt.data) < 12 {
+		return ErrAuthenticationTag
+	}
+	sessionID := binary.BigEndian.Uint32(opt.data[0:4])
+	seq := binary.BigEndian.Uint32(opt.data[4:8])
+	keyID := binary.BigEndian.Uint32(opt.data[8:12])
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.established || sessionID != st.sessionID || keyID != st.keyID {
+		return ErrAuthenticationTag
+	}
+	if !checkTag(st.mac, st.key, msg, off+12) {
+		return ErrAuthenticationTag
+	}
+	if !st.recv.accept(seq) {
+		return ErrReplayedMessage
+	}
+	return nil
+}
+
+//appendPATag appends a PA_AUTHENTICATION_TAG option to msg, an
+//authentication message, see 5.3.2 of RFC7652.
+func appendPATag(msg []byte, k *paKey) []byte {
+	size := k.mac.tagSize()
+	msg = append(msg, byte(OptionOpPaAuthenticationTag), 0)
+	msg = appendUint16(msg, uint16(4+size))
+	msg = appendUint32(msg, k.keyID)
+	off := len(msg)
+	msg = append(msg, make([]byte, size)...)
+	computeTag(k.mac, k.key, msg, off)
+	return msg
+}
+
+//checkPATag reports whether the PA_AUTHENTICATION_TAG ending msg, an
+//authentication message, was made with k.
+func checkPATag(msg []byte, k *paKey) bool {
+	opt, off, err := lastOption(msg, headerSize+paDataSize)
+	if err != nil || opt.opCode != OptionOpPaAuthenticationTag || len(opt.data) < 4 {
+		return false
+	}
+	if binary.BigEndian.Uint32(opt.data[0:4]) != k.keyID {
+		return false
+	}
+	return checkTag(k.mac, k.key, msg, off+4)
+}
+
+//lastOption returns the last option of msg and the offset of its data. Tags
+//must be the last option, as they cover everything before them.
+func lastOption(msg []byte, optionsStart int) (opt PCPOption, off int, err error) {
+	if optionsStart >= len(msg) {
+		return PCPOption{}, 0, ErrMalformedResponse
+	}
+	for rest := msg[optionsStart:]; len(rest) > 0; {
+		off = len(msg) - len(rest) + 4
+		opt, rest, err = nextOption(rest)
+		if err != nil {
+			return PCPOption{}, 0, err
+		}
+	}
+	return opt, off, nil
+}
+
+//paMessage is the content of an authentication message.
+type paMessage struct {
+	result    ResultCode
+	sessionID uint32
+	seq       uint32
+	options   []PCPOption
+}
+
+//appendPARequest appends an authentication message from the client. Its
+//type goes in the last reserved octet of the header.
+func appendPARequest(b []byte, clientAddr netip.Addr, m *paMessage) []byte {
+	b = appendRequestHeader(b, OpAuthentication, 0, clientAddr)
+	b[len(b)-headerSize+3] = byte(m.result)
+	b = appendUint32(b, m.sessionID)
+	b = appendUint32(b, m.seq)
+	return appendOptions(b, m.options)
+}
+
+//appendPAResponse appends an authentication message from the server.
+func appendPAResponse(b []byte, epoch uint32, m *paMessage) []byte {
+	b = appendResponseHeader(b, OpAuthentication, m.result, 0, epoch)
+	b = appendUint32(b, m.sessionID)
+	b = appendUint32(b, m.seq)
+	return appendOptions(b, m.options)
+}
+
+//parsePA reads the session ID and sequence number of an authentication message.
+func parsePA(opData []byte, options []PCPOption, result ResultCode) (m paMessage, err error) {
+	if len(opData) < paDataSize {
+		return m, ErrMalformedResponse
+	}
+	m.result = result
+	m.sessionID = binary.BigEndian.Uint32(opData[0:4])
+	m.seq = binary.BigEndian.Uint32(opData[4:8])
+	m.options = options
+	return m, nil
+}
+
+func uint32Option(code OptionOpCode, v uint32) PCPOption {
+	return PCPOption{code, appendUint32(nil, v)}
+}
+
+//option returns the data of the first option with code.
+func (m *paMessage) option(code OptionOpCode) ([]byte, bool) {
+	for _, o := range m.options {
+		if o.opCode == code {
+			return o.data, true
+		}
+	}
+	return nil, false
+}
+
+func (m *paMessage) uint32Option(code OptionOpCode) (uint32, bool) {
+	data, ok := m.option(code)
+	if !ok || len(data) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data), true
+}
+
+//uint32Options returns the values of every option with code, e.g. the
+//algorithms a server offers.
+func (m *paMessage) uint32Options(code OptionOpCode) (values []uint32) {
+	for _, o := range m.options {
+		if o.opCode == code && len(o.data) >= 4 {
+			values = append(values, binary.BigEndian.Uint32(o.data))
+		}
+	}
+	return
+}
+
+//eapOption returns the EAP packet carried by the message.
+func (m *paMessage) eapOption() (p eapPacket, err error) {
+	data, ok := m.option(OptionOpEapPayload)
+	if !ok {
+		return p, ErrEAPFormat
+	}
+	err = p.unmarshal(data)
+	return
+}
+
+func eapOption(p *eapPacket) PCPOption {
+	return PCPOption{OptionOpEapPayload, p.appendTo(nil)}
+}
+
+func randomUint32() (uint32, error) {
+	b, err := genRandomBytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
@@ -0,0 +1,381 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//authenticateSessions establishes a PCP authentication session with the
+//server of each session and starts keeping them alive. It only fails if no
+//server accepted the client; the others keep retrying in the background.
+func (c *Client) authenticateSessions(sessions []*Session) (err error) {
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+			defer cancel()
+			errs[i] = c.authenticate(ctx, s)
+		}(i, s)
+	}
+	wg.Wait()
+	c.wg.Add(len(sessions))
+	for _, s := range sessions {
+		go c.keepAuthenticated(s)
+	}
+	for i, e := range errs {
+		if e == nil {
+			return nil
+		}
+		log.Errorf("Could not authenticate with PCP server %s: %s", sessions[i].Addr, e)
+		if err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+//keepAuthenticated re-authenticates with the server of s 3/4 through each
+//session lifetime, or when the server asks for it. Failed attempts are
+//retried with the backoff used for requests.
+func (c *Client) keepAuthenticated(s *Session) {
+	defer c.wg.Done()
+	retry := initialRetransmitTime
+	for {
+		var timeout <-chan time.Time
+		var t Timer
+		st := s.auth
+		st.mu.Lock()
+		switch {
+		case !st.established:
+			t = c.clock.NewTimer(retry)
+		case st.renew > 0:
+			t = c.clock.NewTimer(time.Duration(st.renew-c.clock.Now().Unix()) * time.Second)
+		}
+		st.mu.Unlock()
+		if t != nil {
+			timeout = t.C()
+		}
+		select {
+		case <-c.done:
+		case <-s.done:
+		case <-s.reauth:
+		case <-timeout:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if c.isClosed() || sessionDone(s) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+		err := c.authenticate(ctx, s)
+		cancel()
+		if err != nil {
+			log.Errorf("Could not authenticate with PCP server %s: %s", s.Addr, err)
+			retry *= 2
+			if retry > maxRetransmitTime {
+				retry = maxRetransmitTime
+			}
+		} else {
+			retry = initialRetransmitTime
+		}
+	}
+}
+
+func sessionDone(s *Session) bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//requestReauth asks the keepAuthenticated goroutine of s to authenticate now.
+func (c *Client) requestReauth(s *Session) {
+	select {
+	case s.reauth <- struct{}{}:
+	default:
+	}
+}
+
+//authenticate runs the exchange of 4 of RFC7652 with the server of s,
+//starting a PA session or, if one is established, re-authenticating within
+//it. The current key stays in use until the new one is confirmed.
+func (c *Client) authenticate(ctx context.Context, s *Session) (err error) {
+	addr, err := s.internalAddress()
+	if err != nil {
+		return ErrNoInternalAddress
+	}
+	st := s.auth
+	old := st.currentKey()
+	if old == nil {
+		st.reset()
+	}
+	st.mu.Lock()
+	sessionID := st.sessionID
+	st.mu.Unlock()
+	n1, err := randomUint32()
+	if err != nil {
+		return
+	}
+	peer := c.newEAPPeer()
+	m := paMessage{ResultInitiation, sessionID, st.nextSeq(), []PCPOption{uint32Option(OptionOpNonce, n1)}}
+
+	var (
+		started    bool
+		n2         uint32
+		prf        Prf
+		mac        MacAlgorithm
+		prfs, macs []uint32
+	)
+	for {
+		reply, raw, err := c.paExchange(ctx, s, addr, &m, old)
+		if err != nil {
+			return err
+		}
+		//Within a session every message is tagged with the current key, except
+		//the one confirming a new key, and the answer of a server that lost it
+		if old != nil && reply.result != ResultAuthenticationSucceeded && reply.result != ResultUnknownSessionId && !checkPATag(raw, old) {
+			log.Debugf("Dropped authentication message from %s with an invalid tag", s.Addr)
+			continue
+		}
+		switch reply.result {
+		case ResultAuthenticationRequest:
+			if !started {
+				if sessionID == 0 {
+					sessionID = reply.sessionID
+				}
+				var ok bool
+				if n2, ok = reply.uint32Option(OptionOpNonce); !ok {
+					return ErrMalformedResponse
+				}
+				prfs, macs = reply.uint32Options(OptionOpPrf), reply.uint32Options(OptionOpMacAlgorithm)
+				if prf, mac, err = chooseAlgorithms(prfs, macs); err != nil {
+					return err
+				}
+			}
+			if reply.sessionID != sessionID {
+				return ErrUnknownSession
+			}
+			req, err := reply.eapOption()
+			if err != nil {
+				return err
+			}
+			res, err := respondEAP(peer, &req)
+			if err != nil {
+				return err
+			}
+			options := []PCPOption{eapOption(&res), uint32Option(OptionOpReceivedPak, reply.seq)}
+			if !started {
+				options = append(options,
+					uint32Option(OptionOpNonce, n1),
+					uint32Option(OptionOpPrf, uint32(prf)),
+					uint32Option(OptionOpMacAlgorithm, uint32(mac)))
+				started = true
+			}
+			m = paMessage{ResultAuthenticationReply, sessionID, st.nextSeq(), options}
+		case ResultAuthenticationSucceeded:
+			if !started || reply.sessionID != sessionID {
+				return ErrMalformedResponse
+			}
+			msk := peer.MSK()
+			if msk == nil {
+				return ErrEAPAuthentication
+			}
+			k := &paKey{mac: mac, keyID: 1}
+			if old != nil {
+				k.keyID = old.keyID + 1
+			}
+			k.key = deriveKey(prf, mac, msk, sessionID, n1, n2, k.keyID)
+			if !checkPATag(raw, k) {
+				return ErrAuthenticationTag
+			}
+			//The offer is repeated under the new key, so a tampered one shows
+			if !equalUint32s(reply.uint32Options(OptionOpPrf), prfs) || !equalUint32s(reply.uint32Options(OptionOpMacAlgorithm), macs) {
+				return ErrDowngradeDetected
+			}
+			lifetime, _ := reply.uint32Option(OptionOpSessionLifetime)
+			now := c.clock.Now().Unix()
+			st.mu.Lock()
+			st.sessionID, st.established, st.paKey, st.prf = sessionID, true, *k, prf
+			st.renew, st.expires = 0, 0
+			if lifetime > 0 {
+				st.renew = now + int64(lifetime)*3/4
+				st.expires = now + int64(lifetime)
+			}
+			st.mu.Unlock()
+			ack := paMessage{ResultAuthenticationSucceeded, sessionID, st.nextSeq(), []PCPOption{uint32Option(OptionOpReceivedPak, reply.seq)}}
+			if err := c.sendPA(s, addr, &ack, k); err != nil {
+				log.Debugf("Could not acknowledge authentication with %s: %s", s.Addr, err)
+			}
+			log.Debugf("Authenticated with PCP server %s, session %d key %d", s.Addr, sessionID, k.keyID)
+			//A new session means the server had forgotten the client, and
+			//any mapping it held may be gone with it
+			if old == nil {
+				c.refreshMappings(s)
+			}
+			return nil
+		case ResultUnknownSessionId, ResultSessionTerminated:
+			st.reset()
+			if old != nil {
+				return c.authenticate(ctx, s)
+			}
+			return &ResultError{reply.result}
+		default:
+			return &ResultError{reply.result}
+		}
+	}
+}
+
+//paExchange sends an authentication message, tagged with k if not nil, and
+//returns the server's answer to it and the raw message. Answers to earlier
+//messages, which a server repeats for a retransmission, are skipped.
+func (c *Client) paExchange(ctx context.Context, s *Session, addr netip.Addr, m *paMessage, k *paKey) (reply paMessage, raw []byte, err error) {
+	buf := requestBuffers.Get().(*[]byte)
+	defer requestBuffers.Put(buf)
+	msg := appendPARequest((*buf)[:0], addr, m)
+	if k != nil {
+		msg = appendPATag(msg, k)
+	}
+	if len(msg) > maxPacketSize {
+		return reply, nil, ErrRequestDataPayload
+	}
+	key := mappingKey{session: s, op: OpAuthentication}
+	for {
+		res, err := c.exchange(ctx, s, key, msg, false, "")
+		if err != nil {
+			return reply, nil, err
+		}
+		reply, err = parsePA(res.opData, res.pcpOptions, res.resultCode)
+		if err != nil {
+			log.Debugf("Malformed authentication message from %s: %s", s.Addr, err)
+			continue
+		}
+		if pak, ok := reply.uint32Option(OptionOpReceivedPak); ok && pak != m.seq {
+			continue
+		}
+		return reply, res.raw, nil
+	}
+}
+
+//sendPA sends an authentication message that expects no answer.
+func (c *Client) sendPA(s *Session, addr netip.Addr, m *paMessage, k *paKey) error {
+	buf := requestBuffers.Get().(*[]byte)
+	defer requestBuffers.Put(buf)
+	msg := appendPATag(appendPARequest((*buf)[:0], addr, m), k)
+	return c.sendMessage(s, msg)
+}
+
+//sendSigned sends a common request with an AUTHENTICATION_TAG. Every
+//transmission gets its own sequence number, so retransmissions are not
+//taken for replays.
+func (c *Client) sendSigned(s *Session, msg []byte) (err error) {
+	buf := requestBuffers.Get().(*[]byte)
+	defer requestBuffers.Put(buf)
+	signed, err := s.auth.appendAuthTag(append((*buf)[:0], msg...))
+	if err != nil {
+		return
+	}
+	if len(signed) > maxPacketSize {
+		return ErrRequestDataPayload
+	}
+	_, err = s.conn.Write(signed)
+	return
+}
+
+//verifyResponse checks the AUTHENTICATION_TAG of a common response and
+//reports whether to process it. A server that has lost the session cannot
+//tag its answer, so untagged results asking for authentication start a
+//re-authentication, but are dropped like any other untagged response: anyone
+//could send them, and pending requests are retransmitted once the new
+//session is up. Unsolicited ANNOUNCE responses are untagged too; at worst a
+//forged one causes a round of renewals.
+func (c *Client) verifyResponse(s *Session, res *ResponsePacket, msg []byte) bool {
+	err := s.auth.verifyAuthTag(msg, headerSize+len(res.opData))
+	if err == nil {
+		return true
+	}
+	switch {
+	case res.resultCode == ResultAuthenticationRequired || res.resultCode == ResultUnknownSessionId || res.resultCode == ResultSessionTerminated:
+		log.Debugf("PCP server %s asked for authentication: %s", s.Addr, res.resultCode)
+		c.requestReauth(s)
+		return false
+	case res.opCode == OpAnnounce:
+		return true
+	}
+	log.Debugf("Dropped response from %s: %s", s.Addr, err)
+	return false
+}
+
+//handlePA passes an authentication message to the authentication waiting
+//for it. A server ending the session unprompted is handled here, as nothing
+//waits for that.
+func (c *Client) handlePA(s *Session, res *ResponsePacket, msg []byte) {
+	if res.resultCode == ResultSessionTerminated {
+		if k := s.auth.currentKey(); k != nil && checkPATag(msg, k) {
+			log.Infof("PCP server %s ended the authentication session", s.Addr)
+			s.auth.reset()
+			c.requestReauth(s)
+		}
+	}
+	res.raw = msg
+	c.notifyWaiters(s, res)
+}
+
+//chooseAlgorithms picks the first offered algorithms this package supports,
+//as the server lists them in order of preference.
+func chooseAlgorithms(prfs, macs []uint32) (prf Prf, mac MacAlgorithm, err error) {
+	for _, p := range prfs {
+		if Prf(p).hash() != nil {
+			prf = Prf(p)
+			break
+		}
+	}
+	for _, m := range macs {
+		if MacAlgorithm(m).hash() != nil {
+			mac = MacAlgorithm(m)
+			break
+		}
+	}
+	if prf == 0 || mac == 0 {
+		return 0, 0, ErrNoCommonAlgorithm
+	}
+	return
+}
+
+//respondEAP answers an EAP request with the peer's identity or method.
+func respondEAP(peer EAPPeer, req *eapPacket) (res eapPacket, err error) {
+	if req.Code != EapRequest {
+		return res, ErrEAPFormat
+	}
+	res = eapPacket{Code: EapResponse, Identifier: req.Identifier, Type: req.Type}
+	switch req.Type {
+	case EapTypeIdentity:
+		res.Data = []byte(peer.Identity())
+	case peer.Type():
+		res.Data, err = peer.Respond(req.Data)
+	default:
+		err = ErrEAPAuthentication
+	}
+	return
+}
+
+func equalUint32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,435 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	//DefaultSessionLifetime is the lifetime of PA sessions, in seconds, when
+	//PAServer.SessionLifetime is not set.
+	DefaultSessionLifetime = 24 * 3600
+	//DefaultMaxPendingSessions is how many PA sessions may be being set up at
+	//once when PAServer.MaxPendingSessions is not set.
+	DefaultMaxPendingSessions = 1024
+	//paSetupTime bounds an authentication that was started but not finished.
+	paSetupTime = 120
+)
+
+//PAServer is the server side of PCP authentication (RFC7652), for PCP
+//servers built on this package. Authentication requests go to HandlePA;
+//every other request is checked with Verify before it is acted on, and the
+//response tagged with Sign.
+type PAServer struct {
+	//NewAuthenticator returns the server side of the EAP method for each
+	//authentication, e.g. NewPSKAuthenticator.
+	NewAuthenticator func() EAPAuthenticator
+	//Prfs and MacAlgorithms are offered in order of preference. If nil,
+	//DefaultPrfs and DefaultMacAlgorithms are offered.
+	Prfs          []Prf
+	MacAlgorithms []MacAlgorithm
+	//SessionLifetime is in seconds. Clients re-authenticate before it ends.
+	SessionLifetime uint32
+	//MaxPendingSessions caps the sessions started but not yet authenticated;
+	//further initiations are dropped until some finish or expire.
+	MaxPendingSessions int
+	//Clock is the system clock if nil.
+	Clock Clock
+
+	mu        sync.Mutex
+	sessions  map[uint32]*paServerSession
+	pending   int
+	lastSweep int64
+}
+
+//paServerSession is a PA session with one client. The fields besides
+//paState belong to the authentication in progress, and to answering a
+//retransmitted request with the reply already sent.
+type paServerSession struct {
+	paState
+	identity string
+
+	eap             EAPAuthenticator
+	eapID           uint8
+	pendingIdentity string
+	n1, n2          uint32
+	pendingPrf      Prf
+	pendingMac      MacAlgorithm
+
+	lastSeq   uint32
+	lastReply []byte
+}
+
+func (p *PAServer) now() int64 {
+	if p.Clock == nil {
+		return realClock{}.Now().Unix()
+	}
+	return p.Clock.Now().Unix()
+}
+
+func (p *PAServer) prfs() []Prf {
+	if p.Prfs == nil {
+		return DefaultPrfs
+	}
+	return p.Prfs
+}
+
+func (p *PAServer) macAlgorithms() []MacAlgorithm {
+	if p.MacAlgorithms == nil {
+		return DefaultMacAlgorithms
+	}
+	return p.MacAlgorithms
+}
+
+func (p *PAServer) sessionLifetime() uint32 {
+	if p.SessionLifetime == 0 {
+		return DefaultSessionLifetime
+	}
+	return p.SessionLifetime
+}
+
+func (p *PAServer) maxPendingSessions() int {
+	if p.MaxPendingSessions == 0 {
+		return DefaultMaxPendingSessions
+	}
+	return p.MaxPendingSessions
+}
+
+//sweep drops the sessions whose lifetime is over, at most once a second, and
+//recounts those still being set up. In between, sessions that finished
+//setting up are still counted as pending. p.mu must be held.
+func (p *PAServer) sweep(now int64) {
+	if now == p.lastSweep {
+		return
+	}
+	p.lastSweep = now
+	p.pending = 0
+	for id, sess := range p.sessions {
+		sess.mu.Lock()
+		expired, established := sess.expires <= now, sess.established
+		sess.mu.Unlock()
+		if expired {
+			delete(p.sessions, id)
+		} else if !established {
+			p.pending++
+		}
+	}
+}
+
+//session returns the session with id, dropping it if its lifetime is over.
+//p.mu must be held.
+func (p *PAServer) session(id uint32) *paServerSession {
+	sess := p.sessions[id]
+	if sess == nil {
+		return nil
+	}
+	sess.mu.Lock()
+	expired := sess.expires <= p.now()
+	sess.mu.Unlock()
+	if expired {
+		delete(p.sessions, id)
+		return nil
+	}
+	return sess
+}
+
+//HandlePA processes an authentication request and returns the reply to send
+//to the client, if any. epoch is the server's current epoch time. Requests
+//that fail verification, or initiations beyond MaxPendingSessions, return an
+//error and should be dropped.
+func (p *PAServer) HandlePA(req []byte, epoch uint32) (reply []byte, err error) {
+	v, err := parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if v.opCode() != OpAuthentication {
+		return nil, ErrMalformedRequest
+	}
+	var options []PCPOption
+	for rest := v.options(); len(rest) > 0; {
+		var option PCPOption
+		if option, rest, err = nextOption(rest); err != nil {
+			return nil, ErrMalformedRequest
+		}
+		options = append(options, option)
+	}
+	m, err := parsePA(v.opData(), options, v.resultCode())
+	if err != nil {
+		return nil, ErrMalformedRequest
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(p.now())
+	var sess *paServerSession
+	if m.sessionID == 0 {
+		if m.result != ResultInitiation {
+			return nil, ErrUnknownSession
+		}
+		if sess, err = p.newSession(); err != nil {
+			return nil, err
+		}
+	} else if sess = p.session(m.sessionID); sess == nil {
+		//The client will start over; there is no key to tag this with
+		return appendPAResponse(nil, epoch, &paMessage{
+			result:    ResultUnknownSessionId,
+			sessionID: m.sessionID,
+			options:   []PCPOption{uint32Option(OptionOpReceivedPak, m.seq)},
+		}), nil
+	}
+	if sess.lastReply != nil && m.seq == sess.lastSeq {
+		return sess.lastReply, nil
+	}
+	k := sess.currentKey()
+	if k != nil && !checkPATag(req, k) {
+		return nil, ErrAuthenticationTag
+	}
+	sess.mu.Lock()
+	fresh := sess.recv.accept(m.seq)
+	sess.mu.Unlock()
+	if !fresh {
+		return nil, ErrReplayedMessage
+	}
+
+	switch m.result {
+	case ResultInitiation:
+		n1, ok := m.uint32Option(OptionOpNonce)
+		if !ok {
+			return nil, ErrMalformedRequest
+		}
+		if sess.n2, err = randomUint32(); err != nil {
+			return nil, err
+		}
+		sess.eap = p.NewAuthenticator()
+		sess.n1, sess.pendingPrf, sess.pendingMac, sess.pendingIdentity = n1, 0, 0, ""
+		sess.eapID++
+		options := []PCPOption{uint32Option(OptionOpNonce, sess.n2)}
+		options = append(options, p.offer()...)
+		options = append(options, eapOption(&eapPacket{Code: EapRequest, Identifier: sess.eapID, Type: EapTypeIdentity}))
+		return p.reply(sess, ResultAuthenticationRequest, m.seq, options, epoch, k), nil
+	case ResultAuthenticationReply:
+		if sess.eap == nil {
+			return nil, ErrMalformedRequest
+		}
+		return p.continueEAP(sess, &m, epoch, k)
+	case ResultAuthenticationSucceeded:
+		//The client confirming the new key; nothing more to say
+		return nil, nil
+	}
+	return nil, ErrMalformedRequest
+}
+
+//continueEAP handles an AUTHENTICATION_REPLY carrying the client's next EAP
+//response. p.mu must be held.
+func (p *PAServer) continueEAP(sess *paServerSession, m *paMessage, epoch uint32, k *paKey) (reply []byte, err error) {
+	if sess.pendingMac == 0 {
+		//The first reply echoes the nonce and picks from the offer
+		n1, _ := m.uint32Option(OptionOpNonce)
+		prf, _ := m.uint32Option(OptionOpPrf)
+		mac, _ := m.uint32Option(OptionOpMacAlgorithm)
+		if n1 != sess.n1 {
+			return nil, ErrMalformedRequest
+		}
+		if !p.offered(Prf(prf), MacAlgorithm(mac)) {
+			return p.fail(sess, ResultAuthenticationFailed, m.seq, epoch, k), nil
+		}
+		sess.pendingPrf, sess.pendingMac = Prf(prf), MacAlgorithm(mac)
+	}
+	res, err := m.eapOption()
+	if err != nil || res.Code != EapResponse || res.Identifier != sess.eapID {
+		return nil, ErrEAPFormat
+	}
+	var data []byte
+	var done bool
+	switch {
+	case res.Type == EapTypeIdentity && sess.pendingIdentity == "":
+		identity := string(res.Data)
+		if identity == "" {
+			return p.fail(sess, ResultAuthenticationFailed, m.seq, epoch, k), nil
+		}
+		//Re-authentication must not change who the session belongs to
+		if sess.identity != "" && identity != sess.identity {
+			return p.fail(sess, ResultAuthorizationFailed, m.seq, epoch, k), nil
+		}
+		sess.pendingIdentity = identity
+		data, err = sess.eap.Start(identity)
+	case res.Type == sess.eap.Type() && sess.pendingIdentity != "":
+		data, done, err = sess.eap.Process(res.Data)
+	default:
+		err = ErrEAPAuthentication
+	}
+	if err != nil {
+		return p.fail(sess, ResultAuthenticationFailed, m.seq, epoch, k), nil
+	}
+	if done {
+		return p.succeed(sess, m.seq, epoch)
+	}
+	sess.eapID++
+	req := eapPacket{Code: EapRequest, Identifier: sess.eapID, Type: sess.eap.Type(), Data: data}
+	return p.reply(sess, ResultAuthenticationRequest, m.seq, []PCPOption{eapOption(&req)}, epoch, k), nil
+}
+
+//succeed installs the key derived from the EAP MSK and tells the client,
+//tagging the message with the new key. p.mu must be held.
+func (p *PAServer) succeed(sess *paServerSession, seq uint32, epoch uint32) ([]byte, error) {
+	msk := sess.eap.MSK()
+	if msk == nil {
+		return nil, ErrEAPAuthentication
+	}
+	lifetime := p.sessionLifetime()
+	sess.mu.Lock()
+	k := paKey{mac: sess.pendingMac, keyID: sess.keyID + 1}
+	k.key = deriveKey(sess.pendingPrf, k.mac, msk, sess.sessionID, sess.n1, sess.n2, k.keyID)
+	sess.established, sess.paKey, sess.prf = true, k, sess.pendingPrf
+	sess.expires = p.now() + int64(lifetime)
+	sess.mu.Unlock()
+	sess.identity, sess.eap = sess.pendingIdentity, nil
+
+	options := []PCPOption{
+		eapOption(&eapPacket{Code: EapSuccess, Identifier: sess.eapID}),
+		uint32Option(OptionOpSessionLifetime, lifetime),
+	}
+	//The offer is repeated under the new key, so the client can tell if it
+	//was tampered with, see 6.3 of RFC7652
+	options = append(options, p.offer()...)
+	return p.reply(sess, ResultAuthenticationSucceeded, seq, options, epoch, &k), nil
+}
+
+//fail ends the authentication in progress. A session that was never
+//established is forgotten; an established one keeps its key. p.mu must be held.
+func (p *PAServer) fail(sess *paServerSession, result ResultCode, seq uint32, epoch uint32, k *paKey) []byte {
+	sess.eap = nil
+	if k == nil {
+		delete(p.sessions, sess.sessionID)
+	}
+	failure := eapPacket{Code: EapFailure, Identifier: sess.eapID}
+	return p.reply(sess, result, seq, []PCPOption{eapOption(&failure)}, epoch, k)
+}
+
+//reply builds an authentication message answering the request with sequence
+//number seq, and keeps it for retransmissions of the request.
+func (p *PAServer) reply(sess *paServerSession, result ResultCode, seq uint32, options []PCPOption, epoch uint32, k *paKey) []byte {
+	options = append(options, uint32Option(OptionOpReceivedPak, seq))
+	msg := appendPAResponse(nil, epoch, &paMessage{result, sess.sessionID, sess.nextSeq(), options})
+	if k != nil {
+		msg = appendPATag(msg, k)
+	}
+	sess.lastSeq, sess.lastReply = seq, msg
+	return msg
+}
+
+func (p *PAServer) offer() (options []PCPOption) {
+	for _, prf := range p.prfs() {
+		options = append(options, uint32Option(OptionOpPrf, uint32(prf)))
+	}
+	for _, mac := range p.macAlgorithms() {
+		options = append(options, uint32Option(OptionOpMacAlgorithm, uint32(mac)))
+	}
+	return
+}
+
+func (p *PAServer) offered(prf Prf, mac MacAlgorithm) bool {
+	var prfOK, macOK bool
+	for _, x := range p.prfs() {
+		prfOK = prfOK || x == prf
+	}
+	for _, x := range p.macAlgorithms() {
+		macOK = macOK || x == mac
+	}
+	return prfOK && macOK && prf.hash() != nil && mac.hash() != nil
+}
+
+//newSession starts a session under an unused random ID, unless too many are
+//already being set up. p.mu must be held.
+func (p *PAServer) newSession() (sess *paServerSession, err error) {
+	if p.pending >= p.maxPendingSessions() {
+		return nil, ErrTooManySessions
+	}
+	if p.sessions == nil {
+		p.sessions = make(map[uint32]*paServerSession)
+	}
+	var id uint32
+	for id == 0 || p.sessions[id] != nil {
+		if id, err = randomUint32(); err != nil {
+			return nil, err
+		}
+	}
+	sess = &paServerSession{}
+	sess.sessionID = id
+	sess.expires = p.now() + paSetupTime
+	p.sessions[id] = sess
+	p.pending++
+	return sess, nil
+}
+
+//Verify checks the AUTHENTICATION_TAG of a common request and returns the
+//session it belongs to. An untagged request, or one for a session the server
+//does not know, returns the result code to answer it with. A request with an
+//invalid tag or a replayed sequence number returns an error and should be
+//dropped without an answer.
+func (p *PAServer) Verify(req []byte) (sessionID uint32, result ResultCode, err error) {
+	v, err := parseRequest(req)
+	if err != nil {
+		return 0, ResultMalformedRequest, err
+	}
+	opt, _, err := lastOption(req, headerSize+v.opDataLen())
+	if err != nil || opt.opCode != OptionOpAuthenticationTag || len(opt.data) < 12 {
+		return 0, ResultAuthenticationRequired, nil
+	}
+	sessionID = binary.BigEndian.Uint32(opt.data[0:4])
+	p.mu.Lock()
+	sess := p.session(sessionID)
+	p.mu.Unlock()
+	if sess == nil {
+		return 0, ResultUnknownSessionId, nil
+	}
+	if sess.currentKey() == nil {
+		return 0, ResultAuthenticationRequired, nil
+	}
+	if err = sess.verifyAuthTag(req, headerSize+v.opDataLen()); err != nil {
+		return 0, 0, err
+	}
+	return sessionID, ResultSuccess, nil
+}
+
+//Sign appends an AUTHENTICATION_TAG for the session to res, a response to a
+//request that passed Verify.
+func (p *PAServer) Sign(sessionID uint32, res []byte) ([]byte, error) {
+	p.mu.Lock()
+	sess := p.session(sessionID)
+	p.mu.Unlock()
+	if sess == nil {
+		return res, ErrUnknownSession
+	}
+	return sess.appendAuthTag(res)
+}
+
+//Identity returns the EAP identity the session was authenticated as, for
+//authorising what the client asks for.
+func (p *PAServer) Identity(sessionID uint32) (identity string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sess := p.session(sessionID)
+	if sess == nil || sess.currentKey() == nil {
+		return "", false
+	}
+	return sess.identity, true
+}
+
+//Terminate ends a session and returns the message telling the client, which
+//will have to authenticate again.
+func (p *PAServer) Terminate(sessionID uint32, epoch uint32) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sess := p.session(sessionID)
+	if sess == nil {
+		return nil, ErrUnknownSession
+	}
+	delete(p.sessions, sessionID)
+	k := sess.currentKey()
+	msg := appendPAResponse(nil, epoch, &paMessage{ResultSessionTerminated, sessionID, sess.nextSeq(), nil})
+	if k != nil {
+		msg = appendPATag(msg, k)
+	}
+	return msg, nil
+}
@@ -0,0 +1,187 @@
+package pcp
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var testPSKs = map[string][]byte{"alice": []byte("alice-secret")}
+
+func newPATestServer(t *testing.T, clock Clock, lifetime uint32) *testServer {
+	srv := newTestServer(t, clock)
+	srv.PA = &PAServer{
+		NewAuthenticator: func() EAPAuthenticator {
+			return NewPSKAuthenticator(func(identity string) ([]byte, bool) {
+				key, ok := testPSKs[identity]
+				return key, ok
+			})
+		},
+		SessionLifetime: lifetime,
+		Clock:           clock,
+	}
+	srv.start(t)
+	return srv
+}
+
+func withPSK(identity string, key []byte) ClientOption {
+	return WithAuthentication(func() EAPPeer { return NewPSKPeer(identity, key) })
+}
+
+//serverKey returns the key the server holds for the session.
+func serverKey(p *PAServer, sessionID uint32) *paKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sess := p.session(sessionID)
+	if sess == nil {
+		return nil
+	}
+	return sess.currentKey()
+}
+
+func mapTestPort(c *Client, port uint16, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := c.request(ctx, c.sessionList()[0], OpMap, 600, &OpDataMap{Protocol: ProtocolTCP, InternalPort: port})
+	return err
+}
+
+func TestPAWrongCredentials(t *testing.T) {
+	srv := newPATestServer(t, nil, 0)
+	if c, err := dialTestClient(srv, withPSK("alice", []byte("wrong"))); err == nil {
+		c.Close(context.Background(), false)
+		t.Fatal("authenticated with the wrong key")
+	}
+	if c, err := dialTestClient(srv, withPSK("mallory", []byte("alice-secret"))); err == nil {
+		c.Close(context.Background(), false)
+		t.Fatal("authenticated an unknown identity")
+	}
+}
+
+func TestPASession(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newPATestServer(t, clock, 40)
+	c := newTestClient(t, srv, withPSK("alice", testPSKs["alice"]), WithClock(clock))
+	st := c.sessionList()[0].auth
+
+	//Key derivation: both ends hold the same key, derived from the MSK
+	st.mu.Lock()
+	sessionID := st.sessionID
+	st.mu.Unlock()
+	k := st.currentKey()
+	if k == nil || k.keyID != 1 {
+		t.Fatalf("client key %+v", k)
+	}
+	sk := serverKey(srv.PA, sessionID)
+	if sk == nil || sk.keyID != k.keyID || sk.mac != k.mac || !bytes.Equal(sk.key, k.key) {
+		t.Fatalf("server key %+v, client key %+v", sk, k)
+	}
+	if identity, ok := srv.PA.Identity(sessionID); !ok || identity != "alice" {
+		t.Fatalf("identity %q %v", identity, ok)
+	}
+	if err := mapTestPort(c, 8080, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//Tag rejection: a response altered after tagging is dropped
+	srv.setTamper(true)
+	if err := mapTestPort(c, 8081, 300*time.Millisecond); err != ErrNetworkTimeout {
+		t.Fatalf("tampered response: %v", err)
+	}
+	srv.setTamper(false)
+
+	//Replay rejection: an earlier response sent again is dropped, even though
+	//it answers the request in flight
+	if err := mapTestPort(c, 8082, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	replayed := srv.lastResponse()
+	srv.setMute(true)
+	done := make(chan error, 1)
+	go func() { done <- mapTestPort(c, 8082, 500*time.Millisecond) }()
+	srv.send(replayed)
+	if err := <-done; err != ErrNetworkTimeout {
+		t.Fatalf("replayed response: %v", err)
+	}
+	srv.setMute(false)
+
+	//Re-authentication 3/4 through the session lifetime, under the same
+	//session with a new key
+	clock.Advance(30 * time.Second)
+	eventually(t, "re-authentication", func() bool {
+		k2 := st.currentKey()
+		return k2 != nil && k2.keyID == 2
+	})
+	k2 := st.currentKey()
+	if bytes.Equal(k2.key, k.key) {
+		t.Fatal("re-authentication kept the old key")
+	}
+	if sk := serverKey(srv.PA, sessionID); sk == nil || !bytes.Equal(sk.key, k2.key) {
+		t.Fatalf("server key after re-authentication %+v", sk)
+	}
+	if err := mapTestPort(c, 8083, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//Terminate: the client starts a new session
+	msg, err := srv.PA.Terminate(sessionID, srv.epoch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.send(msg)
+	var newID uint32
+	eventually(t, "a new session", func() bool {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		newID = st.sessionID
+		return st.established && newID != sessionID
+	})
+	if _, ok := srv.PA.Identity(sessionID); ok {
+		t.Fatal("terminated session still known")
+	}
+	if err := mapTestPort(c, 8084, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//Without re-authentication the session ends with its lifetime
+	c.Close(context.Background(), false)
+	clock.Advance(41 * time.Second)
+	if _, ok := srv.PA.Identity(newID); ok {
+		t.Fatal("session outlived its lifetime")
+	}
+}
+
+func TestPAPendingSessions(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	p := &PAServer{
+		NewAuthenticator:   func() EAPAuthenticator { return NewPSKAuthenticator(nil) },
+		MaxPendingSessions: 2,
+		Clock:              clock,
+	}
+	initiate := func(seq uint32) error {
+		m := paMessage{ResultInitiation, 0, seq, []PCPOption{uint32Option(OptionOpNonce, seq)}}
+		_, err := p.HandlePA(appendPARequest(nil, netip.MustParseAddr("192.0.2.1"), &m), 0)
+		return err
+	}
+	for seq := uint32(1); seq <= 2; seq++ {
+		if err := initiate(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := initiate(3); err != ErrTooManySessions {
+		t.Fatalf("initiation beyond the limit: %v", err)
+	}
+	//Unfinished sessions are swept once their setup time is over
+	clock.Advance((paSetupTime + 1) * time.Second)
+	if err := initiate(4); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	n := len(p.sessions)
+	p.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d sessions after sweep", n)
+	}
+}
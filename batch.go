@@ -0,0 +1,211 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultRequestRate is how many MapMany requests per second are sent to each server.
+	DefaultRequestRate = 50
+	//DefaultMaxInFlight is how many MapMany requests may await a response from each server.
+	DefaultMaxInFlight = 16
+)
+
+//MappingRequest describes one mapping for MapMany. Setting Remote makes it a
+//PEER mapping, otherwise it is a MAP mapping.
+type MappingRequest struct {
+	Protocol     Protocol
+	InternalPort uint16
+	ExternalPort uint16
+	ExternalIP   netip.Addr
+	Remote       netip.AddrPort
+	//ThirdParty makes the mapping for another host, see MapThirdParty.
+	ThirdParty ThirdParty
+	//Description labels the mapping on the server, see WithDescription.
+	Description string
+	Lifetime    uint32
+}
+
+//MappingResult is the outcome of one MappingRequest. Servers holds the
+//answer of every server, in the order of Sessions; for a PEER mapping the
+//Mapping of each is the PortMap part of the peer mapping. Err is only set
+//when no server granted the mapping, or the request itself was invalid.
+type MappingResult struct {
+	Request MappingRequest
+	Servers []ServerResult
+	Err     error
+}
+
+//opData validates the request and returns what to send for it.
+func (r *MappingRequest) opData() (op OpCode, lifetime uint32, data interface{}, err error) {
+	lifetime = clampLifetime(r.Lifetime)
+	mapData := OpDataMap{
+		Protocol:     r.Protocol,
+		InternalPort: r.InternalPort,
+		ExternalPort: r.ExternalPort,
+		ExternalIP:   r.ExternalIP,
+		ThirdParty:   ThirdParty{r.ThirdParty.Addr.Unmap(), r.ThirdParty.ID},
+		Description:  r.Description,
+	}
+	if err = r.ThirdParty.validate(); err != nil {
+		return
+	}
+	if err = validateDescription(r.Description); err != nil {
+		return
+	}
+	if !r.Remote.IsValid() {
+		err = r.Protocol.validatePorts(r.InternalPort, r.ExternalPort)
+		return OpMap, lifetime, &mapData, err
+	}
+	err = r.Protocol.validatePorts(r.InternalPort, r.ExternalPort, r.Remote.Port())
+	peerData := &OpDataPeer{
+		OpDataMap:  mapData,
+		RemotePort: r.Remote.Port(),
+		RemoteIP:   r.Remote.Addr().Unmap(),
+	}
+	return OpPeer, lifetime, peerData, err
+}
+
+//MapMany requests many mappings at once on every server and waits for the
+//answers. Requests are pipelined, but paced to the rate set by
+//WithRequestRate and limited to WithMaxInFlight outstanding requests per
+//server, so that a server's rate limiting is not tripped. Only first
+//transmissions are paced: a request left unanswered is retransmitted on its
+//own schedule (3 s, then doubling), so at most WithMaxInFlight of them go
+//out together. err is only set if the client is closed; failures of single
+//mappings are in their result.
+func (c *Client) MapMany(ctx context.Context, requests []MappingRequest) (results []MappingResult, err error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	type prepared struct {
+		op       OpCode
+		lifetime uint32
+		data     interface{}
+	}
+	sessions := c.sessionList()
+	results = make([]MappingResult, len(requests))
+	items := make([]prepared, len(requests))
+	var valid []int
+	for i := range requests {
+		results[i].Request = requests[i]
+		p := &items[i]
+		p.op, p.lifetime, p.data, results[i].Err = requests[i].opData()
+		if results[i].Err == nil {
+			results[i].Servers = make([]ServerResult, len(sessions))
+			valid = append(valid, i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for j, s := range sessions {
+		jobs := make(chan int, len(valid))
+		for _, i := range valid {
+			jobs <- i
+		}
+		close(jobs)
+		p := newPacer(c.clock, c.requestRate)
+		workers := c.maxInFlight
+		if workers > len(valid) {
+			workers = len(valid)
+		}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(j int, s *Session) {
+				defer wg.Done()
+				for i := range jobs {
+					it := items[i]
+					results[i].Servers[j] = c.mapOnSession(ctx, s, p, it.op, it.lifetime, it.data)
+				}
+			}(j, s)
+		}
+	}
+	wg.Wait()
+	c.saveNow()
+
+	for _, i := range valid {
+		for _, r := range results[i].Servers {
+			if r.Err == nil {
+				results[i].Err = nil
+				break
+			}
+			if results[i].Err == nil {
+				results[i].Err = r.Err
+			}
+		}
+	}
+	return results, nil
+}
+
+//mapOnSession sends one MapMany request to the server of s once p allows it.
+func (c *Client) mapOnSession(ctx context.Context, s *Session, p *pacer, op OpCode, lifetime uint32, data interface{}) (r ServerResult) {
+	r.Server = s.Addr
+	if r.Err = p.wait(ctx, c.done); r.Err != nil {
+		return
+	}
+	if _, r.Err = c.request(ctx, s, op, lifetime, data); r.Err != nil {
+		return
+	}
+	key := requestKey(s, op, data)
+	c.mu.Lock()
+	switch op {
+	case OpMap:
+		r.Mapping = s.Mappings[key.MappingKey]
+	case OpPeer:
+		r.Mapping = s.PeerMappings[key.MappingKey].PortMap
+	}
+	c.mu.Unlock()
+	return
+}
+
+//pacer spaces requests to one server evenly, at most rate per second. A rate
+//of zero or less does not limit anything.
+type pacer struct {
+	mu       sync.Mutex
+	clock    Clock
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(clock Clock, rate float64) *pacer {
+	p := &pacer{clock: clock}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return p
+}
+
+//wait blocks until the next request may be sent, reserving its slot.
+func (p *pacer) wait(ctx context.Context, done <-chan struct{}) error {
+	if p.interval <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	now := p.clock.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval)
+	p.mu.Unlock()
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	t := p.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-done:
+		return ErrClientClosed
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrNetworkTimeout
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+package pcp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//mapManyPorts starts MapMany for TCP mappings of ports from 8080 on, and
+//returns a channel for its results.
+func mapManyPorts(c *Client, n int) <-chan []MappingResult {
+	requests := make([]MappingRequest, n)
+	for i := range requests {
+		requests[i] = MappingRequest{Protocol: ProtocolTCP, InternalPort: 8080 + uint16(i), Lifetime: 600}
+	}
+	done := make(chan []MappingResult, 1)
+	go func() {
+		results, _ := c.MapMany(context.Background(), requests)
+		done <- results
+	}()
+	return done
+}
+
+func checkResults(t *testing.T, done <-chan []MappingResult, n int) {
+	t.Helper()
+	select {
+	case results := <-done:
+		if len(results) != n {
+			t.Fatalf("%d results for %d requests", len(results), n)
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				t.Errorf("port %d: %s", r.Request.InternalPort, r.Err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MapMany did not return")
+	}
+}
+
+//TestMapManyPacing checks that MapMany spaces its requests to one server by
+//the interval WithRequestRate sets.
+func TestMapManyPacing(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newTestServer(t, clock)
+	srv.start(t)
+	c := newTestClient(t, srv, WithClock(clock), WithRequestRate(10))
+	idle := pendingTimers(clock)
+	requests := srv.requestCount()
+
+	done := mapManyPorts(c, 4)
+	eventually(t, "the first request", func() bool { return srv.requestCount() == requests+1 })
+	//The other three have reserved their slots and wait for them
+	clock.BlockUntil(idle + 3)
+	for i := 1; i < 4; i++ {
+		clock.Advance(99 * time.Millisecond)
+		checkQuiet(t, srv, requests+i, "before the request interval")
+		clock.Advance(time.Millisecond)
+		eventually(t, "the next request", func() bool { return srv.requestCount() == requests+1+i })
+	}
+	checkResults(t, done, 4)
+}
+
+//TestMapManyInFlight checks that no more than WithMaxInFlight requests await
+//an answer from one server, and that a retransmission is sent on its own
+//schedule rather than paced.
+func TestMapManyInFlight(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newTestServer(t, clock)
+	srv.start(t)
+	c := newTestClient(t, srv, WithClock(clock), WithRequestRate(0), WithMaxInFlight(2))
+	idle := pendingTimers(clock)
+	requests := srv.requestCount()
+	srv.setMute(true)
+
+	done := mapManyPorts(c, 4)
+	eventually(t, "two requests", func() bool { return srv.requestCount() == requests+2 })
+	//Both wait for their retransmission
+	clock.BlockUntil(idle + 2)
+	checkQuiet(t, srv, requests+2, "while two requests are in flight")
+
+	//The retransmissions are answered, freeing the workers for the rest
+	srv.setMute(false)
+	clock.Advance(3 * time.Second)
+	eventually(t, "the remaining requests", func() bool { return srv.requestCount() == requests+6 })
+	checkResults(t, done, 4)
+}
@@ -1,7 +1,10 @@
 package pcp
 
 import (
+	"context"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/jackpal/gateway"
@@ -10,21 +13,24 @@ import (
 
 type Action uint8
 
-func (a Action) String() string {
-	return [...]string{"ActionReceivedAnnounce", "ActionReceivedMapping", "ActionReceivedPeer"}[a]
-}
-
 //Not the greatest naming, but will do for now.
 const (
-	ActionReceivedAnnounce = iota
+	ActionReceivedAnnounce Action = iota
 	ActionReceivedMapping
 	ActionReceivedPeer
 	ActionClose
+	//The mapping's lifetime passed without a successful renewal.
+	ActionMappingExpired
+	//The host moved to a different network and mappings were requested
+	//again there. Data is a NetworkChange.
+	ActionNetworkChanged
 )
 
 type Event struct {
 	Action Action
 	Data   interface{}
+	//Server is the PCP server the event concerns. It is unset for ActionClose.
+	Server netip.Addr
 }
 
 type ClientEpoch struct {
@@ -32,30 +38,72 @@ type ClientEpoch struct {
 	prevClientTime int64
 }
 
+//Client holds a session with each PCP server it found. Requests are sent to
+//every server; GatewayAddr, Mappings and PeerMappings belong to the primary
+//(most preferred) server, see Sessions for the others.
+//
+//GatewayAddr, Mappings, PeerMappings and Servers are replaced when the host
+//moves to a different network, and the mapping tables change as responses
+//arrive, so they must not be read directly while the client is running. Use
+//GetServerAddress, GetMappings, GetPeerMappings and GetServers, which return
+//copies.
 type Client struct {
-	GatewayAddr  net.IP
-	Event        chan Event
-	Mappings     map[uint16]PortMap
-	PeerMappings map[uint16]PeerMap
-
-	conn      *net.UDPConn
-	cancelled chan bool
-	epoch     *ClientEpoch
-	nonce     []byte
+	GatewayAddr netip.Addr
+	//Event is the default subscription. It is buffered and drops the oldest
+	//event when full; use Subscribe or OnMappingChanged for other behaviour.
+	Event        <-chan Event
+	Mappings     map[MappingKey]PortMap
+	PeerMappings map[MappingKey]PeerMap
+	//Servers lists every server found by discovery, including unreachable ones.
+	Servers []Server
+
+	//mu guards sessions, their mapping tables, epochs and waiters, which are
+	//shared with the receive loop.
+	mu           sync.Mutex
+	sessions     []*Session
+	recv         chan received
+	waiters      map[mappingKey][]*waiter
+	handles      map[mappingKey]*Mapping
+	sched        *scheduler
+	clock        Clock
+	rand         *lockedRand
+	events       *eventBus
+	discovery    Discovery
+	gateway      netip.Addr
+	noWatch      bool
+	pollInterval time.Duration
+	requestRate  float64
+	maxInFlight  int
+	store        StateStore
+	restoreMode  RestoreMode
+	stateDirty   chan struct{}
+	saveMu       sync.Mutex
+	newEAPPeer   func() EAPPeer
+	description  string
+	done         chan struct{}
+	closing      bool
+	wg           sync.WaitGroup
+	nonce        []byte
 }
 
 //Need to add support for PCP options later.
-func (c *Client) AddPortMapping(protocol Protocol, internalPort, requestedExternalPort uint16, requestedAddr net.IP, lifetime uint32) (err error) {
+func (c *Client) AddPortMapping(protocol Protocol, internalPort, requestedExternalPort uint16, requestedAddr netip.Addr, lifetime uint32) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
 	//disableChecks is a bool which stops the method from correcting parameters/applying defaults
-	if _, exists := c.Mappings[internalPort]; exists {
+	c.mu.Lock()
+	_, exists := c.Mappings[MappingKey{Protocol: protocol, InternalPort: internalPort}]
+	c.mu.Unlock()
+	if exists {
 		//Mapping already exists
 		//Should force refresh the mapping. (Using the lifetime parameter if passed.)
 		log.Debugf("mapping for port %d exists, refreshing", internalPort)
 	}
-	//Set minimum lifetime to 2 mins. Less than this is pointless.
-	if lifetime < 120 {
-		lifetime = 120
+	if err = protocol.validatePorts(internalPort, requestedExternalPort); err != nil {
+		return
 	}
+	lifetime = clampLifetime(lifetime)
 	mapData := &OpDataMap{
 		Protocol:     protocol,
 		InternalPort: internalPort,
@@ -66,17 +114,29 @@ func (c *Client) AddPortMapping(protocol Protocol, internalPort, requestedExtern
 	return
 }
 
-func (c *Client) AddPeerMapping(protocol Protocol, internalPort, requestedExternalPort, remotePort uint16, requestedAddr, remoteAddr net.IP, lifetime uint32) (err error) {
+//AddPeerMapping requests a peer mapping from internalPort to the remote
+//address and port on every server. On an IPv6-only network an IPv4 remote is
+//reached through NAT64: the server is asked for its prefix once (see
+//Client.Prefix64) and the mapping is made to the IPv4-embedded IPv6 address.
+func (c *Client) AddPeerMapping(protocol Protocol, internalPort, requestedExternalPort, remotePort uint16, requestedAddr, remoteAddr netip.Addr, lifetime uint32) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	//Responses carry the remote address unmapped, so the key must match that
+	remoteAddr = remoteAddr.Unmap()
 	//disableChecks is a bool which stops the method from correcting parameters/applying defaults
-	if _, exists := c.PeerMappings[internalPort]; exists {
+	c.mu.Lock()
+	_, exists := c.PeerMappings[MappingKey{Protocol: protocol, InternalPort: internalPort, Remote: netip.AddrPortFrom(remoteAddr, remotePort)}]
+	c.mu.Unlock()
+	if exists {
 		//Mapping already exists
 		//Should force refresh the mapping. (Using the lifetime parameter if passed.)
 		log.Debugf("peer mapping for port %d exists, refreshing", internalPort)
 	}
-	//Set minimum lifetime to 2 mins. Less than this is pointless.
-	if lifetime < 120 {
-		lifetime = 120
+	if err = protocol.validatePorts(internalPort, requestedExternalPort, remotePort); err != nil {
+		return
 	}
+	lifetime = clampLifetime(lifetime)
 	peerData := &OpDataPeer{
 		OpDataMap: OpDataMap{
 			Protocol:     protocol,
@@ -92,257 +152,460 @@ func (c *Client) AddPeerMapping(protocol Protocol, internalPort, requestedExtern
 }
 
 func (c *Client) Announce() (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
 	err = c.addMapping(OpCode(OpAnnounce), 0, nil)
 	return
 }
 
-func (c *Client) DeletePortMapping(internalPort uint16) (err error) {
-	//Should send an AddPortMapping request, setting the lifetime to zero
-	if m, exists := c.Mappings[internalPort]; exists {
-		mapData := &OpDataMap{
-			Protocol:     m.Protocol,
-			InternalPort: m.InternalPort,
-			ExternalPort: m.ExternalPort,
-			ExternalIP:   m.ExternalIP,
-		}
-		err = c.addMapping(OpMap, 0, mapData)
-	}
-	//Delete mapping from map
-L:
-	for {
-		select {
-		case event := <-c.Event:
-			if event.Action == ActionReceivedMapping {
-				m := event.Data.(PortMap)
-				if m.InternalPort == internalPort {
-					delete(c.Mappings, internalPort)
-					break L
+//DeletePortMapping asks the server to remove the mapping for protocol and
+//internalPort and waits for the lifetime zero response confirming it.
+func (c *Client) DeletePortMapping(ctx context.Context, protocol Protocol, internalPort uint16) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	return c.deleteMapping(ctx, OpMap, MappingKey{Protocol: protocol, InternalPort: internalPort})
+}
+
+//DeletePeerMapping asks the server to remove the peer mapping from
+//internalPort to remote and waits for the lifetime zero response confirming it.
+func (c *Client) DeletePeerMapping(ctx context.Context, protocol Protocol, internalPort uint16, remote netip.AddrPort) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	return c.deleteMapping(ctx, OpPeer, MappingKey{Protocol: protocol, InternalPort: internalPort, Remote: remote})
+}
+
+//deleteMapping deletes the mapping with key on every server holding it.
+func (c *Client) deleteMapping(ctx context.Context, op OpCode, key MappingKey) (err error) {
+	return c.eachSession(func(s *Session) error {
+		var data interface{}
+		c.mu.Lock()
+		switch op {
+		case OpMap:
+			if m, exists := s.Mappings[key]; exists {
+				//Deleting is a map request with the lifetime set to zero
+				data = &m.OpDataMap
+			}
+		case OpPeer:
+			if m, exists := s.PeerMappings[s.peerKey(key)]; exists {
+				data = &OpDataPeer{
+					OpDataMap:  m.OpDataMap,
+					RemotePort: m.RemotePort,
+					RemoteIP:   m.RemoteIP,
 				}
 			}
 		}
-		time.Sleep(time.Millisecond)
-	}
-	return
+		c.mu.Unlock()
+		if data == nil {
+			return ErrMappingNotFound
+		}
+		_, err := c.request(ctx, s, op, 0, data)
+		c.saveNow()
+		return err
+	})
 }
 
-func (c *Client) DeletePeerMapping(internalPort uint16) (err error) {
-	//Should send an AddPortMapping request, setting the lifetime to zero
-	if m, exists := c.PeerMappings[internalPort]; exists {
-		peerData := &OpDataPeer{
-			OpDataMap: OpDataMap{
-				Protocol:     m.Protocol,
-				InternalPort: m.InternalPort,
-				ExternalPort: m.ExternalPort,
-				ExternalIP:   m.ExternalIP,
-			},
-			RemotePort: m.RemotePort,
-			RemoteIP:   m.RemoteIP,
+//DeleteAll removes every known port and peer mapping on every server in
+//parallel, returning the first error encountered once all deletions have finished.
+func (c *Client) DeleteAll(ctx context.Context) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	var ports, peers []MappingKey
+	seen := make(map[mappingKey]bool)
+	c.mu.Lock()
+	for _, s := range c.sessions {
+		for k := range s.Mappings {
+			if !seen[mappingKey{op: OpMap, MappingKey: k}] {
+				seen[mappingKey{op: OpMap, MappingKey: k}] = true
+				ports = append(ports, k)
+			}
 		}
-		err = c.addMapping(OpPeer, 0, peerData)
-	}
-	//Delete mapping from map
-L:
-	for {
-		select {
-		case event := <-c.Event:
-			if event.Action == ActionReceivedPeer {
-				m := event.Data.(PeerMap)
-				if m.InternalPort == internalPort {
-					delete(c.PeerMappings, internalPort)
-					break L
-				}
+		for k := range s.PeerMappings {
+			if !seen[mappingKey{op: OpPeer, MappingKey: k}] {
+				seen[mappingKey{op: OpPeer, MappingKey: k}] = true
+				peers = append(peers, k)
 			}
 		}
-		time.Sleep(time.Millisecond)
+	}
+	c.mu.Unlock()
+
+	errs := make(chan error, len(ports)+len(peers))
+	for _, k := range ports {
+		go func(k MappingKey) {
+			errs <- c.deleteMapping(ctx, OpMap, k)
+		}(k)
+	}
+	for _, k := range peers {
+		go func(k MappingKey) {
+			errs <- c.deleteMapping(ctx, OpPeer, k)
+		}(k)
+	}
+	for i := 0; i < len(ports)+len(peers); i++ {
+		//Mappings removed concurrently by the server are not a failure here
+		if e := <-errs; e != nil && e != ErrMappingNotFound && err == nil {
+			err = e
+		}
 	}
 	return
 }
 
-func (c *Client) GetGatewayAddress() (addr net.IP, err error) {
-	addr, err = gateway.DiscoverGateway()
+//GetGatewayAddress returns the default gateway. It is looked up once and
+//again after a network change.
+func (c *Client) GetGatewayAddress() (addr netip.Addr, err error) {
+	if c.isClosed() {
+		return netip.Addr{}, ErrClientClosed
+	}
+	c.mu.Lock()
+	addr = c.gateway
+	c.mu.Unlock()
+	if addr.IsValid() {
+		return addr, nil
+	}
+	addr, err = discoverGateway()
 	if err != nil {
-		return nil, ErrGatewayNotFound
+		return netip.Addr{}, err
 	}
+	c.mu.Lock()
+	c.gateway = addr
+	c.mu.Unlock()
 	return addr, nil
 }
 
-func (c *Client) GetExternalAddress() (addr net.IP, err error) {
+func (c *Client) GetExternalAddress() (addr netip.Addr, err error) {
+	if c.isClosed() {
+		return netip.Addr{}, ErrClientClosed
+	}
 	// Will create a short mapping with PCP server and return the address returned
 	// by the server in the response packet. Use UDP/9 (Discard) as short mapping.
-	internalAddr, err := c.GetInternalAddress()
-	if err != nil {
-		return nil, ErrNoInternalAddress
-	}
 	mapData := &OpDataMap{
 		Protocol:     ProtocolUDP,
 		InternalPort: 9,
 		ExternalPort: 0,
-		ExternalIP:   internalAddr,
 	}
-	err = c.addMapping(OpMap, 30, mapData)
+	s, err := c.primarySession()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	res, err := c.request(context.Background(), s, OpMap, 30, mapData)
 	if err != nil {
 		log.Error(err)
-		return nil, err
-	}
-L:
-	for {
-		select {
-		case event := <-c.Event:
-			if event.Action == ActionReceivedMapping {
-				m := event.Data.(PortMap)
-				if m.InternalPort == 9 {
-					addr = m.ExternalIP
-					delete(c.Mappings, 9)
-					break L
-				}
-			}
-		}
-		time.Sleep(time.Millisecond)
+		return netip.Addr{}, err
 	}
-	return
+	var data OpDataMap
+	err = data.unmarshal(res.opData)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	//The mapping was only needed for its address, so it is deleted again. If
+	//that fails it is still forgotten here, and expires on the server.
+	if _, err := c.request(context.Background(), s, OpMap, 0, mapData); err != nil {
+		log.Debugf("Could not delete the mapping used to learn the external address: %s", err)
+	}
+	c.mu.Lock()
+	delete(s.Mappings, mapData.key())
+	c.sched.remove(requestKey(s, OpMap, mapData))
+	c.mu.Unlock()
+	c.stateChanged()
+	return data.ExternalIP, nil
+}
+
+//GetInternalAddress returns the address requests to the primary PCP server
+//are sent from. It is taken from the connected socket when the session is
+//set up, so it costs nothing per request and changes only with the network.
+//IPv6 link-local addresses carry the interface as their zone.
+func (c *Client) GetInternalAddress() (addr netip.Addr, err error) {
+	if c.isClosed() {
+		return netip.Addr{}, ErrClientClosed
+	}
+	s, err := c.primarySession()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return s.internalAddress()
+}
+
+//GetServerAddress returns the address of the primary PCP server.
+func (c *Client) GetServerAddress() netip.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.GatewayAddr
+}
+
+//GetMappings returns a copy of the port mappings held on the primary server.
+func (c *Client) GetMappings() map[MappingKey]PortMap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mappings := make(map[MappingKey]PortMap, len(c.Mappings))
+	for k, m := range c.Mappings {
+		mappings[k] = m
+	}
+	return mappings
+}
+
+//GetPeerMappings returns a copy of the peer mappings held on the primary
+//server.
+func (c *Client) GetPeerMappings() map[MappingKey]PeerMap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mappings := make(map[MappingKey]PeerMap, len(c.PeerMappings))
+	for k, m := range c.PeerMappings {
+		mappings[k] = m
+	}
+	return mappings
+}
+
+//GetServers returns a copy of the servers found by discovery.
+func (c *Client) GetServers() []Server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	servers := make([]Server, len(c.Servers))
+	for i, srv := range c.Servers {
+		servers[i] = Server{append([]netip.Addr(nil), srv.Addrs...), srv.Source}
+	}
+	return servers
 }
 
-func (c *Client) GetInternalAddress() (addr net.IP, err error) {
-	gatewayAddr, err := c.GetGatewayAddress()
+func discoverGateway() (addr netip.Addr, err error) {
+	ip, err := gateway.DiscoverGateway()
 	if err != nil {
-		return nil, err
+		return netip.Addr{}, ErrGatewayNotFound
 	}
+	addr = AddrFromIP(ip)
+	if !addr.IsValid() {
+		return netip.Addr{}, ErrGatewayNotFound
+	}
+	return addr, nil
+}
 
+func internalAddressFor(gatewayAddr netip.Addr) (addr netip.Addr, err error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return nil, err
+		return netip.Addr{}, err
 	}
 
 	for _, iface := range ifaces {
+		//A scoped gateway can only be reached through its own interface
+		if gatewayAddr.Zone() != "" && gatewayAddr.Zone() != iface.Name {
+			continue
+		}
 		addrs, err := iface.Addrs()
 		if err != nil {
-			return nil, err
+			return netip.Addr{}, err
 		}
 
-		for _, addr := range addrs {
-			switch x := addr.(type) {
+		for _, a := range addrs {
+			switch x := a.(type) {
 			case *net.IPNet:
-				if x.Contains(gatewayAddr) {
-					return x.IP, nil
+				ip := AddrFromIP(x.IP)
+				ones, _ := x.Mask.Size()
+				if ip.Is4() && ones > 32 {
+					ones -= 96
 				}
+				prefix := netip.PrefixFrom(ip, ones)
+				if !prefix.IsValid() || !prefix.Contains(gatewayAddr.WithZone("")) {
+					continue
+				}
+				if ip.Is6() && ip.IsLinkLocalUnicast() {
+					ip = ip.WithZone(iface.Name)
+				}
+				return ip, nil
 			}
 		}
 	}
 
-	return nil, ErrNoInternalAddress
+	return netip.Addr{}, ErrNoInternalAddress
 }
 
-func (c *Client) RefreshPortMapping(internalPort uint16, lifetime uint32) (err error) {
-	if m, exists := c.Mappings[internalPort]; exists {
-		mapData := &OpDataMap{
-			Protocol:     m.Protocol,
-			InternalPort: m.InternalPort,
-			ExternalPort: m.ExternalPort,
-			ExternalIP:   m.ExternalIP,
-		}
-		err = c.addMapping(OpCode(OpMap), lifetime, mapData)
-	} else {
-		err = ErrMappingNotFound
+func (c *Client) RefreshPortMapping(protocol Protocol, internalPort uint16, lifetime uint32) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
 	}
-	return
+	key := MappingKey{Protocol: protocol, InternalPort: internalPort}
+	return c.eachSession(func(s *Session) error {
+		c.mu.Lock()
+		m, exists := s.Mappings[key]
+		c.mu.Unlock()
+		if !exists {
+			return ErrMappingNotFound
+		}
+		mapData := m.OpDataMap
+		return c.addSessionMapping(s, OpMap, lifetime, &mapData)
+	})
 }
 
-func (c *Client) RefreshPeerMapping(internalPort uint16, lifetime uint32) (err error) {
-	if m, exists := c.PeerMappings[internalPort]; exists {
+func (c *Client) RefreshPeerMapping(protocol Protocol, internalPort uint16, remote netip.AddrPort, lifetime uint32) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	key := MappingKey{Protocol: protocol, InternalPort: internalPort, Remote: remote}
+	return c.eachSession(func(s *Session) error {
+		c.mu.Lock()
+		m, exists := s.PeerMappings[s.peerKey(key)]
+		c.mu.Unlock()
+		if !exists {
+			return ErrMappingNotFound
+		}
 		peerData := &OpDataPeer{
-			OpDataMap: OpDataMap{
-				Protocol:     m.Protocol,
-				InternalPort: m.InternalPort,
-				ExternalPort: m.ExternalPort,
-				ExternalIP:   m.ExternalIP,
-			},
+			OpDataMap:  m.OpDataMap,
 			RemotePort: m.RemotePort,
 			RemoteIP:   m.RemoteIP,
 		}
-		err = c.addMapping(OpCode(OpPeer), lifetime, peerData)
-	} else {
-		err = ErrMappingNotFound
-	}
-	return
+		return c.addSessionMapping(s, OpPeer, lifetime, peerData)
+	})
 }
 
+//addMapping sends the request to every server. It only fails if no server
+//could be sent to.
 func (c *Client) addMapping(op OpCode, lifetime uint32, data interface{}) (err error) {
-	var msg []byte
-	switch op {
-	case OpMap:
-		d := data.(*OpDataMap)
-		msg, err = d.marshal(c.nonce)
-		if err != nil {
-			return ErrPeerDataPayload
+	sent := false
+	for _, s := range c.sessionList() {
+		e := c.addSessionMapping(s, op, lifetime, data)
+		if e == nil {
+			sent = true
+			continue
 		}
-	case OpPeer:
-		d := data.(*OpDataPeer)
-		msg, err = d.marshal(c.nonce)
-		if err != nil {
-			return ErrPeerDataPayload
+		log.Debugf("Request to %s failed: %s", s.Addr, e)
+		if err == nil {
+			err = e
 		}
 	}
-
-	addr, err := c.GetInternalAddress()
-	if err != nil {
-		return ErrNoInternalAddress
+	if sent {
+		if op == OpMap || op == OpPeer {
+			c.saveNow()
+		}
+		return nil
 	}
+	return
+}
 
-	requestData := &RequestPacket{op, lifetime, addr, msg, nil}
-	requestDataBytes, err := requestData.marshal()
+func (c *Client) addSessionMapping(s *Session, op OpCode, lifetime uint32, data interface{}) (err error) {
+	if data, err = c.nat64Data(context.Background(), s, op, data); err != nil {
+		return
+	}
+	buf := requestBuffers.Get().(*[]byte)
+	defer requestBuffers.Put(buf)
+	requestDataBytes, err := c.buildRequest((*buf)[:0], s, op, lifetime, data)
 	if err != nil {
-		return ErrRequestDataPayload
+		return
+	}
+	err = c.sendMessage(s, requestDataBytes)
+	if err == ErrNotAuthenticated {
+		return
 	}
-	err = c.sendMessage(requestDataBytes)
 	if err != nil {
 		return ErrNetworkSend
 	}
-	rt := getRefreshTime(0, lifetime)
+
+	defer c.stateChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now().Unix()
+	expires := now + int64(lifetime)
 	refresh := RefreshTime{
 		Attempt: 0,
-		Time:    rt,
+		Time:    c.getRefreshTime(0, lifetime, expires),
 	}
-
+	//A mapping the server has already granted keeps its state until the
+	//response arrives; a new or unconfirmed one is (re)scheduled from now.
+	key := requestKey(s, op, data)
 	switch op {
 	case OpMap:
 		d := data.(*OpDataMap)
+		if m, exists := s.Mappings[key.MappingKey]; exists && m.Active {
+			return
+		}
 		portMap := PortMap{
-			OpDataMap: OpDataMap{
-				Protocol:     d.Protocol,
-				InternalPort: d.InternalPort,
-				ExternalPort: d.ExternalPort,
-				ExternalIP:   d.ExternalIP,
-			},
-			Active:   false,
-			Lifetime: lifetime,
-			Refresh:  refresh,
+			OpDataMap: *d,
+			Active:    false,
+			Lifetime:  lifetime,
+			Expires:   expires,
+			Refresh:   refresh,
 		}
-		c.Mappings[d.InternalPort] = portMap
+		portMap.Description = c.describe(d.Description)
+		s.Mappings[key.MappingKey] = portMap
 	case OpPeer:
 		d := data.(*OpDataPeer)
+		if m, exists := s.PeerMappings[key.MappingKey]; exists && m.Active {
+			return
+		}
 		peerMap := PeerMap{
 			PortMap: PortMap{
-				OpDataMap: OpDataMap{
-					Protocol:     d.Protocol,
-					InternalPort: d.InternalPort,
-					ExternalPort: d.ExternalPort,
-					ExternalIP:   d.ExternalIP,
-				},
-				Active:   false,
-				Lifetime: lifetime,
-				Refresh:  refresh,
+				OpDataMap: d.OpDataMap,
+				Active:    false,
+				Lifetime:  lifetime,
+				Expires:   expires,
+				Refresh:   refresh,
 			},
 			RemotePort: d.RemotePort,
 			RemoteIP:   d.RemoteIP,
 		}
-		c.PeerMappings[d.InternalPort] = peerMap
+		peerMap.Description = c.describe(d.Description)
+		s.PeerMappings[key.MappingKey] = peerMap
+	default:
+		return
+	}
+	c.sched.schedule(key, nextDue(refresh.Time, expires))
+	return
+}
+
+//requestBuffers holds send buffers, so that building a request does not allocate.
+var requestBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, maxPacketSize)
+		return &b
+	},
+}
+
+//buildRequest appends the request to b, usually a buffer from requestBuffers.
+func (c *Client) buildRequest(b []byte, s *Session, op OpCode, lifetime uint32, data interface{}) (msg []byte, err error) {
+	addr, err := s.internalAddress()
+	if err != nil {
+		return nil, ErrNoInternalAddress
+	}
+
+	msg = appendRequestHeader(b, op, lifetime, addr)
+	switch op {
+	case OpMap:
+		d := data.(*OpDataMap)
+		msg = d.appendTo(msg, c.nonce, addr)
+		if msg, err = d.ThirdParty.appendOptions(msg); err != nil {
+			return nil, err
+		}
+		if msg, err = appendDescription(msg, c.describe(d.Description)); err != nil {
+			return nil, err
+		}
+		if msg, err = appendPortSet(msg, d.PortSet); err != nil {
+			return nil, err
+		}
+	case OpPeer:
+		d := data.(*OpDataPeer)
+		msg, err = d.appendTo(msg, c.nonce, addr)
+		if err != nil {
+			return nil, ErrPeerDataPayload
+		}
+		if msg, err = d.ThirdParty.appendOptions(msg); err != nil {
+			return nil, err
+		}
+		if msg, err = appendDescription(msg, c.describe(d.Description)); err != nil {
+			return nil, err
+		}
+	}
+	if len(msg)-len(b) > maxPacketSize {
+		return nil, ErrRequestDataPayload
+	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("Request Bytes: %x", msg[len(b):])
 	}
 	return
 }
 
-func (c *Client) epochValid(clientTime int64, serverTime uint32) bool {
+func (c *Client) epochValid(e *ClientEpoch, clientTime int64, serverTime uint32) bool {
 	//Function will be used to check whether to trigger mapping renewals and such.
-	e := c.epoch
 	s := false
 	log.Debugf("Prev client time: %d Current client time: %d Prev server time: %d Server time: %d", e.prevClientTime, clientTime, e.prevServerTime, serverTime)
 	//Unsure if this timing check logic if spec compliant.
@@ -367,22 +630,125 @@ func (c *Client) epochValid(clientTime int64, serverTime uint32) bool {
 	return s
 }
 
-func (c *Client) refreshMappings() (err error) {
-	for k, v := range c.Mappings {
-		err = c.RefreshPortMapping(k, v.Lifetime)
-		if err != nil {
-			return
+//refreshMappings schedules every mapping on s for immediate renewal, e.g.
+//after the server has lost state. The refresh goroutine sends the requests.
+func (c *Client) refreshMappings(s *Session) {
+	now := c.clock.Now().Unix()
+	c.mu.Lock()
+	var keys []mappingKey
+	for k, v := range s.Mappings {
+		s.Mappings[k] = resetRefresh(v, now)
+		keys = append(keys, mappingKey{s, OpMap, k})
+	}
+	for k, v := range s.PeerMappings {
+		v.PortMap = resetRefresh(v.PortMap, now)
+		s.PeerMappings[k] = v
+		keys = append(keys, mappingKey{s, OpPeer, k})
+	}
+	c.mu.Unlock()
+	for _, k := range keys {
+		c.sched.schedule(k, now)
+	}
+}
+
+func resetRefresh(m PortMap, now int64) PortMap {
+	m.Refresh = RefreshTime{Attempt: 0, Time: now}
+	return m
+}
+
+//refreshDue is called by the refresh goroutine when key is due. It either
+//marks the mapping expired, or sends a renewal and schedules the next attempt
+//as described in 11.2.1 of RFC6887.
+func (c *Client) refreshDue(key mappingKey, now int64) {
+	s := key.session
+	var m PortMap
+	var peer PeerMap
+	var exists bool
+	c.mu.Lock()
+	switch key.op {
+	case OpMap:
+		m, exists = s.Mappings[key.MappingKey]
+	case OpPeer:
+		peer, exists = s.PeerMappings[key.MappingKey]
+		m = peer.PortMap
+	}
+	if !exists {
+		c.mu.Unlock()
+		return
+	}
+	if m.Expires <= now {
+		m.Active = false
+		var e Event
+		switch key.op {
+		case OpMap:
+			delete(s.Mappings, key.MappingKey)
+			e = Event{ActionMappingExpired, m, s.Addr}
+		case OpPeer:
+			delete(s.PeerMappings, key.MappingKey)
+			peer.PortMap = m
+			e = Event{ActionMappingExpired, peer, s.Addr}
 		}
-		//Leave a little time between requests
-		time.Sleep(100 * time.Millisecond)
+		c.mu.Unlock()
+		c.stateChanged()
+		log.Debugf("Mapping for port %d expired", key.InternalPort)
+		c.events.emit(e)
+		if h, _ := c.handleFor(s, key); h != nil {
+			//Handles are kept until closed, so start over with a new request
+			c.updateHandle(s, key, PortMap{}, ErrMappingExpired)
+			if err := c.addSessionMapping(s, key.op, h.lifetime, h.data); err != nil {
+				log.Errorf("Could not request expired mapping for port %d again: %s", key.InternalPort, err)
+			}
+		}
+		return
 	}
-	for k, v := range c.PeerMappings {
-		err = c.RefreshPeerMapping(k, v.Lifetime)
-		if err != nil {
-			return
+	attempt := m.Refresh.Attempt
+	if m.Refresh.Time <= now {
+		m.Refresh = RefreshTime{
+			Attempt: attempt + 1,
+			Time:    c.getRefreshTime(attempt+1, m.Lifetime, m.Expires),
 		}
-		//Leave a little time between requests
-		time.Sleep(100 * time.Millisecond)
 	}
-	return
+	switch key.op {
+	case OpMap:
+		s.Mappings[key.MappingKey] = m
+	case OpPeer:
+		peer.PortMap = m
+		s.PeerMappings[key.MappingKey] = peer
+	}
+	c.mu.Unlock()
+	c.sched.schedule(key, nextDue(m.Refresh.Time, m.Expires))
+	if m.Refresh.Attempt == attempt {
+		//Woken early, nothing to send yet
+		return
+	}
+
+	var data interface{}
+	switch key.op {
+	case OpMap:
+		data = &m.OpDataMap
+	case OpPeer:
+		data = &OpDataPeer{
+			OpDataMap:  m.OpDataMap,
+			RemotePort: peer.RemotePort,
+			RemoteIP:   peer.RemoteIP,
+		}
+	}
+	log.Debugf("Refreshing mapping for port %d, attempt %d", key.InternalPort, attempt)
+	buf := requestBuffers.Get().(*[]byte)
+	defer requestBuffers.Put(buf)
+	msg, err := c.buildRequest((*buf)[:0], s, key.op, m.Lifetime, data)
+	if err == nil {
+		err = c.sendMessage(s, msg)
+	}
+	if err != nil {
+		log.Errorf("Error occured whilst refreshing mapping: %s", err)
+	}
+}
+
+//nextDue is the earlier of the refresh time and the expiry time.
+func nextDue(refresh, expires int64) int64 {
+	if expires > 0 && expires < refresh {
+		return expires
+	}
+	return refresh
 }
@@ -0,0 +1,132 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	benchMap  = &OpDataMap{Protocol: ProtocolTCP, InternalPort: 8080, ExternalPort: 8080}
+	benchPeer = &OpDataPeer{
+		OpDataMap:  OpDataMap{Protocol: ProtocolUDP, InternalPort: 5000},
+		RemotePort: 6000,
+		RemoteIP:   netip.MustParseAddr("198.51.100.7"),
+	}
+)
+
+func benchmarkBuildRequest(b *testing.B, op OpCode, data interface{}) {
+	srv := newTestServer(b, nil)
+	c := newTestClient(b, srv)
+	s := c.sessionList()[0]
+	buf := make([]byte, 0, maxPacketSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.buildRequest(buf, s, op, 3600, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildRequestMap(b *testing.B)  { benchmarkBuildRequest(b, OpMap, benchMap) }
+func BenchmarkBuildRequestPeer(b *testing.B) { benchmarkBuildRequest(b, OpPeer, benchPeer) }
+
+func TestBuildRequestAllocs(t *testing.T) {
+	srv := newTestServer(t, nil)
+	c := newTestClient(t, srv)
+	s := c.sessionList()[0]
+	buf := make([]byte, 0, maxPacketSize)
+	for _, r := range []struct {
+		op   OpCode
+		data interface{}
+	}{{OpMap, benchMap}, {OpPeer, benchPeer}} {
+		allocs := testing.AllocsPerRun(100, func() {
+			c.buildRequest(buf, s, r.op, 3600, r.data)
+		})
+		if allocs != 0 {
+			t.Errorf("building a %s request: %v allocations", r.op, allocs)
+		}
+	}
+}
+
+//TestAccessorsCopy checks that the accessors return copies of the primary
+//server's state, which the caller can change freely.
+func TestAccessorsCopy(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	c := newTestClient(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.OpenPortMapping(ctx, ProtocolTCP, 8080, 0, netip.Addr{}, 600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.OpenPeerMapping(ctx, ProtocolUDP, 5000, 0, netip.Addr{}, netip.MustParseAddrPort("198.51.100.7:6000"), 600); err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.GetServerAddress(); addr != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("GetServerAddress: %s", addr)
+	}
+
+	mappings := c.GetMappings()
+	if len(mappings) != 1 {
+		t.Fatalf("GetMappings: %+v", mappings)
+	}
+	for k := range mappings {
+		delete(mappings, k)
+	}
+	peers := c.GetPeerMappings()
+	if len(peers) != 1 {
+		t.Fatalf("GetPeerMappings: %+v", peers)
+	}
+	for k := range peers {
+		delete(peers, k)
+	}
+	if len(c.GetMappings()) != 1 || len(c.GetPeerMappings()) != 1 {
+		t.Error("changing a copy changed the client")
+	}
+
+	c.mu.Lock()
+	c.Servers = []Server{{Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1")}}}
+	c.mu.Unlock()
+	servers := c.GetServers()
+	servers[0].Addrs[0] = netip.MustParseAddr("192.0.2.2")
+	if got := c.GetServers(); got[0].Addrs[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("changing a copy changed the client: %+v", got)
+	}
+}
+
+func TestGetExternalAddress(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	c := newTestClient(t, srv)
+	addr, err := c.GetExternalAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != srv.Table.ExternalIP {
+		t.Errorf("GetExternalAddress: %s, want %s", addr, srv.Table.ExternalIP)
+	}
+	//The mapping made to learn the address is gone on both sides
+	if entries := srv.Table.Entries(); len(entries) != 0 {
+		t.Errorf("server still holds %+v", entries)
+	}
+	if m := c.GetMappings(); len(m) != 0 {
+		t.Errorf("client still holds %+v", m)
+	}
+
+	c.mu.Lock()
+	sessions := c.sessions
+	c.sessions = nil
+	c.mu.Unlock()
+	if _, err = c.GetExternalAddress(); err != ErrServerNotFound {
+		t.Errorf("GetExternalAddress without a server: %v", err)
+	}
+	if _, err = c.GetInternalAddress(); err != ErrServerNotFound {
+		t.Errorf("GetInternalAddress without a server: %v", err)
+	}
+	c.mu.Lock()
+	c.sessions = sessions
+	c.mu.Unlock()
+}
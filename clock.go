@@ -0,0 +1,198 @@
+package pcp
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock is the source of time for a Client. The default uses the time package;
+//tests can pass a FakeClock with WithClock to control refresh and expiry.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+//Timer mirrors time.Timer, with the channel exposed through C.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+//Ticker mirrors time.Ticker, with the channel exposed through C.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+//FakeClock is a manually driven Clock. Time only moves when Advance or Set is
+//called, firing any timers and tickers that fall due along the way.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+//NewFakeClock returns a FakeClock set to start.
+func NewFakeClock(start time.Time) *FakeClock {
+	f := &FakeClock{
+		now:    start,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	return f.newTimer(d, 0)
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("pcp: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.newTimer(d, d)}
+}
+
+func (f *FakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	t := &fakeTimer{
+		clock:  f,
+		c:      make(chan time.Time, 1),
+		period: period,
+	}
+	f.mu.Lock()
+	t.at = f.now.Add(d)
+	f.timers[t] = struct{}{}
+	f.cond.Broadcast()
+	f.fire()
+	f.mu.Unlock()
+	return t
+}
+
+//Advance moves the clock forward by d, firing timers in deadline order.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advanceTo(f.now.Add(d))
+}
+
+//Set moves the clock to t. Setting a time in the past does not fire anything.
+func (f *FakeClock) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.Before(f.now) {
+		f.now = t
+		return
+	}
+	f.advanceTo(t)
+}
+
+//BlockUntil waits until at least n timers or tickers are pending, so a test
+//can be sure the client is waiting on the clock before advancing it.
+func (f *FakeClock) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+func (f *FakeClock) advanceTo(target time.Time) {
+	for {
+		var next *fakeTimer
+		for t := range f.timers {
+			if !t.at.After(target) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		f.now = next.at
+		f.fire()
+	}
+	f.now = target
+}
+
+//fire delivers every timer due at the current time. The caller holds f.mu.
+func (f *FakeClock) fire() {
+	for t := range f.timers {
+		if t.at.After(f.now) {
+			continue
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			delete(f.timers, t)
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, pending := f.timers[t]
+	delete(f.timers, t)
+	return pending
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, pending := f.timers[t]
+	t.at = f.now.Add(d)
+	if t.period > 0 {
+		t.period = d
+	}
+	f.timers[t] = struct{}{}
+	f.cond.Broadcast()
+	f.fire()
+	return pending
+}
+
+type fakeTicker struct{ t *fakeTimer }
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.c }
+func (t fakeTicker) Stop()               { t.t.Stop() }
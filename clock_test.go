@@ -0,0 +1,128 @@
+package pcp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClockTimers(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	clock := NewFakeClock(start)
+	timer := clock.NewTimer(3 * time.Second)
+	ticker := clock.NewTicker(2 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer reported false")
+	}
+
+	clock.Advance(2*time.Second - time.Nanosecond)
+	if fired(timer.C()) || fired(ticker.C()) {
+		t.Fatal("fired early")
+	}
+	clock.Advance(time.Nanosecond)
+	if fired(timer.C()) || !fired(ticker.C()) {
+		t.Fatal("ticker did not fire at 2s")
+	}
+	clock.Advance(time.Second)
+	if !fired(timer.C()) || fired(ticker.C()) {
+		t.Fatal("timer did not fire at 3s")
+	}
+	if fired(stopped.C()) {
+		t.Error("stopped timer fired")
+	}
+	//A fired timer is not pending, and Reset arms it from the current time
+	if timer.Stop() {
+		t.Error("Stop of a fired timer reported true")
+	}
+	timer.Reset(time.Second)
+	clock.Advance(time.Second)
+	if !fired(timer.C()) || !fired(ticker.C()) {
+		t.Fatal("Reset timer and ticker did not fire at 4s")
+	}
+	if now := clock.Now(); !now.Equal(start.Add(4 * time.Second)) {
+		t.Errorf("now %s", now)
+	}
+
+	//Set into the past fires nothing; a timer already due fires on creation
+	clock.Set(start)
+	if fired(ticker.C()) {
+		t.Error("ticker fired going back")
+	}
+	if due := clock.NewTimer(0); !fired(due.C()) {
+		t.Error("timer due now did not fire")
+	}
+	ticker.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		clock.BlockUntil(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("BlockUntil returned with nothing pending")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.NewTimer(time.Second)
+	<-done
+}
+
+//pendingTimers returns how many timers and tickers of clock are pending.
+func pendingTimers(clock *FakeClock) int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.timers)
+}
+
+//TestRetransmit checks that a request the server does not answer is sent
+//again after 3, 6 and 12 seconds, as 8.1.1 of RFC6887 describes.
+func TestRetransmit(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newTestServer(t, clock)
+	srv.start(t)
+	c := newTestClient(t, srv, WithClock(clock))
+	srv.setMute(true)
+	idle := pendingTimers(clock)
+	requests := srv.requestCount()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.request(ctx, c.sessionList()[0], OpMap, 600, &OpDataMap{Protocol: ProtocolTCP, InternalPort: 8080})
+		result <- err
+	}()
+	clock.BlockUntil(idle + 1)
+	eventually(t, "the request", func() bool { return srv.requestCount() == requests+1 })
+	for i, wait := range []time.Duration{3 * time.Second, 6 * time.Second, 12 * time.Second} {
+		//The retransmission timer is running
+		clock.BlockUntil(idle + 1)
+		clock.Advance(wait - time.Millisecond)
+		checkQuiet(t, srv, requests+1+i, "before the retransmission time")
+		clock.Advance(time.Millisecond)
+		eventually(t, "the retransmission", func() bool { return srv.requestCount() == requests+2+i })
+	}
+
+	//An answer ends the exchange
+	srv.setMute(false)
+	clock.BlockUntil(idle + 1)
+	clock.Advance(24 * time.Second)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response to the retransmission")
+	}
+	cancel()
+}
@@ -0,0 +1,81 @@
+package pcp
+
+import "unicode/utf8"
+
+//MaxDescriptionLength is the longest description, in bytes, that still fits
+//in a PEER request of maxPacketSize.
+const MaxDescriptionLength = maxPacketSize - headerSize - peerDataSize - 4
+
+func validateDescription(description string) error {
+	if len(description) > MaxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	if !utf8.ValidString(description) {
+		return ErrDescriptionUTF8
+	}
+	return nil
+}
+
+//appendDescription appends the DESCRIPTION option (RFC7220), if description
+//is set. The text is sent as is, without a terminating null.
+func appendDescription(b []byte, description string) ([]byte, error) {
+	if description == "" {
+		return b, nil
+	}
+	if err := validateDescription(description); err != nil {
+		return b, err
+	}
+	return appendOptions(b, []PCPOption{{OptionOpDescription, []byte(description)}}), nil
+}
+
+//readDescription reads the DESCRIPTION option. Servers that store the
+//description echo it, others leave it out.
+func readDescription(options []PCPOption) (string, error) {
+	for _, o := range options {
+		if o.opCode == OptionOpDescription {
+			description := string(o.data)
+			return description, validateDescription(description)
+		}
+	}
+	return "", nil
+}
+
+//requestedDescription returns the description sent for key, for responses
+//from servers that do not echo it: that of a request awaiting the response,
+//else the one kept for the mapping, else the default. c.mu must be held.
+func (c *Client) requestedDescription(key mappingKey) string {
+	for _, w := range c.waiters[key] {
+		if w.description != "" {
+			return w.description
+		}
+	}
+	var own string
+	switch key.op {
+	case OpMap:
+		own = key.session.Mappings[key.MappingKey].Description
+	case OpPeer:
+		own = key.session.PeerMappings[key.MappingKey].Description
+	}
+	return c.describe(own)
+}
+
+//dataDescription returns the description sent with data.
+func (c *Client) dataDescription(data interface{}) string {
+	var own string
+	switch d := data.(type) {
+	case *OpDataMap:
+		own = d.Description
+	case *OpDataPeer:
+		own = d.Description
+	}
+	return c.describe(own)
+}
+
+//describe returns the description sent for a mapping: its own, or the
+//default set with WithDescription.
+func (c *Client) describe(own string) string {
+	if own != "" {
+		return own
+	}
+	return c.description
+}
@@ -0,0 +1,162 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+//tableDescriptions returns the description of every mapping srv holds, by
+//internal port.
+func tableDescriptions(srv *testServer) map[uint16]string {
+	descriptions := make(map[uint16]string)
+	for _, e := range srv.Table.Entries() {
+		descriptions[e.InternalPort] = e.Description
+	}
+	return descriptions
+}
+
+//mappingEvents collects the description of the latest mapping event for
+//each internal port, and counts the events.
+func mappingEvents(t *testing.T, c *Client) func() (map[uint16]string, int) {
+	sub := c.Subscribe(64, OverflowDropNewest, 0)
+	t.Cleanup(sub.Close)
+	seen := make(map[uint16]string)
+	n := 0
+	return func() (map[uint16]string, int) {
+		for {
+			select {
+			case e := <-sub.C:
+				if m, ok := e.Data.(PortMap); ok && e.Action == ActionReceivedMapping {
+					seen[m.InternalPort] = m.Description
+					n++
+				}
+			default:
+				return seen, n
+			}
+		}
+	}
+}
+
+func TestDescription(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		name := "echoed"
+		if strip {
+			name = "stripped"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, nil)
+			srv.strip = strip
+			srv.start(t)
+			c := newTestClient(t, srv, WithDescription("myapp"))
+			events := mappingEvents(t, c)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			results, err := c.MapMany(ctx, []MappingRequest{
+				{Protocol: ProtocolTCP, InternalPort: 8080, Description: "web", Lifetime: 600},
+				{Protocol: ProtocolTCP, InternalPort: 8081, Lifetime: 600},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[uint16]string{8080: "web", 8081: "myapp"}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+				if got := r.Servers[0].Mapping.Description; got != want[r.Request.InternalPort] {
+					t.Errorf("result for port %d: %q", r.Request.InternalPort, got)
+				}
+			}
+			eventually(t, "both events", func() bool { _, n := events(); return n == 2 })
+			seen, _ := events()
+			for port, got := range seen {
+				if got != want[port] {
+					t.Errorf("event for port %d: %q", port, got)
+				}
+			}
+			for port, got := range c.GetMappings() {
+				if got.Description != want[port.InternalPort] {
+					t.Errorf("mapping for port %d: %q", port.InternalPort, got.Description)
+				}
+			}
+			wantTable := want
+			if strip {
+				wantTable = map[uint16]string{8080: "", 8081: ""}
+			}
+			if got := tableDescriptions(srv); len(got) != 2 || got[8080] != wantTable[8080] || got[8081] != wantTable[8081] {
+				t.Errorf("server holds %v", got)
+			}
+
+			//A refresh sends the description kept for the mapping again
+			before := len(srv.strippedDescriptions())
+			if err = c.RefreshPortMapping(ProtocolTCP, 8080, 600); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, "the refresh", func() bool { _, n := events(); return n == 3 })
+			if strip {
+				if got := srv.strippedDescriptions(); len(got) != before+1 || got[len(got)-1] != "web" {
+					t.Errorf("refresh sent %v", got[before:])
+				}
+			} else if got := tableDescriptions(srv)[8080]; got != "web" {
+				t.Errorf("server holds %q after refresh", got)
+			}
+			if seen, _ = events(); seen[8080] != "web" {
+				t.Errorf("event after refresh: %q", seen[8080])
+			}
+			if got := c.GetMappings()[MappingKey{Protocol: ProtocolTCP, InternalPort: 8080}].Description; got != "web" {
+				t.Errorf("after refresh: %q", got)
+			}
+		})
+	}
+}
+
+func TestDescriptionRefused(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	long := strings.Repeat("x", MaxDescriptionLength+1)
+	c := newTestClient(t, srv)
+	results, err := c.MapMany(ctx, []MappingRequest{
+		{Protocol: ProtocolTCP, InternalPort: 8080, Description: long},
+		{Protocol: ProtocolTCP, InternalPort: 8081, Description: "bad \xff"},
+		{Protocol: ProtocolTCP, InternalPort: 8082, Description: strings.Repeat("x", MaxDescriptionLength)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []error{ErrDescriptionTooLong, ErrDescriptionUTF8, nil} {
+		if results[i].Err != want {
+			t.Errorf("request %d: %v, want %v", i, results[i].Err, want)
+		}
+	}
+
+	bad := newTestClient(t, srv, WithDescription("bad \xff"))
+	if err = bad.AddPortMapping(ProtocolTCP, 9000, 0, netip.Addr{}, 600); err != ErrDescriptionUTF8 {
+		t.Errorf("AddPortMapping: %v", err)
+	}
+	if entries := tableDescriptions(srv); len(entries) != 1 {
+		t.Errorf("server holds %v", entries)
+	}
+
+	//The server refuses what the client would not send
+	from := netip.MustParseAddr("192.0.2.1")
+	for _, description := range []string{long, "bad \xff"} {
+		req := appendRequestHeader(nil, OpMap, 600, from)
+		req = (&OpDataMap{Protocol: ProtocolTCP, InternalPort: 8080}).appendTo(req, make([]byte, 12), from)
+		req = appendOptions(req, []PCPOption{{OptionOpDescription, []byte(description)}})
+		res, err := srv.Table.Handle(req, from, false, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r ResponsePacket
+		if err = r.unmarshal(res); err != nil || r.resultCode != ResultMalformedOption {
+			t.Errorf("%.10q: %v %v", description, r.resultCode, err)
+		}
+	}
+}
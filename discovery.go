@@ -0,0 +1,326 @@
+package pcp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//DHCP option codes carrying PCP server addresses, see RFC7291.
+const (
+	DHCPv4OptionPCPServer = 158
+	DHCPv6OptionPCPServer = 86
+)
+
+//ServerSource records how a PCP server was found.
+type ServerSource uint8
+
+const (
+	SourceConfigured ServerSource = iota
+	SourceDHCPv4
+	SourceDHCPv6
+	SourceGateway
+)
+
+//Server is a PCP server found by discovery. A server may be reachable on
+//several addresses, which are tried in order (4 of RFC7488).
+type Server struct {
+	Addrs  []netip.Addr
+	Source ServerSource
+}
+
+//DefaultLeaseFiles are the dhclient lease locations used by common distributions.
+var DefaultLeaseFiles = []string{
+	"/var/lib/dhcp/dhclient*.leases",
+	"/var/lib/dhclient/dhclient*.lease*",
+	"/var/lib/NetworkManager/dhclient*.lease",
+}
+
+//Discovery controls where NewClient looks for PCP servers. Configured servers
+//come first, then those from DHCP leases. The default gateway is only used
+//when neither gives a server, as 4 of RFC7488 describes.
+type Discovery struct {
+	Servers []Server
+	//LeaseFiles are glob patterns of dhclient lease files. Nil means DefaultLeaseFiles.
+	LeaseFiles []string
+	NoGateway  bool
+}
+
+//leaseOptionNames maps the names dhclient writes PCP server options under,
+//both unknown options and ones declared in dhclient.conf, to their family.
+var leaseOptionNames = map[string]ServerSource{
+	"unknown-158":      SourceDHCPv4,
+	"pcp-server":       SourceDHCPv4,
+	"dhcp6.unknown-86": SourceDHCPv6,
+	"dhcp6.pcp-server": SourceDHCPv6,
+}
+
+//Discover returns every PCP server found, most preferred first. Servers with
+//the same first address are only listed once.
+func (d *Discovery) Discover() (servers []Server, err error) {
+	seen := make(map[netip.Addr]bool)
+	add := func(s Server) {
+		if len(s.Addrs) == 0 || seen[s.Addrs[0]] {
+			return
+		}
+		seen[s.Addrs[0]] = true
+		servers = append(servers, s)
+	}
+	for _, s := range d.Servers {
+		add(s)
+	}
+
+	patterns := d.LeaseFiles
+	if patterns == nil {
+		patterns = DefaultLeaseFiles
+	}
+	for _, pattern := range patterns {
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			found, err := readLeaseFile(file)
+			if err != nil {
+				log.Debugf("Skipping lease file %s: %s", file, err)
+				continue
+			}
+			for _, s := range found {
+				add(s)
+			}
+		}
+	}
+
+	if len(servers) == 0 && !d.NoGateway {
+		gatewayAddr, err := discoverGateway()
+		if err != nil {
+			return nil, err
+		}
+		add(Server{Addrs: []netip.Addr{gatewayAddr}, Source: SourceGateway})
+	}
+	if len(servers) == 0 {
+		return nil, ErrServerNotFound
+	}
+	return servers, nil
+}
+
+func readLeaseFile(name string) ([]Server, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseLeaseFile(f)
+}
+
+//ParseLeaseFile reads PCP servers from a dhclient lease file. dhclient
+//appends each new lease, so only the last lease for each interface is used.
+//Blocks nested in a lease, such as the ia-na and iaaddr of a DHCPv6 lease,
+//do not end it.
+func ParseLeaseFile(r io.Reader) (servers []Server, err error) {
+	type lease struct {
+		key     string
+		servers []Server
+	}
+	var leases []*lease
+	latest := make(map[string]*lease)
+	var cur *lease
+	var kind, iface string
+	//depth counts the blocks open in the current lease, itself included
+	var depth int
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case cur == nil && (line == "lease {" || line == "lease6 {"):
+			kind, iface = line, ""
+			cur, depth = &lease{}, 1
+		case cur == nil:
+		case strings.HasSuffix(line, "{"):
+			depth++
+		case line == "}":
+			if depth--; depth > 0 {
+				continue
+			}
+			cur.key = kind + iface
+			if prev, exists := latest[cur.key]; exists {
+				prev.servers = cur.servers
+			} else {
+				latest[cur.key] = cur
+				leases = append(leases, cur)
+			}
+			cur = nil
+		case depth == 1 && strings.HasPrefix(line, "interface "):
+			iface = strings.Trim(strings.TrimSuffix(line[len("interface "):], ";"), `"`)
+		case strings.HasPrefix(line, "option "):
+			fields := strings.SplitN(strings.TrimSuffix(line[len("option "):], ";"), " ", 2)
+			source, known := leaseOptionNames[fields[0]]
+			if !known || len(fields) < 2 {
+				continue
+			}
+			found, err := parseLeaseOption(source, strings.TrimSpace(fields[1]))
+			if err != nil {
+				log.Debugf("Ignoring lease option %s: %s", fields[0], err)
+				continue
+			}
+			cur.servers = append(cur.servers, found...)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, l := range leases {
+		servers = append(servers, l.servers...)
+	}
+	return servers, nil
+}
+
+//parseLeaseOption decodes an option value as dhclient prints it: a list of
+//addresses when the option is declared in dhclient.conf, otherwise the raw
+//payload as colon separated hex or a quoted string.
+func parseLeaseOption(source ServerSource, value string) ([]Server, error) {
+	if addrs, ok := parseAddrList(value); ok {
+		return []Server{{Addrs: addrs, Source: source}}, nil
+	}
+	var payload []byte
+	if strings.HasPrefix(value, `"`) {
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, ErrDHCPOptionFormat
+		}
+		payload = []byte(s)
+	} else {
+		for _, part := range strings.Split(value, ":") {
+			if len(part) == 1 {
+				part = "0" + part
+			}
+			b, err := hex.DecodeString(part)
+			if err != nil || len(b) != 1 {
+				return nil, ErrDHCPOptionFormat
+			}
+			payload = append(payload, b[0])
+		}
+	}
+	if source == SourceDHCPv6 {
+		s, err := ParseDHCPv6PCPServer(payload)
+		if err != nil {
+			return nil, err
+		}
+		return []Server{s}, nil
+	}
+	return ParseDHCPv4PCPServers(payload)
+}
+
+func parseAddrList(value string) (addrs []netip.Addr, ok bool) {
+	for _, field := range strings.Split(value, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(field))
+		if err != nil {
+			return nil, false
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, true
+}
+
+//ParseDHCPv4PCPServers parses the payload of OPTION_V4_PCP_SERVER (without
+//the code and length octets). Each list in the option is a separate server.
+func ParseDHCPv4PCPServers(payload []byte) (servers []Server, err error) {
+	for len(payload) > 0 {
+		n := int(payload[0])
+		if n == 0 || n%4 != 0 || len(payload) < 1+n {
+			return nil, ErrDHCPOptionFormat
+		}
+		s := Server{Source: SourceDHCPv4}
+		for i := 1; i < 1+n; i += 4 {
+			s.Addrs = append(s.Addrs, netip.AddrFrom4([4]byte{payload[i], payload[i+1], payload[i+2], payload[i+3]}))
+		}
+		servers = append(servers, s)
+		payload = payload[1+n:]
+	}
+	if len(servers) == 0 {
+		return nil, ErrDHCPOptionFormat
+	}
+	return servers, nil
+}
+
+//ParseDHCPv6PCPServer parses the payload of one OPTION_V6_PCP_SERVER. Unlike
+//the DHCPv4 option, each instance of the option describes a single server.
+//IPv4-mapped addresses are returned as IPv4.
+func ParseDHCPv6PCPServer(payload []byte) (s Server, err error) {
+	if len(payload) == 0 || len(payload)%16 != 0 {
+		return Server{}, ErrDHCPOptionFormat
+	}
+	s.Source = SourceDHCPv6
+	for i := 0; i < len(payload); i += 16 {
+		s.Addrs = append(s.Addrs, getAddr(payload[i:i+16]))
+	}
+	return s, nil
+}
+
+//connectServer picks the first of the server's addresses that answers an
+//ANNOUNCE, trying each for one initial retransmission time as 4.1 of RFC7488
+//suggests. With a single address there is nothing to choose between, so it is
+//used without waiting. If nothing answers the first address is used, so a
+//server that comes up later is still reached.
+func connectServer(server Server) (addr netip.Addr, conn *net.UDPConn, err error) {
+	var candidates []netip.Addr
+	for _, a := range server.Addrs {
+		//A link-local server is unreachable without knowing which interface it is on
+		if a.Is6() && a.IsLinkLocalUnicast() && a.Zone() == "" {
+			a = a.WithZone(linkLocalZone())
+		}
+		candidates = append(candidates, a)
+	}
+	if len(candidates) == 0 {
+		return netip.Addr{}, nil, ErrServerNotFound
+	}
+	for _, a := range candidates {
+		conn, err = dialServer(a)
+		if err != nil {
+			continue
+		}
+		if len(candidates) == 1 || probe(conn) {
+			return a, conn, nil
+		}
+		conn.Close()
+	}
+	conn, err = dialServer(candidates[0])
+	if err != nil {
+		return netip.Addr{}, nil, err
+	}
+	return candidates[0], conn, nil
+}
+
+//probe sends an ANNOUNCE and reports whether a PCP response came back. An
+//error result still shows a server is listening.
+func probe(conn *net.UDPConn) bool {
+	local := AddrPortFromUDPAddr(conn.LocalAddr().(*net.UDPAddr)).Addr()
+	req := &RequestPacket{OpAnnounce, 0, local, nil, nil}
+	msg, err := req.marshal()
+	if err != nil {
+		return false
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(initialRetransmitTime))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1100)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		var res ResponsePacket
+		if err = res.unmarshal(buf[:n]); err == nil {
+			return true
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package pcp
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//dhclientLeases is a dhclient.leases file with two leases for eth0, the
+//later one current, and one for wlan0.
+const dhclientLeases = `lease {
+  interface "eth0";
+  fixed-address 192.168.1.50;
+  option subnet-mask 255.255.255.0;
+  option routers 192.168.1.1;
+  option dhcp-lease-time 86400;
+  option unknown-158 4:c0:0:2:1;
+  option domain-name-servers 192.168.1.1;
+  renew 2 2024/01/02 10:00:00;
+  rebind 3 2024/01/03 01:00:00;
+  expire 3 2024/01/03 04:00:00;
+}
+lease {
+  interface "eth0";
+  fixed-address 192.168.1.50;
+  option subnet-mask 255.255.255.0;
+  option routers 192.168.1.1;
+  option unknown-158 8:c0:0:2:2:c0:0:2:3:4:c0:0:2:4;
+  renew 3 2024/01/03 10:00:00;
+  rebind 4 2024/01/04 01:00:00;
+  expire 4 2024/01/04 04:00:00;
+}
+lease {
+  interface "wlan0";
+  fixed-address 10.0.0.23;
+  option routers 10.0.0.1;
+  option pcp-server 10.0.0.1, 10.0.0.2;
+  renew 3 2024/01/03 11:00:00;
+}
+`
+
+//dhclient6Leases is a dhclient6.leases file. The PCP server option follows
+//the nested ia-na and iaaddr blocks.
+const dhclient6Leases = `default-duid "\000\001\000\001\055\023\217\312\122\124\000\022\064\126";
+lease6 {
+  interface "eth0";
+  ia-na 1e:2f:3a:4b {
+    starts 1700000000;
+    renew 1800;
+    rebind 2880;
+    iaaddr 2001:db8::100 {
+      starts 1700000000;
+      preferred-life 3600;
+      max-life 7200;
+    }
+  }
+  option dhcp6.client-id 0:1:0:1:2d:13:8f:ca:52:54:0:12:34:56;
+  option dhcp6.server-id 0:1:0:1:2a:1b:3c:4d:52:54:0:ab:cd:ef;
+  option dhcp6.name-servers 2001:db8::1;
+  option dhcp6.unknown-86 20:1:d:b8:0:0:0:0:0:0:0:0:0:0:0:1;
+}
+lease6 {
+  interface "eth0";
+  ia-na 1e:2f:3a:4b {
+    starts 1700003600;
+    renew 1800;
+    rebind 2880;
+    iaaddr 2001:db8::100 {
+      starts 1700003600;
+      preferred-life 3600;
+      max-life 7200;
+    }
+  }
+  option dhcp6.server-id 0:1:0:1:2a:1b:3c:4d:52:54:0:ab:cd:ef;
+  option dhcp6.unknown-86 20:1:d:b8:0:0:0:0:0:0:0:0:0:0:0:2:0:0:0:0:0:0:0:0:0:0:ff:ff:c0:0:2:1;
+  option dhcp6.pcp-server 2001:db8::3;
+}
+`
+
+func leaseServers(source ServerSource, lists ...string) (s []Server) {
+	for _, list := range lists {
+		var addrs []netip.Addr
+		for _, a := range strings.Fields(list) {
+			addrs = append(addrs, netip.MustParseAddr(a))
+		}
+		s = append(s, Server{Addrs: addrs, Source: source})
+	}
+	return
+}
+
+func TestParseLeaseFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		lease string
+		want  []Server
+	}{
+		{"dhclient", dhclientLeases, append(
+			leaseServers(SourceDHCPv4, "192.0.2.2 192.0.2.3", "192.0.2.4"),
+			leaseServers(SourceDHCPv4, "10.0.0.1 10.0.0.2")...)},
+		{"dhclient6", dhclient6Leases, append(
+			leaseServers(SourceDHCPv6, "2001:db8::2 192.0.2.1"),
+			leaseServers(SourceDHCPv6, "2001:db8::3")...)},
+		{"both families", dhclientLeases + dhclient6Leases, append(
+			leaseServers(SourceDHCPv4, "192.0.2.2 192.0.2.3", "192.0.2.4", "10.0.0.1 10.0.0.2"),
+			leaseServers(SourceDHCPv6, "2001:db8::2 192.0.2.1", "2001:db8::3")...)},
+		{"unterminated", "lease6 {\n  interface \"eth0\";\n  option dhcp6.pcp-server 2001:db8::3;\n", nil},
+		{"bad option", "lease {\n  interface \"eth0\";\n  option unknown-158 5:c0:0:2:1;\n  option pcp-server 192.0.2.9;\n}\n", leaseServers(SourceDHCPv4, "192.0.2.9")},
+		{"none", "lease {\n  interface \"eth0\";\n  option routers 192.168.1.1;\n}\n", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseLeaseFile(strings.NewReader(test.lease))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseLeaseOption(t *testing.T) {
+	tests := []struct {
+		source ServerSource
+		value  string
+		want   []Server
+		err    error
+	}{
+		{SourceDHCPv4, "192.0.2.1, 192.0.2.2", leaseServers(SourceDHCPv4, "192.0.2.1 192.0.2.2"), nil},
+		{SourceDHCPv4, "4:c0:0:2:1:4:c0:0:2:2", leaseServers(SourceDHCPv4, "192.0.2.1", "192.0.2.2"), nil},
+		{SourceDHCPv4, `"\004\300\000\002\001"`, leaseServers(SourceDHCPv4, "192.0.2.1"), nil},
+		{SourceDHCPv4, "4:c0:0:2", nil, ErrDHCPOptionFormat},
+		{SourceDHCPv4, "4:c0:0:2:zz", nil, ErrDHCPOptionFormat},
+		{SourceDHCPv4, `"\004`, nil, ErrDHCPOptionFormat},
+		{SourceDHCPv6, "::ffff:192.0.2.1", leaseServers(SourceDHCPv6, "192.0.2.1"), nil},
+		{SourceDHCPv6, "20:1:d:b8:0:0:0:0:0:0:0:0:0:0:0:1", leaseServers(SourceDHCPv6, "2001:db8::1"), nil},
+		{SourceDHCPv6, "20:1:d:b8", nil, ErrDHCPOptionFormat},
+	}
+	for _, test := range tests {
+		got, err := parseLeaseOption(test.source, test.value)
+		if err != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseLeaseOption(%d, %s) = %v, %v, want %v, %v", test.source, test.value, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestParseDHCPPCPServers(t *testing.T) {
+	v4 := []struct {
+		payload []byte
+		want    []Server
+	}{
+		{[]byte{4, 192, 0, 2, 1}, leaseServers(SourceDHCPv4, "192.0.2.1")},
+		{[]byte{8, 192, 0, 2, 1, 192, 0, 2, 2, 4, 198, 51, 100, 1}, leaseServers(SourceDHCPv4, "192.0.2.1 192.0.2.2", "198.51.100.1")},
+		{nil, nil},
+		{[]byte{0}, nil},
+		{[]byte{3, 192, 0, 2}, nil},
+		{[]byte{8, 192, 0, 2, 1}, nil},
+	}
+	for _, test := range v4 {
+		got, err := ParseDHCPv4PCPServers(test.payload)
+		if test.want == nil {
+			if err != ErrDHCPOptionFormat {
+				t.Errorf("ParseDHCPv4PCPServers(%v) = %v, %v", test.payload, got, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseDHCPv4PCPServers(%v) = %v, %v, want %v", test.payload, got, err, test.want)
+		}
+	}
+
+	mapped := netip.MustParseAddr("::ffff:192.0.2.1").As16()
+	v6 := netip.MustParseAddr("2001:db8::1").As16()
+	got, err := ParseDHCPv6PCPServer(append(v6[:], mapped[:]...))
+	if want := leaseServers(SourceDHCPv6, "2001:db8::1 192.0.2.1")[0]; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDHCPv6PCPServer = %v, %v, want %v", got, err, want)
+	}
+	for _, payload := range [][]byte{nil, v6[:15], append(v6[:], 0)} {
+		if _, err = ParseDHCPv6PCPServer(payload); err != ErrDHCPOptionFormat {
+			t.Errorf("ParseDHCPv6PCPServer(%v): %v", payload, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package pcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//EAP codes and the types used by PCP authentication, see RFC3748.
+const (
+	EapRequest  = 1
+	EapResponse = 2
+	EapSuccess  = 3
+	EapFailure  = 4
+
+	EapTypeIdentity = 1
+	//EapTypeExperimental is the type used by the PSK method of this package.
+	EapTypeExperimental = 255
+)
+
+//EAPPeer is the client side of an EAP method. A new one is used for each
+//authentication, so it can keep the state of a single exchange.
+type EAPPeer interface {
+	//Identity is sent in the EAP Response/Identity.
+	Identity() string
+	//Type is the EAP method type.
+	Type() uint8
+	//Respond handles the type data of a request for the method and returns
+	//the type data of the response.
+	Respond(data []byte) ([]byte, error)
+	//MSK returns the master session key once the method has succeeded.
+	MSK() []byte
+}
+
+//EAPAuthenticator is the server side of an EAP method. A new one is used for
+//each authentication.
+type EAPAuthenticator interface {
+	Type() uint8
+	//Start begins the method for the identity the peer gave and returns the
+	//type data of the first request.
+	Start(identity string) ([]byte, error)
+	//Process handles the type data of a response. It returns the data of the
+	//next request, or done once the peer is authenticated.
+	Process(data []byte) (next []byte, done bool, err error)
+	//MSK returns the master session key once the method has succeeded.
+	MSK() []byte
+}
+
+//eapPacket is an EAP packet. Type and Data are unused for Success and Failure.
+type eapPacket struct {
+	Code       uint8
+	Identifier uint8
+	Type       uint8
+	Data       []byte
+}
+
+func (p *eapPacket) appendTo(b []byte) []byte {
+	length := 4
+	if p.Code == EapRequest || p.Code == EapResponse {
+		length += 1 + len(p.Data)
+	}
+	b = append(b, p.Code, p.Identifier)
+	b = appendUint16(b, uint16(length))
+	if length > 4 {
+		b = append(b, p.Type)
+		b = append(b, p.Data...)
+	}
+	return b
+}
+
+func (p *eapPacket) unmarshal(b []byte) error {
+	if len(b) < 4 {
+		return ErrEAPFormat
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return ErrEAPFormat
+	}
+	*p = eapPacket{Code: b[0], Identifier: b[1]}
+	switch p.Code {
+	case EapRequest, EapResponse:
+		if length < 5 {
+			return ErrEAPFormat
+		}
+		p.Type = b[4]
+		p.Data = b[5:length]
+	case EapSuccess, EapFailure:
+	default:
+		return ErrEAPFormat
+	}
+	return nil
+}
+
+//pskPeer and pskAuthenticator implement a small mutually authenticating
+//method over a pre-shared key, for closed deployments and testing:
+//
+//	server -> peer: RAND_S (16 octets)
+//	peer -> server: RAND_P (16 octets) | HMAC(key, "peer" | RAND_S | RAND_P | identity)
+//	server -> peer: HMAC(key, "server" | RAND_P | RAND_S)
+//	peer -> server: empty
+//
+//The MSK is HMAC(key, "msk1" | RAND_S | RAND_P) | HMAC(key, "msk2" | RAND_S | RAND_P).
+//It uses the experimental EAP type, so it is not EAP-PSK of RFC4764.
+type pskPeer struct {
+	identity     string
+	key          []byte
+	randS, randP []byte
+	verified     bool
+}
+
+type pskAuthenticator struct {
+	keys         func(identity string) ([]byte, bool)
+	identity     string
+	key          []byte
+	randS, randP []byte
+	verified     bool
+}
+
+const pskRandSize = 16
+
+//NewPSKPeer returns the client side of the pre-shared key method.
+func NewPSKPeer(identity string, key []byte) EAPPeer {
+	return &pskPeer{identity: identity, key: key}
+}
+
+//NewPSKAuthenticator returns the server side of the pre-shared key method.
+//keys looks up the key of an identity.
+func NewPSKAuthenticator(keys func(identity string) ([]byte, bool)) EAPAuthenticator {
+	return &pskAuthenticator{keys: keys}
+}
+
+func pskMAC(key []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func pskMSK(key, randS, randP []byte) []byte {
+	return append(pskMAC(key, []byte("msk1"), randS, randP), pskMAC(key, []byte("msk2"), randS, randP)...)
+}
+
+func (p *pskPeer) Identity() string { return p.identity }
+func (p *pskPeer) Type() uint8      { return EapTypeExperimental }
+
+func (p *pskPeer) Respond(data []byte) ([]byte, error) {
+	if p.randS == nil {
+		if len(data) != pskRandSize {
+			return nil, ErrEAPFormat
+		}
+		randP, err := genRandomBytes(pskRandSize)
+		if err != nil {
+			return nil, err
+		}
+		p.randS, p.randP = append([]byte(nil), data...), randP
+		mac := pskMAC(p.key, []byte("peer"), p.randS, p.randP, []byte(p.identity))
+		return append(append([]byte(nil), randP...), mac...), nil
+	}
+	if !hmac.Equal(data, pskMAC(p.key, []byte("server"), p.randP, p.randS)) {
+		return nil, ErrEAPAuthentication
+	}
+	p.verified = true
+	return nil, nil
+}
+
+func (p *pskPeer) MSK() []byte {
+	if !p.verified {
+		return nil
+	}
+	return pskMSK(p.key, p.randS, p.randP)
+}
+
+func (a *pskAuthenticator) Type() uint8 { return EapTypeExperimental }
+
+func (a *pskAuthenticator) Start(identity string) ([]byte, error) {
+	key, ok := a.keys(identity)
+	if !ok {
+		return nil, ErrEAPAuthentication
+	}
+	randS, err := genRandomBytes(pskRandSize)
+	if err != nil {
+		return nil, err
+	}
+	a.identity, a.key, a.randS = identity, key, randS
+	return randS, nil
+}
+
+func (a *pskAuthenticator) Process(data []byte) (next []byte, done bool, err error) {
+	if a.randP == nil {
+		if len(data) != pskRandSize+sha256.Size {
+			return nil, false, ErrEAPFormat
+		}
+		randP := data[:pskRandSize]
+		if !hmac.Equal(data[pskRandSize:], pskMAC(a.key, []byte("peer"), a.randS, randP, []byte(a.identity))) {
+			return nil, false, ErrEAPAuthentication
+		}
+		a.randP = append([]byte(nil), randP...)
+		return pskMAC(a.key, []byte("server"), a.randP, a.randS), false, nil
+	}
+	a.verified = true
+	return nil, true, nil
+}
+
+func (a *pskAuthenticator) MSK() []byte {
+	if !a.verified {
+		return nil
+	}
+	return pskMSK(a.key, a.randS, a.randP)
+}
@@ -2,37 +2,34 @@ package pcp
 
 import (
 	"encoding/binary"
-	"net"
+	"net/netip"
 
-	"github.com/boljen/go-bitmap"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	ProtocolAll Protocol = 0
-	ProtocolTCP Protocol = 6
-	ProtocolUDP Protocol = 17
-)
-
 type OpCode uint8
 type OptionOpCode uint8
-
-//At a later date it would be worth integrating with the IANA package to be fully compliant.
-//For now, just implement common protocols
-type Protocol uint8
 type ResultCode uint8
 
 type OpDataMap struct {
 	Protocol     Protocol
 	InternalPort uint16
-	ExternalPort uint16 //This is only a suggestion in request. Server ultimately decides.
-	ExternalIP   net.IP //Also only a suggestion
+	ExternalPort uint16     //This is only a suggestion in request. Server ultimately decides.
+	ExternalIP   netip.Addr //Also only a suggestion
+	//ThirdParty is set for mappings made for another host. It is sent as
+	//options rather than opcode data, and echoed by the server.
+	ThirdParty ThirdParty
+	//Description labels the mapping for whoever inspects the server, see
+	//RFC7220. It is sent as an option, so it is not part of the key.
+	Description string
+	//PortSet makes a MAP mapping cover consecutive ports, see MapPortSet.
+	PortSet PortSet
 }
 
 type OpDataPeer struct {
 	OpDataMap
 	RemotePort uint16
-	RemoteIP   net.IP
+	RemoteIP   netip.Addr
 }
 
 //Potentially add in progress bool
@@ -45,39 +42,73 @@ type PortMap struct {
 	OpDataMap
 	Active   bool
 	Lifetime uint32
-	Refresh  RefreshTime
+	//Unix time at which the server will drop the mapping unless renewed.
+	Expires int64
+	Refresh RefreshTime
 }
 
 type PeerMap struct {
 	PortMap
 	RemotePort uint16
-	RemoteIP   net.IP
+	RemoteIP   netip.Addr
+}
+
+//MappingKey identifies a mapping in the client's Mappings and PeerMappings
+//tables. It is comparable, so lookups need no allocation or string matching.
+type MappingKey struct {
+	Protocol     Protocol
+	InternalPort uint16
+	//Remote is only set for peer mappings.
+	Remote netip.AddrPort
+	//ThirdParty is only set for mappings made for another host.
+	ThirdParty ThirdParty
+}
+
+//ExternalAddr returns the external address and port.
+func (data OpDataMap) ExternalAddr() netip.AddrPort {
+	return netip.AddrPortFrom(data.ExternalIP, data.ExternalPort)
+}
+
+//RemoteAddr returns the remote peer's address and port.
+func (data OpDataPeer) RemoteAddr() netip.AddrPort {
+	return netip.AddrPortFrom(data.RemoteIP, data.RemotePort)
+}
+
+//RemoteAddr returns the remote peer's address and port.
+func (m PeerMap) RemoteAddr() netip.AddrPort {
+	return netip.AddrPortFrom(m.RemoteIP, m.RemotePort)
 }
 
-func (o OpCode) String() string {
-	return [...]string{"OpAnnounce", "OpMap", "OpPeer"}[o]
+func (data OpDataMap) key() MappingKey {
+	return MappingKey{Protocol: data.Protocol, InternalPort: data.InternalPort, ThirdParty: data.ThirdParty}
 }
 
-func (o OptionOpCode) String() string {
-	return [...]string{"OptionOpReserved", "OptionOpThirdParty", "OptionOpPreferFailure", "OptionOpFilter", "OptionOpNonce", "OptionOpAuthenticationTag", "OptionOpPaAuthenticationTag", "OptionOpEapPayload", "OptionOpPrf", "OptionOpMacAlgorithm", "OptionOpSessionLifetime", "OptionOpReceivedPak", "OptionOpIdIndicator", "OptionOpThirdPartyId"}[o]
+func (data OpDataPeer) key() MappingKey {
+	return MappingKey{data.Protocol, data.InternalPort, data.RemoteAddr(), data.ThirdParty}
 }
 
-func (p Protocol) String() string {
-	return [...]string{"ProtocolAll", "ProtocolTCP", "ProtocolUDP"}[p]
+//Key returns the key of the mapping in Client.Mappings.
+func (m PortMap) Key() MappingKey {
+	return m.OpDataMap.key()
 }
 
-func (r ResultCode) String() string {
-	return [...]string{"ResultSuccess", "ResultUnsupportedVersion", "ResultNotAuthorised", "ResultMalformedRequest", "ResultUnsupportedOpcode", "ResultUnsupportedOption", "ResultMalformedOption", "ResultNetworkFailure", "ResultNoResources", "ResultUnsupportedProtocol", "ResultUserExceededQuota", "ResultCannotProvideExternal", "ResultAddressMismatch", "ResultExcessiveRemotePeers"}[r]
+//Key returns the key of the mapping in Client.PeerMappings.
+func (m PeerMap) Key() MappingKey {
+	return MappingKey{m.Protocol, m.InternalPort, m.RemoteAddr(), m.ThirdParty}
 }
 
 const (
 	DefaultLifetimeSeconds = 3600
+	//minLifetime is the shortest lifetime requested. Less than this is pointless.
+	minLifetime = 120
 )
 
 const (
 	OpAnnounce OpCode = iota
 	OpMap
 	OpPeer
+	//OpAuthentication carries PCP authentication messages, see RFC7652.
+	OpAuthentication
 )
 
 const (
@@ -95,7 +126,16 @@ const (
 	OptionOpReceivedPak
 	OptionOpIdIndicator
 	OptionOpThirdPartyId
-	//Currently not implementing 128+
+	//128-255 are optional to process, and include vendor specific codes
+)
+
+const (
+	//OptionOpDescription carries a text label for the mapping, see RFC7220.
+	OptionOpDescription OptionOpCode = 128
+	//OptionOpPrefix64 carries the NAT64 prefixes of the server, see RFC7225.
+	OptionOpPrefix64 OptionOpCode = 129
+	//OptionOpPortSet maps a range of consecutive ports, see RFC7753.
+	OptionOpPortSet OptionOpCode = 130
 )
 
 const (
@@ -113,6 +153,18 @@ const (
 	ResultCannotProvideExternal
 	ResultAddressMismatch
 	ResultExcessiveRemotePeers
+	//Result codes of PCP authentication, see 5.1 of RFC7652. In
+	//authentication messages they also mark the type of requests.
+	ResultInitiation
+	ResultAuthenticationRequired
+	ResultAuthenticationFailed
+	ResultAuthenticationSucceeded
+	ResultAuthorizationFailed
+	ResultSessionTerminated
+	ResultUnknownSessionId
+	ResultDowngradeAttackDetected
+	ResultAuthenticationRequest
+	ResultAuthenticationReply
 )
 
 type PCPOption struct {
@@ -123,7 +175,7 @@ type PCPOption struct {
 type RequestPacket struct {
 	opCode     OpCode
 	lifetime   uint32
-	clientAddr net.IP
+	clientAddr netip.Addr
 	opData     []byte
 	pcpOptions []PCPOption
 }
@@ -135,239 +187,316 @@ type ResponsePacket struct {
 	epoch      uint32
 	opData     []byte
 	pcpOptions []PCPOption
+	//raw is the whole message, kept for authentication messages so their
+	//tags can be checked once the key is known.
+	raw []byte
 }
 
-func (data *OpDataMap) marshal(nonce []byte) (msg []byte, err error) {
-	//Potentially relax requirement for non-zero. Appears to be valid in the spec when combined with ProtocolAll.
-	//Also, marshal is probably the wrong place for this, since it technically doesn't cause an error.
-	if data.InternalPort == 0 {
-		return nil, ErrPortNotSpecified
-	}
-
-	empty := make([]byte, 3)
-
-	internalPortBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(internalPortBytes, data.InternalPort)
-
-	externalPortBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(externalPortBytes, data.ExternalPort)
-
-	addr := make([]byte, 16)
-	if data.ExternalIP != nil {
-		copy(addr, data.ExternalIP)
-	}
-
-	var slices = [][]byte{
-		nonce,
-		[]byte{byte(data.Protocol)},
-		empty,
-		internalPortBytes,
-		externalPortBytes,
-		addr,
-	}
+const (
+	//maxPacketSize is the largest PCP message, see 7 of RFC6887.
+	maxPacketSize = 1100
+	headerSize    = 24
+	mapDataSize   = 36
+	peerDataSize  = 56
+	//paDataSize is the session ID and sequence number of authentication messages.
+	paDataSize = 8
+	//responseBit is the R bit, set in the opcode byte of responses.
+	responseBit = 0x80
+)
 
-	msg = concatCopyPreAllocate(slices)
-	return
+//appendTo appends the MAP opcode data to b. clientAddr picks the family of
+//the all-zeros address sent when no external address is suggested.
+func (data *OpDataMap) appendTo(b []byte, nonce []byte, clientAddr netip.Addr) []byte {
+	b = append(b, nonce...)
+	//Protocol, then 24 bits reserved
+	b = append(b, byte(data.Protocol), 0, 0, 0)
+	b = appendUint16(b, data.InternalPort)
+	b = appendUint16(b, data.ExternalPort)
+	return appendAddr(b, suggestedAddr(data.ExternalIP, clientAddr))
 }
 
 func (data *OpDataMap) unmarshal(msg []byte) (err error) {
-	data = &OpDataMap{
+	if len(msg) < mapDataSize {
+		return ErrMapDataPayload
+	}
+	*data = OpDataMap{
 		Protocol:     Protocol(msg[12]),
 		InternalPort: binary.BigEndian.Uint16(msg[16:18]),
 		ExternalPort: binary.BigEndian.Uint16(msg[18:20]),
-		ExternalIP:   net.IP(msg[20:36]),
+		ExternalIP:   getAddr(msg[20:36]),
 	}
 	return
 }
 
-func (data *OpDataPeer) marshal(nonce []byte) (msg []byte, err error) {
-	//Potentially relax requirement for non-zero. Appears to be valid in the spec when combined with ProtocolAll.
-	//Also, marshal is probably the wrong place for this, since it technically doesn't cause an error.
-	if data.InternalPort == 0 {
-		return nil, ErrPortNotSpecified
-	}
-
-	r1, r2 := make([]byte, 3), make([]byte, 2)
-
-	internalPortBytes, externalPortBytes, remotePortBytes := make([]byte, 2), make([]byte, 2), make([]byte, 2)
-
-	binary.BigEndian.PutUint16(internalPortBytes, data.InternalPort)
-	binary.BigEndian.PutUint16(externalPortBytes, data.ExternalPort)
-	binary.BigEndian.PutUint16(remotePortBytes, data.RemotePort)
-
-	addr, remoteAddr := make([]byte, 16), make([]byte, 16)
-	if data.ExternalIP != nil {
-		copy(addr, data.ExternalIP)
+//appendTo appends the PEER opcode data to b. The remote peer is required.
+func (data *OpDataPeer) appendTo(b []byte, nonce []byte, clientAddr netip.Addr) ([]byte, error) {
+	if !data.RemoteIP.IsValid() {
+		return b, ErrNoAddress
 	}
-	if data.RemoteIP == nil {
-		return nil, ErrNoAddress
-	}
-	copy(remoteAddr, data.RemoteIP)
-
-	var slices = [][]byte{
-		nonce,
-		[]byte{byte(data.Protocol)},
-		r1,
-		internalPortBytes,
-		externalPortBytes,
-		addr,
-		remotePortBytes,
-		r2,
-		remoteAddr,
-	}
-
-	msg = concatCopyPreAllocate(slices)
-	return
+	b = data.OpDataMap.appendTo(b, nonce, clientAddr)
+	b = appendUint16(b, data.RemotePort)
+	//16 bits reserved
+	b = append(b, 0, 0)
+	return appendAddr(b, data.RemoteIP), nil
 }
 
 func (data *OpDataPeer) unmarshal(msg []byte) (err error) {
-	data = &OpDataPeer{
+	if len(msg) < peerDataSize {
+		return ErrPeerDataPayload
+	}
+	*data = OpDataPeer{
 		OpDataMap: OpDataMap{
 			Protocol:     Protocol(msg[12]),
 			InternalPort: binary.BigEndian.Uint16(msg[16:18]),
 			ExternalPort: binary.BigEndian.Uint16(msg[18:20]),
-			ExternalIP:   net.IP(msg[20:36]),
+			ExternalIP:   getAddr(msg[20:36]),
 		},
 		RemotePort: binary.BigEndian.Uint16(msg[36:38]),
-		RemoteIP:   net.IP(msg[40:56]),
+		RemoteIP:   getAddr(msg[40:56]),
 	}
 	return
 }
 
-func (req *RequestPacket) marshal() (msg []byte, err error) {
-	opMap := bitmap.NewSlice(8)
-	//Bits at indexes 0-6 set from opCode int.
-	for i := 0; i < 7; i++ {
-		opCodeBit := bitmap.GetBit(byte(req.opCode), i)
-		bitmap.Set(opMap, i, opCodeBit)
-	}
-	//Bit at index 7 is 0 as it is a request
-	bitmap.Set(opMap, 7, false)
-
-	empty := make([]byte, 2)
-
-	lifetimeBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lifetimeBytes, req.lifetime)
-
-	addr := make([]byte, 16)
-	log.Debugf("Client addr: %s\n", req.clientAddr)
-	copy(addr, req.clientAddr)
-
-	var options []byte
-	log.Debugf("Number of options in request: %d", len(req.pcpOptions))
-	for _, option := range req.pcpOptions {
-		//8 bits reserved
-		empty := make([]byte, 1)
-
-		optionSlices := [][]byte{
-			[]byte{byte(option.opCode)},
-			empty,
-			//length of option data payload
-			[]byte{byte(len(option.data))},
-			option.data,
-		}
-
-		optionBytes := concatCopyPreAllocate(optionSlices)
-		//Pad option data to multiple of 4
-		optionBytes = addPadding(optionBytes)
+//mapData reads the opcode data of a MAP response, with the options the
+//server echoes from the request.
+func (res *ResponsePacket) mapData() (data OpDataMap, err error) {
+	if err = data.unmarshal(res.opData); err != nil {
+		return
+	}
+	if data.ThirdParty, err = readThirdParty(res.pcpOptions); err != nil {
+		return
+	}
+	//A bad description is dropped rather than the mapping
+	data.Description, _ = readDescription(res.pcpOptions)
+	data.PortSet, err = readPortSet(res.pcpOptions)
+	return
+}
 
-		options = append(options, optionBytes...)
+//peerData reads the opcode data of a PEER response, like mapData.
+func (res *ResponsePacket) peerData() (data OpDataPeer, err error) {
+	if err = data.unmarshal(res.opData); err != nil {
+		return
 	}
+	if data.ThirdParty, err = readThirdParty(res.pcpOptions); err != nil {
+		return
+	}
+	//A bad description is dropped rather than the mapping
+	data.Description, _ = readDescription(res.pcpOptions)
+	return
+}
 
-	var slices = [][]byte{
-		//The current PCP version number
-		[]byte{2},
-		opMap,
-		//Next 2 bytes (16 bits) reserved
-		empty,
-		//lifetime is an unsigned 32 bit integer in seconds
-		lifetimeBytes,
-		//client ip is always a 16 byte (128 bit) block
-		addr,
-		//opData is the opcode-specific data
-		req.opData,
-		options,
+//appendRequestHeader appends the common request header, see 7.1 of RFC6887.
+func appendRequestHeader(b []byte, op OpCode, lifetime uint32, clientAddr netip.Addr) []byte {
+	//Version, then the opcode with the R bit clear as it is a request, then
+	//16 bits reserved
+	b = append(b, 2, byte(op)&^responseBit, 0, 0)
+	b = appendUint32(b, lifetime)
+	return appendAddr(b, clientAddr)
+}
+
+//appendResponseHeader appends the common response header, see 7.2 of RFC6887.
+func appendResponseHeader(b []byte, op OpCode, result ResultCode, lifetime, epoch uint32) []byte {
+	//Version, the opcode with the R bit set, 8 bits reserved and the result
+	b = append(b, 2, byte(op)|responseBit, 0, byte(result))
+	b = appendUint32(b, lifetime)
+	b = appendUint32(b, epoch)
+	//96 bits reserved
+	return append(b, make([]byte, 12)...)
+}
+
+//appendOptions appends options in the format of 7.3 of RFC6887: code, a
+//reserved octet, a 16 bit length and the data padded to a multiple of 4.
+func appendOptions(b []byte, options []PCPOption) []byte {
+	for _, option := range options {
+		b = append(b, byte(option.opCode), 0)
+		b = appendUint16(b, uint16(len(option.data)))
+		b = append(b, option.data...)
+		b = appendPadding(b)
 	}
+	return b
+}
 
-	msg = concatCopyPreAllocate(slices)
-	//Pad message to multiple of 4
-	msg = addPadding(msg)
+//appendTo appends the encoded request to b, which is typically a reused buffer.
+func (req *RequestPacket) appendTo(b []byte) ([]byte, error) {
+	start := len(b)
+	b = appendRequestHeader(b, req.opCode, req.lifetime, req.clientAddr)
+	b = append(b, req.opData...)
+	b = appendOptions(b, req.pcpOptions)
+	if len(b)-start > maxPacketSize {
+		return b[:start], ErrPacketTooLarge
+	}
+	return b, nil
+}
 
-	if len(msg) > 1100 {
-		return nil, ErrPacketTooLarge
+func (req *RequestPacket) marshal() (msg []byte, err error) {
+	msg, err = req.appendTo(make([]byte, 0, maxPacketSize))
+	if err != nil {
+		return nil, err
 	}
 	log.Debugf("Request Bytes: %x\n", msg)
 	return msg, nil
 }
 
-func (res *ResponsePacket) unmarshal(data []byte) (err error) {
-	log.Debugf("Response Bytes: %x\n", data)
-	version := uint8(data[0])
-	if version != 2 {
-		return ErrUnsupportedVersion
-	}
-	if !bitmap.GetBit(data[1], 7) {
-		return ErrWrongPacketType
-	}
-
-	var opCode byte
-	for i := 0; i < 7; i++ {
-		opCodeBit := bitmap.GetBit(data[1], i)
-		opCode = bitmap.SetBit(opCode, i, opCodeBit)
-	}
-	res.opCode = OpCode(opCode)
-	res.resultCode = ResultCode(data[3])
-	log.Debugf("Result Code: %s", res.resultCode)
-	res.lifetime = binary.BigEndian.Uint32(data[4:8])
-	log.Debugf("Response Lifetime: %d", res.lifetime)
-	res.epoch = binary.BigEndian.Uint32(data[8:12])
-	log.Debugf("Response Epoch: %d", res.epoch)
-
-	var opDataLen int
-	//This could be trimmed down - left for clarity.
-	switch res.opCode {
-	case OpAnnounce:
-		opDataLen = 0
+//responseView reads the fields of a response in place. parseResponse checks
+//the length and header, so the accessors do not need to.
+type responseView []byte
+
+//parseResponse validates b as a PCP response without copying it.
+func parseResponse(b []byte) (responseView, error) {
+	if len(b) < headerSize {
+		return nil, ErrMalformedResponse
+	}
+	if b[0] != 2 {
+		return nil, ErrUnsupportedVersion
+	}
+	if b[1]&responseBit == 0 {
+		return nil, ErrWrongPacketType
+	}
+	v := responseView(b)
+	if len(b) < headerSize+v.opDataLen() {
+		return nil, ErrMalformedResponse
+	}
+	return v, nil
+}
+
+func (v responseView) opCode() OpCode         { return OpCode(v[1] &^ responseBit) }
+func (v responseView) resultCode() ResultCode { return ResultCode(v[3]) }
+func (v responseView) lifetime() uint32       { return binary.BigEndian.Uint32(v[4:8]) }
+func (v responseView) epoch() uint32          { return binary.BigEndian.Uint32(v[8:12]) }
+
+func (v responseView) opDataLen() int {
+	switch v.opCode() {
 	case OpMap:
-		opDataLen = 36
+		return mapDataSize
 	case OpPeer:
-		opDataLen = 56
-	default:
-		opDataLen = 0
-	}
-
-	log.Debugf("Opcode: %s\n", res.opCode)
-	log.Debugf("Op data len: %d\n", opDataLen)
-	if opDataLen > 0 {
-		res.opData = data[24 : 24+opDataLen]
-	}
-
-	currentOffset := 24 + opDataLen
-	for currentOffset < len(data) {
-		log.Debugf("Current offset: %d\n", currentOffset)
-		log.Debugf("Remaining data: %x\n", data[currentOffset:])
-		opCode := OptionOpCode(data[currentOffset])
-		log.Debugf("Option OpCode: %s\n", opCode)
-		optionLengthBytes := make([]byte, 2)
-		copy(optionLengthBytes, data[currentOffset+2:currentOffset+3])
-		optionLength := binary.BigEndian.Uint16(optionLengthBytes)
-		log.Debugf("Option data length: %d", optionLength)
-		var optionData []byte
-		dataStart := currentOffset + 3
-		if optionLength > 0 {
-			dataEnd := dataStart + int(optionLength)
-			optionData = data[dataStart:dataEnd]
-			currentOffset = dataEnd
-		} else {
-			currentOffset = dataStart
+		return peerDataSize
+	case OpAuthentication:
+		return paDataSize
+	}
+	return 0
+}
+
+func (v responseView) opData() []byte {
+	n := v.opDataLen()
+	if n == 0 {
+		return nil
+	}
+	return v[headerSize : headerSize+n]
+}
+
+//options returns the encoded options following the opcode data.
+func (v responseView) options() []byte {
+	return v[headerSize+v.opDataLen():]
+}
+
+//requestView reads the fields of a request in place, for the server side of
+//PCP authentication. parseRequest checks the length and header.
+type requestView []byte
+
+//parseRequest validates b as a PCP request without copying it.
+func parseRequest(b []byte) (requestView, error) {
+	if len(b) < headerSize || len(b) > maxPacketSize || len(b)%4 != 0 {
+		return nil, ErrMalformedRequest
+	}
+	if b[0] != 2 {
+		return nil, ErrUnsupportedVersion
+	}
+	if b[1]&responseBit != 0 {
+		return nil, ErrWrongPacketType
+	}
+	v := requestView(b)
+	if len(b) < headerSize+v.opDataLen() {
+		return nil, ErrMalformedRequest
+	}
+	return v, nil
+}
+
+func (v requestView) opCode() OpCode { return OpCode(v[1]) }
+
+//resultCode is only used by authentication requests, which carry their
+//type in the last reserved octet (5.1 of RFC7652).
+func (v requestView) resultCode() ResultCode { return ResultCode(v[3]) }
+func (v requestView) lifetime() uint32       { return binary.BigEndian.Uint32(v[4:8]) }
+func (v requestView) clientAddr() netip.Addr { return getAddr(v[8:24]) }
+
+func (v requestView) opDataLen() int {
+	return responseView(v).opDataLen()
+}
+
+func (v requestView) opData() []byte {
+	return v[headerSize : headerSize+v.opDataLen()]
+}
+
+func (v requestView) options() []byte {
+	return v[headerSize+v.opDataLen():]
+}
+
+//nextOption splits the first option from b. Its data refers to b.
+func nextOption(b []byte) (option PCPOption, rest []byte, err error) {
+	if len(b) < 4 {
+		return PCPOption{}, nil, ErrMalformedResponse
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	end := 4 + length
+	if end > len(b) {
+		return PCPOption{}, nil, ErrMalformedResponse
+	}
+	option = PCPOption{OptionOpCode(b[0]), b[4:end]}
+	//The padding may be missing after the last option
+	end += (4 - length%4) % 4
+	if end > len(b) {
+		end = len(b)
+	}
+	return option, b[end:], nil
+}
+
+//unmarshal decodes a response. opData and the option data refer to data
+//rather than copying it.
+func (res *ResponsePacket) unmarshal(data []byte) (err error) {
+	debug := log.IsLevelEnabled(log.DebugLevel)
+	if debug {
+		log.Debugf("Response Bytes: %x", data)
+	}
+	v, err := parseResponse(data)
+	if err != nil {
+		return err
+	}
+	*res = ResponsePacket{
+		opCode:     v.opCode(),
+		resultCode: v.resultCode(),
+		lifetime:   v.lifetime(),
+		epoch:      v.epoch(),
+		opData:     v.opData(),
+	}
+	if debug {
+		log.Debugf("Opcode: %s Result Code: %s Lifetime: %d Epoch: %d", res.opCode, res.resultCode, res.lifetime, res.epoch)
+	}
+
+	for rest := v.options(); len(rest) > 0; {
+		var option PCPOption
+		option, rest, err = nextOption(rest)
+		if err != nil {
+			return err
 		}
-		//OpCode 0 is reserved, has no function, hence dropped due to possible
-		//entries from reading empty bytes
-		if opCode != 0 {
-			option := PCPOption{opCode, optionData}
-			res.pcpOptions = append(res.pcpOptions, option)
+		if debug {
+			log.Debugf("Option OpCode: %s, data length: %d", option.opCode, len(option.data))
 		}
+		res.pcpOptions = append(res.pcpOptions, option)
 	}
+	return nil
+}
 
-	return
+//detach copies the parts of res that refer to a received buffer, so the
+//response stays valid after the buffer is reused.
+func (res *ResponsePacket) detach() *ResponsePacket {
+	c := *res
+	c.opData = append([]byte(nil), res.opData...)
+	if res.raw != nil {
+		c.raw = append([]byte(nil), res.raw...)
+	}
+	c.pcpOptions = make([]PCPOption, len(res.pcpOptions))
+	for i, o := range res.pcpOptions {
+		c.pcpOptions[i] = PCPOption{o.opCode, append([]byte(nil), o.data...)}
+	}
+	return &c
 }
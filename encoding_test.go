@@ -0,0 +1,64 @@
+package pcp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+//testPeerResponse returns a MappingTable's answer to a PEER request.
+func testPeerResponse(t testing.TB) []byte {
+	srv := newTestServer(t, nil)
+	c := newTestClient(t, srv)
+	req, err := c.buildRequest(nil, c.sessionList()[0], OpPeer, 3600, benchPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := srv.Table.Handle(req, netip.MustParseAddr("127.0.0.1"), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func BenchmarkResponseUnmarshal(b *testing.B) {
+	msg := testPeerResponse(b)
+	var res ResponsePacket
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := res.unmarshal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResponsePeerData(b *testing.B) {
+	msg := testPeerResponse(b)
+	var res ResponsePacket
+	if err := res.unmarshal(msg); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := res.peerData(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestResponseAllocs(t *testing.T) {
+	msg := testPeerResponse(t)
+	var res ResponsePacket
+	allocs := testing.AllocsPerRun(100, func() {
+		res.unmarshal(msg)
+		res.peerData()
+	})
+	if allocs != 0 {
+		t.Errorf("parsing a PEER response: %v allocations", allocs)
+	}
+	data, err := res.peerData()
+	if err != nil || data.RemoteIP != benchPeer.RemoteIP || data.RemotePort != benchPeer.RemotePort || data.InternalPort != benchPeer.InternalPort {
+		t.Errorf("peer data %+v, %v", data, err)
+	}
+}
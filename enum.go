@@ -0,0 +1,114 @@
+package pcp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//go:generate stringer -type=Action,OpCode,OptionOpCode,ResultCode,OverflowPolicy,ServerSource,RestoreMode -output=enum_string.go
+
+//The enum types below marshal to their constant names, so values can be
+//logged and serialised (encoding/json uses MarshalText) without panicking on
+//codes received from the wire. Values without a name round trip through the
+//"Type(N)" form produced by String, and plain numbers are also accepted.
+
+func (a Action) MarshalText() ([]byte, error) { return []byte(a.String()), nil }
+
+func (a *Action) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "Action", func(i uint8) string { return Action(i).String() })
+	*a = Action(v)
+	return err
+}
+
+func (o OpCode) MarshalText() ([]byte, error) { return []byte(o.String()), nil }
+
+func (o *OpCode) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "OpCode", func(i uint8) string { return OpCode(i).String() })
+	*o = OpCode(v)
+	return err
+}
+
+func (o OptionOpCode) MarshalText() ([]byte, error) { return []byte(o.String()), nil }
+
+func (o *OptionOpCode) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "OptionOpCode", func(i uint8) string { return OptionOpCode(i).String() })
+	*o = OptionOpCode(v)
+	return err
+}
+
+//Mandatory reports whether a server must understand the option to process the
+//request. Codes 0-127 are mandatory, 128-255 (including vendor specific codes)
+//are optional; see 7.3 of RFC6887.
+func (o OptionOpCode) Mandatory() bool {
+	return o < 128
+}
+
+func (r ResultCode) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *ResultCode) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "ResultCode", func(i uint8) string { return ResultCode(i).String() })
+	*r = ResultCode(v)
+	return err
+}
+
+func (p OverflowPolicy) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "OverflowPolicy", func(i uint8) string { return OverflowPolicy(i).String() })
+	*p = OverflowPolicy(v)
+	return err
+}
+
+func (s ServerSource) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+func (s *ServerSource) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "ServerSource", func(i uint8) string { return ServerSource(i).String() })
+	*s = ServerSource(v)
+	return err
+}
+
+func (m RestoreMode) MarshalText() ([]byte, error) { return []byte(m.String()), nil }
+
+func (m *RestoreMode) UnmarshalText(text []byte) error {
+	v, err := parseEnum(text, "RestoreMode", func(i uint8) string { return RestoreMode(i).String() })
+	*m = RestoreMode(v)
+	return err
+}
+
+func (p Protocol) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+//UnmarshalText accepts anything ParseProtocol does, as well as "Protocol(N)".
+func (p *Protocol) UnmarshalText(text []byte) error {
+	if v, err := parseEnum(text, "Protocol", func(i uint8) string { return Protocol(i).String() }); err == nil {
+		*p = Protocol(v)
+		return nil
+	}
+	v, err := ParseProtocol(string(text))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+//parseEnum finds the uint8 value whose name matches text. The enums are all
+//single byte, so trying every value is cheap and keeps the generated String
+//methods as the only source of names.
+func parseEnum(text []byte, typeName string, name func(uint8) string) (uint8, error) {
+	s := strings.TrimSpace(string(text))
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil {
+		return uint8(n), nil
+	}
+	if strings.HasPrefix(s, typeName+"(") && strings.HasSuffix(s, ")") {
+		if n, err := strconv.ParseUint(s[len(typeName)+1:len(s)-1], 10, 8); err == nil {
+			return uint8(n), nil
+		}
+	}
+	for i := 0; i < 256; i++ {
+		if name(uint8(i)) == s {
+			return uint8(i), nil
+		}
+	}
+	return 0, fmt.Errorf("pcp: invalid %s %q", typeName, s)
+}
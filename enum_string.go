@@ -0,0 +1,195 @@
+// Code generated by "stringer -type=Action,OpCode,OptionOpCode,ResultCode,OverflowPolicy,ServerSource,RestoreMode -output=enum_string.go ."; DO NOT EDIT.
+
+package pcp
+
+import "strconv"
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[ActionReceivedAnnounce-0]
+	_ = x[ActionReceivedMapping-1]
+	_ = x[ActionReceivedPeer-2]
+	_ = x[ActionClose-3]
+	_ = x[ActionMappingExpired-4]
+	_ = x[ActionNetworkChanged-5]
+}
+
+const _Action_name = "ActionReceivedAnnounceActionReceivedMappingActionReceivedPeerActionCloseActionMappingExpiredActionNetworkChanged"
+
+var _Action_index = [...]uint8{0, 22, 43, 61, 72, 92, 112}
+
+func (i Action) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_Action_index)-1 {
+		return "Action(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _Action_name[_Action_index[idx]:_Action_index[idx+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[OpAnnounce-0]
+	_ = x[OpMap-1]
+	_ = x[OpPeer-2]
+	_ = x[OpAuthentication-3]
+}
+
+const _OpCode_name = "OpAnnounceOpMapOpPeerOpAuthentication"
+
+var _OpCode_index = [...]uint8{0, 10, 15, 21, 37}
+
+func (i OpCode) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_OpCode_index)-1 {
+		return "OpCode(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _OpCode_name[_OpCode_index[idx]:_OpCode_index[idx+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[OptionOpReserved-0]
+	_ = x[OptionOpThirdParty-1]
+	_ = x[OptionOpPreferFailure-2]
+	_ = x[OptionOpFilter-3]
+	_ = x[OptionOpNonce-4]
+	_ = x[OptionOpAuthenticationTag-5]
+	_ = x[OptionOpPaAuthenticationTag-6]
+	_ = x[OptionOpEapPayload-7]
+	_ = x[OptionOpPrf-8]
+	_ = x[OptionOpMacAlgorithm-9]
+	_ = x[OptionOpSessionLifetime-10]
+	_ = x[OptionOpReceivedPak-11]
+	_ = x[OptionOpIdIndicator-12]
+	_ = x[OptionOpThirdPartyId-13]
+	_ = x[OptionOpDescription-128]
+	_ = x[OptionOpPrefix64-129]
+	_ = x[OptionOpPortSet-130]
+}
+
+const (
+	_OptionOpCode_name_0 = "OptionOpReservedOptionOpThirdPartyOptionOpPreferFailureOptionOpFilterOptionOpNonceOptionOpAuthenticationTagOptionOpPaAuthenticationTagOptionOpEapPayloadOptionOpPrfOptionOpMacAlgorithmOptionOpSessionLifetimeOptionOpReceivedPakOptionOpIdIndicatorOptionOpThirdPartyId"
+	_OptionOpCode_name_1 = "OptionOpDescriptionOptionOpPrefix64OptionOpPortSet"
+)
+
+var (
+	_OptionOpCode_index_0 = [...]uint16{0, 16, 34, 55, 69, 82, 107, 134, 152, 163, 183, 206, 225, 244, 264}
+	_OptionOpCode_index_1 = [...]uint8{0, 19, 35, 50}
+)
+
+func (i OptionOpCode) String() string {
+	switch {
+	case i <= 13:
+		return _OptionOpCode_name_0[_OptionOpCode_index_0[i]:_OptionOpCode_index_0[i+1]]
+	case 128 <= i && i <= 130:
+		i -= 128
+		return _OptionOpCode_name_1[_OptionOpCode_index_1[i]:_OptionOpCode_index_1[i+1]]
+	default:
+		return "OptionOpCode(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[ResultSuccess-0]
+	_ = x[ResultUnsupportedVersion-1]
+	_ = x[ResultNotAuthorised-2]
+	_ = x[ResultMalformedRequest-3]
+	_ = x[ResultUnsupportedOpcode-4]
+	_ = x[ResultUnsupportedOption-5]
+	_ = x[ResultMalformedOption-6]
+	_ = x[ResultNetworkFailure-7]
+	_ = x[ResultNoResources-8]
+	_ = x[ResultUnsupportedProtocol-9]
+	_ = x[ResultUserExceededQuota-10]
+	_ = x[ResultCannotProvideExternal-11]
+	_ = x[ResultAddressMismatch-12]
+	_ = x[ResultExcessiveRemotePeers-13]
+	_ = x[ResultInitiation-14]
+	_ = x[ResultAuthenticationRequired-15]
+	_ = x[ResultAuthenticationFailed-16]
+	_ = x[ResultAuthenticationSucceeded-17]
+	_ = x[ResultAuthorizationFailed-18]
+	_ = x[ResultSessionTerminated-19]
+	_ = x[ResultUnknownSessionId-20]
+	_ = x[ResultDowngradeAttackDetected-21]
+	_ = x[ResultAuthenticationRequest-22]
+	_ = x[ResultAuthenticationReply-23]
+}
+
+const _ResultCode_name = "ResultSuccessResultUnsupportedVersionResultNotAuthorisedResultMalformedRequestResultUnsupportedOpcodeResultUnsupportedOptionResultMalformedOptionResultNetworkFailureResultNoResourcesResultUnsupportedProtocolResultUserExceededQuotaResultCannotProvideExternalResultAddressMismatchResultExcessiveRemotePeersResultInitiationResultAuthenticationRequiredResultAuthenticationFailedResultAuthenticationSucceededResultAuthorizationFailedResultSessionTerminatedResultUnknownSessionIdResultDowngradeAttackDetectedResultAuthenticationRequestResultAuthenticationReply"
+
+var _ResultCode_index = [...]uint16{0, 13, 37, 56, 78, 101, 124, 145, 165, 182, 207, 230, 257, 278, 304, 320, 348, 374, 403, 428, 451, 473, 502, 529, 554}
+
+func (i ResultCode) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_ResultCode_index)-1 {
+		return "ResultCode(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _ResultCode_name[_ResultCode_index[idx]:_ResultCode_index[idx+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[OverflowDropOldest-0]
+	_ = x[OverflowDropNewest-1]
+	_ = x[OverflowBlock-2]
+}
+
+const _OverflowPolicy_name = "OverflowDropOldestOverflowDropNewestOverflowBlock"
+
+var _OverflowPolicy_index = [...]uint8{0, 18, 36, 49}
+
+func (i OverflowPolicy) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_OverflowPolicy_index)-1 {
+		return "OverflowPolicy(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _OverflowPolicy_name[_OverflowPolicy_index[idx]:_OverflowPolicy_index[idx+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[SourceConfigured-0]
+	_ = x[SourceDHCPv4-1]
+	_ = x[SourceDHCPv6-2]
+	_ = x[SourceGateway-3]
+}
+
+const _ServerSource_name = "SourceConfiguredSourceDHCPv4SourceDHCPv6SourceGateway"
+
+var _ServerSource_index = [...]uint8{0, 16, 28, 40, 53}
+
+func (i ServerSource) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_ServerSource_index)-1 {
+		return "ServerSource(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _ServerSource_name[_ServerSource_index[idx]:_ServerSource_index[idx+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[RestoreResume-0]
+	_ = x[RestoreDelete-1]
+}
+
+const _RestoreMode_name = "RestoreResumeRestoreDelete"
+
+var _RestoreMode_index = [...]uint8{0, 13, 26}
+
+func (i RestoreMode) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_RestoreMode_index)-1 {
+		return "RestoreMode(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _RestoreMode_name[_RestoreMode_index[idx]:_RestoreMode_index[idx+1]]
+}
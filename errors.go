@@ -2,6 +2,7 @@ package pcp
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -21,4 +22,40 @@ var (
 	ErrNetworkTimeout			= errors.New("the connection timed out")
 	ErrMappingNotFound    = errors.New("mapping not found")
 	ErrNoAddress          = errors.New("no address specified")
+	ErrMalformedResponse  = errors.New("the response packet is malformed")
+	ErrMalformedRequest   = errors.New("the request packet is malformed")
+	ErrClientClosed       = errors.New("the client has been closed")
+	ErrUnknownProtocol    = errors.New("the protocol number is not assigned")
+	ErrPortNotAllowed     = errors.New("ports must be zero for this protocol")
+	ErrServerNotFound     = errors.New("no pcp server found")
+	ErrDHCPOptionFormat   = errors.New("the dhcp pcp server option is malformed")
+	ErrMappingExpired     = errors.New("the mapping expired before it was renewed")
+	ErrMappingClosed      = errors.New("the mapping has been closed")
+	ErrMappingInUse       = errors.New("a handle on the mapping is already open")
+	ErrEAPFormat          = errors.New("the eap packet is malformed")
+	ErrEAPAuthentication  = errors.New("eap authentication failed")
+	ErrNotAuthenticated   = errors.New("the pcp authentication session is not established")
+	ErrAuthenticationTag  = errors.New("the authentication tag is missing or invalid")
+	ErrReplayedMessage    = errors.New("the message sequence number was already seen")
+	ErrNoCommonAlgorithm  = errors.New("no authentication algorithm supported by both sides")
+	ErrDowngradeDetected  = errors.New("the offered authentication algorithms were tampered with")
+	ErrUnknownSession     = errors.New("unknown pcp authentication session")
+	ErrTooManySessions    = errors.New("too many pcp authentication sessions are being set up")
+	ErrMalformedOption    = errors.New("a pcp option is malformed")
+	ErrThirdPartyID       = errors.New("a third party id needs a third party address")
+	ErrDescriptionTooLong = errors.New("the mapping description is too long")
+	ErrDescriptionUTF8    = errors.New("the mapping description is not valid utf-8")
+	ErrPortSetRange       = errors.New("the port set is empty or runs past port 65535")
+	ErrPrefix64Length     = errors.New("the nat64 prefix length is not allowed by rfc 6052")
+	ErrNoPrefix64         = errors.New("no nat64 prefix is known for the address")
+	ErrAddressFamily      = errors.New("the address is not of the expected family")
 )
+
+//ResultError is returned when the PCP server answers a request with a non success result code.
+type ResultError struct {
+	Code ResultCode
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("pcp server returned %s", e.Code)
+}
@@ -0,0 +1,198 @@
+package pcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//OverflowPolicy decides what happens to an event when a subscriber's buffer is full.
+type OverflowPolicy uint8
+
+const (
+	//OverflowDropOldest discards the oldest buffered event to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+	//OverflowDropNewest discards the event being delivered, keeping the buffer as is.
+	OverflowDropNewest
+	//OverflowBlock waits up to the subscription timeout for room, then drops the event.
+	OverflowBlock
+)
+
+const (
+	DefaultEventBufferSize = 16
+	DefaultBlockTimeout    = time.Second
+)
+
+//Subscription is a single consumer of client events. Events are read from C.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	policy  OverflowPolicy
+	timeout time.Duration
+	dropped uint64
+	bus     *eventBus
+	//Serialises delivery so drop oldest cannot race another sender.
+	mu sync.Mutex
+}
+
+//Dropped returns the number of events discarded because the subscriber was not keeping up.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+//Close removes the subscription from the client and closes C.
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+func (s *Subscription) deliver(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.ch <- e:
+		return
+	default:
+	}
+	switch s.policy {
+	case OverflowDropOldest:
+		select {
+		case <-s.ch:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowBlock:
+		t := time.NewTimer(s.timeout)
+		defer t.Stop()
+		select {
+		case s.ch <- e:
+		case <-t.C:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+//eventBus fans events out to every subscription without ever blocking
+//indefinitely, so protocol processing continues when nobody is reading.
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]struct{})}
+}
+
+func (b *eventBus) subscribe(size int, policy OverflowPolicy, timeout time.Duration) *Subscription {
+	if size < 1 {
+		size = DefaultEventBufferSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultBlockTimeout
+	}
+	ch := make(chan Event, size)
+	s := &Subscription{
+		C:       ch,
+		ch:      ch,
+		policy:  policy,
+		timeout: timeout,
+		bus:     b,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		//The client has gone away, so hand back a subscription that is already finished
+		close(ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.subs[s]; exists {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+//close ends every subscription. It is called once the client has shut down.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+	b.closed = true
+}
+
+func (b *eventBus) emit(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		s.deliver(e)
+	}
+}
+
+//Subscribe registers a new event consumer with its own buffer of size events.
+//When the buffer is full the policy is applied; timeout is only used by OverflowBlock.
+func (c *Client) Subscribe(size int, policy OverflowPolicy, timeout time.Duration) *Subscription {
+	return c.events.subscribe(size, policy, timeout)
+}
+
+//OnMappingChanged calls fn from a dedicated goroutine for every map and peer
+//event. Close the returned subscription to stop receiving callbacks. Close on
+//the client waits for the events already buffered to be passed to fn, so fn
+//must not call it.
+func (c *Client) OnMappingChanged(fn func(Event)) *Subscription {
+	s := c.events.subscribe(DefaultEventBufferSize, OverflowDropOldest, 0)
+	notify := func(e Event) {
+		switch e.Action {
+		case ActionReceivedMapping, ActionReceivedPeer:
+			fn(e)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		s.Close()
+		return s
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			select {
+			case e, ok := <-s.ch:
+				if !ok {
+					return
+				}
+				notify(e)
+			case <-c.done:
+				for {
+					select {
+					case e, ok := <-s.ch:
+						if !ok {
+							return
+						}
+						notify(e)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return s
+}
@@ -0,0 +1,129 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+//receivedEvents returns what sub holds, without waiting.
+func receivedEvents(sub *Subscription) (got []int) {
+	for {
+		select {
+		case e := <-sub.C:
+			got = append(got, e.Data.(int))
+		default:
+			return
+		}
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy OverflowPolicy
+		want   []int
+	}{
+		{"drop oldest", OverflowDropOldest, []int{3, 4}},
+		{"drop newest", OverflowDropNewest, []int{0, 1}},
+		{"block", OverflowBlock, []int{0, 1}},
+	} {
+		bus := newEventBus()
+		sub := bus.subscribe(2, c.policy, time.Millisecond)
+		for i := 0; i < 5; i++ {
+			bus.emit(Event{Data: i})
+		}
+		if got := receivedEvents(sub); len(got) != len(c.want) || got[0] != c.want[0] || got[1] != c.want[1] {
+			t.Errorf("%s: received %v, want %v", c.name, got, c.want)
+		}
+		if n := sub.Dropped(); n != 3 {
+			t.Errorf("%s: dropped %d, want 3", c.name, n)
+		}
+	}
+}
+
+//TestOverflowBlock checks that a full subscriber holds up delivery until it
+//reads, or the timeout passes.
+func TestOverflowBlock(t *testing.T) {
+	bus := newEventBus()
+	sub := bus.subscribe(1, OverflowBlock, time.Minute)
+	bus.emit(Event{Data: 0})
+	delivered := make(chan struct{})
+	go func() {
+		bus.emit(Event{Data: 1})
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+		t.Fatal("delivered to a full buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if e := <-sub.C; e.Data != 0 {
+		t.Fatalf("received %v", e.Data)
+	}
+	<-delivered
+	if e := <-sub.C; e.Data != 1 || sub.Dropped() != 0 {
+		t.Fatalf("received %v, dropped %d", e.Data, sub.Dropped())
+	}
+
+	//Closing ends the subscription; later events go nowhere
+	sub.Close()
+	bus.emit(Event{Data: 2})
+	if _, ok := <-sub.C; ok {
+		t.Error("closed subscription received an event")
+	}
+}
+
+//TestOnMappingChanged checks that callbacks see mapping events only, and
+//that Close waits for the ones already buffered.
+func TestOnMappingChanged(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	c, err := dialTestClient(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var ports []uint16
+	release := make(chan struct{})
+	c.OnMappingChanged(func(e Event) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		ports = append(ports, e.Data.(PortMap).InternalPort)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, port := range []uint16{8080, 8081} {
+		if _, err = c.MapPort(ctx, ProtocolTCP, port, 0, netip.Addr{}, 600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.events.emit(Event{Action: ActionReceivedAnnounce})
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close(ctx, false)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a callback was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 2 || ports[0] != 8080 || ports[1] != 8081 {
+		t.Errorf("callbacks for %v", ports)
+	}
+
+	//A closed client has no callbacks to run
+	sub := c.OnMappingChanged(func(Event) { t.Error("callback on a closed client") })
+	if _, ok := <-sub.C; ok {
+		t.Error("subscription on a closed client is open")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/netip"
 	"os"
 	"time"
 
@@ -30,7 +31,7 @@ func main() {
 	}
 	log.Infof("Internal IP: %s Gateway IP: %s", addr, gatewayAddr)
 
-	err = client.AddPortMapping(ProtocolTCP, 8080, 0, nil, DefaultLifetimeSeconds)
+	err = client.AddPortMapping(ProtocolTCP, 8080, 0, netip.Addr{}, DefaultLifetimeSeconds)
 	if err == nil {
 		log.Debug("successfully sent port map request")
 	}
@@ -0,0 +1,157 @@
+// +build ignore
+
+//This program generates protocols_iana.go from the IANA Assigned Internet
+//Protocol Numbers registry. Run it with go generate, or pass -in to read a
+//previously downloaded copy of protocol-numbers.xml.
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const registryURL = "https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xml"
+
+type registry struct {
+	Title   string `xml:"registry>title"`
+	Updated string `xml:"updated"`
+	Records []struct {
+		Value string `xml:"value"`
+		Name  string `xml:"name"`
+		Descr string `xml:"description"`
+	} `xml:"registry>record"`
+}
+
+type record struct {
+	value      int
+	ident      string
+	keyword    string
+	descr      string
+	deprecated bool
+}
+
+var identReplacer = strings.NewReplacer(
+	"-in-", "in",
+	"+", "P",
+	"-", "",
+	"/", "",
+	".", "",
+	" ", "",
+)
+
+func main() {
+	in := flag.String("in", "", "read the registry from this file instead of downloading it")
+	out := flag.String("out", "protocols_iana.go", "file to write")
+	flag.Parse()
+
+	var r io.Reader
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	} else {
+		resp, err := http.Get(registryURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("got HTTP status %d for %s", resp.StatusCode, registryURL)
+		}
+		r = resp.Body
+	}
+
+	var reg registry
+	if err := xml.NewDecoder(r).Decode(&reg); err != nil {
+		log.Fatal(err)
+	}
+	records := parse(&reg)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_protocols.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package pcp\n\n")
+	fmt.Fprintf(&b, "// %s, Updated: %s\n", reg.Title, reg.Updated)
+	fmt.Fprintf(&b, "const (\n")
+	for _, rec := range records {
+		fmt.Fprintf(&b, "Protocol%s Protocol = %d // %s\n", rec.ident, rec.value, comment(rec))
+	}
+	fmt.Fprintf(&b, ")\n\n")
+
+	fmt.Fprintf(&b, "// protocolNames holds the constant name of each assigned protocol, without the Protocol prefix.\n")
+	fmt.Fprintf(&b, "var protocolNames = [256]string{\n")
+	for _, rec := range records {
+		fmt.Fprintf(&b, "%d: %q,\n", rec.value, rec.ident)
+	}
+	fmt.Fprintf(&b, "}\n\n")
+
+	fmt.Fprintf(&b, "// protocolKeywords holds the IANA keyword of each assigned protocol.\n")
+	fmt.Fprintf(&b, "var protocolKeywords = [256]string{\n")
+	for _, rec := range records {
+		fmt.Fprintf(&b, "%d: %q,\n", rec.value, rec.keyword)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parse(reg *registry) (records []record) {
+	for _, r := range reg.Records {
+		value, err := strconv.Atoi(strings.TrimSpace(r.Value))
+		name := strings.TrimSpace(r.Name)
+		//Ranges and entries without a keyword (e.g. "any local network") have no constant
+		if err != nil || name == "" {
+			continue
+		}
+		rec := record{value: value, descr: strings.Join(strings.Fields(r.Descr), " ")}
+		if i := strings.Index(strings.ToLower(name), "(deprecated)"); i >= 0 {
+			rec.deprecated = true
+			name = strings.TrimSpace(name[:i])
+		}
+		rec.keyword = name
+		switch {
+		case value == 0:
+			//PCP uses protocol zero to mean all protocols, rather than HOPOPT
+			rec.ident = "All"
+			rec.keyword = "All"
+			rec.descr = "All protocols (PCP), IANA HOPOPT"
+		case name == "ISIS over IPv4":
+			rec.ident = "ISIS"
+		case name == "manet":
+			rec.ident = "MANET"
+		default:
+			rec.ident = identReplacer.Replace(name)
+		}
+		records = append(records, rec)
+	}
+	return
+}
+
+func comment(rec record) string {
+	s := rec.descr
+	if s == "" {
+		s = rec.keyword
+	}
+	if rec.deprecated {
+		s += " (deprecated)"
+	}
+	return s
+}
@@ -1,9 +1,13 @@
 module github.com/sashahilton00/go-pcp
 
-go 1.13
+go 1.18
 
 require (
-	github.com/boljen/go-bitmap v0.0.0-20151001105940-23cd2fb0ce7d
 	github.com/jackpal/gateway v1.0.5
 	github.com/sirupsen/logrus v1.4.2
 )
+
+require (
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	golang.org/x/sys v0.0.0-20190422165155-953cdadca894 // indirect
+)
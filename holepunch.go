@@ -0,0 +1,143 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//SignalFunc exchanges endpoints with the remote peer over some other channel,
+//e.g. a rendezvous server. It is given the external endpoint assigned to this
+//side and returns the one the peer was assigned.
+type SignalFunc func(ctx context.Context, local netip.AddrPort) (remote netip.AddrPort, err error)
+
+//Punch is a PEER mapping opened towards a remote peer by HolePunch. The
+//client keeps it alive like any other peer mapping until Close is called.
+type Punch struct {
+	Protocol     Protocol
+	InternalPort uint16
+	//Local is the external endpoint the server assigned, as given to the peer.
+	Local netip.AddrPort
+	//Remote is the peer's endpoint received through signalling.
+	Remote netip.AddrPort
+
+	client *Client
+	once   sync.Once
+	err    error
+}
+
+//HolePunch lets a remote peer reach internalPort through the primary PCP
+//server. It creates a PEER mapping towards candidate, the best known address
+//of the peer, and passes the assigned external endpoint to signal. If the
+//peer reports a different endpoint, the mapping is moved to it; the external
+//port already given out is suggested again, so the peer's view stays valid
+//wherever the server allows. The mapping is renewed until Close.
+func (c *Client) HolePunch(ctx context.Context, protocol Protocol, internalPort uint16, candidate netip.AddrPort, lifetime uint32, signal SignalFunc) (p *Punch, err error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if !candidate.Addr().IsValid() {
+		return nil, ErrNoAddress
+	}
+	candidate = netip.AddrPortFrom(candidate.Addr().Unmap(), candidate.Port())
+	s, err := c.primarySession()
+	if err != nil {
+		return nil, err
+	}
+	local, err := c.openPeer(ctx, s, protocol, internalPort, netip.AddrPort{}, candidate, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := signal(ctx, local)
+	if err == nil && !remote.Addr().IsValid() {
+		err = ErrNoAddress
+	}
+	if err != nil {
+		c.releasePeer(ctx, s, protocol, internalPort, candidate)
+		return nil, err
+	}
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	if remote != candidate {
+		//Open the new mapping before dropping the old one, so the server
+		//has no reason to give the external port to anyone else meanwhile
+		moved, err := c.openPeer(ctx, s, protocol, internalPort, local, remote, lifetime)
+		c.releasePeer(ctx, s, protocol, internalPort, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if moved != local {
+			log.Warnf("PCP server moved hole punch for port %d from %s to %s", internalPort, local, moved)
+			local = moved
+		}
+	}
+	return &Punch{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		Local:        local,
+		Remote:       remote,
+		client:       c,
+	}, nil
+}
+
+//Close deletes the PEER mapping. Later calls return the first call's result.
+func (p *Punch) Close(ctx context.Context) error {
+	p.once.Do(func() {
+		p.err = p.client.DeletePeerMapping(ctx, p.Protocol, p.InternalPort, p.Remote)
+	})
+	return p.err
+}
+
+//openPeer requests a PEER mapping on s and returns the external endpoint the
+//server assigned. The response adds the mapping to s, which keeps it renewed.
+func (c *Client) openPeer(ctx context.Context, s *Session, protocol Protocol, internalPort uint16, suggested, remote netip.AddrPort, lifetime uint32) (local netip.AddrPort, err error) {
+	if err = protocol.validatePorts(internalPort, suggested.Port(), remote.Port()); err != nil {
+		return
+	}
+	lifetime = clampLifetime(lifetime)
+	peerData := &OpDataPeer{
+		OpDataMap: OpDataMap{
+			Protocol:     protocol,
+			InternalPort: internalPort,
+			ExternalPort: suggested.Port(),
+			ExternalIP:   suggested.Addr(),
+		},
+		RemotePort: remote.Port(),
+		RemoteIP:   remote.Addr(),
+	}
+	res, err := c.request(ctx, s, OpPeer, lifetime, peerData)
+	if err != nil {
+		return
+	}
+	var data OpDataPeer
+	if err = data.unmarshal(res.opData); err != nil {
+		return
+	}
+	return data.ExternalAddr(), nil
+}
+
+//releasePeer deletes a PEER mapping on s. If the server cannot be asked, the
+//mapping is at least no longer renewed, so it expires.
+func (c *Client) releasePeer(ctx context.Context, s *Session, protocol Protocol, internalPort uint16, remote netip.AddrPort) {
+	key := s.peerKey(MappingKey{Protocol: protocol, InternalPort: internalPort, Remote: remote})
+	c.mu.Lock()
+	m, exists := s.PeerMappings[key]
+	c.mu.Unlock()
+	if !exists {
+		return
+	}
+	peerData := &OpDataPeer{
+		OpDataMap:  m.OpDataMap,
+		RemotePort: m.RemotePort,
+		RemoteIP:   m.RemoteIP,
+	}
+	if _, err := c.request(ctx, s, OpPeer, 0, peerData); err != nil {
+		log.Debugf("Could not delete peer mapping for port %d: %s", internalPort, err)
+		c.mu.Lock()
+		delete(s.PeerMappings, key)
+		c.sched.remove(mappingKey{s, OpPeer, key})
+		c.mu.Unlock()
+		c.stateChanged()
+	}
+}
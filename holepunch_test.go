@@ -0,0 +1,96 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHolePunch(t *testing.T) {
+	servers := [2]*testServer{newTestServer(t, nil), newTestServer(t, nil)}
+	servers[1].Table.ExternalIP = netip.MustParseAddr("198.51.100.7")
+	var clients [2]*Client
+	for i, srv := range servers {
+		srv.start(t)
+		clients[i] = newTestClient(t, srv)
+	}
+
+	//Each side only has a stale guess for the other, so both punches move
+	//once the endpoints are signalled
+	stale := netip.MustParseAddrPort("192.0.2.99:4000")
+	locals := [2]chan netip.AddrPort{make(chan netip.AddrPort, 1), make(chan netip.AddrPort, 1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var punches [2]*Punch
+	var errs [2]error
+	var firstLocal [2]netip.AddrPort
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			signal := func(ctx context.Context, local netip.AddrPort) (netip.AddrPort, error) {
+				firstLocal[i] = local
+				locals[i] <- local
+				select {
+				case remote := <-locals[1-i]:
+					return remote, nil
+				case <-ctx.Done():
+					return netip.AddrPort{}, ctx.Err()
+				}
+			}
+			punches[i], errs[i] = clients[i].HolePunch(ctx, ProtocolUDP, uint16(5000+i), stale, 600, signal)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, p := range punches {
+		if errs[i] != nil {
+			t.Fatalf("punch %d: %s", i, errs[i])
+		}
+		if p.Local != firstLocal[i] || p.Local.Addr() != servers[i].Table.ExternalIP {
+			t.Errorf("punch %d local %s, signalled %s", i, p.Local, firstLocal[i])
+		}
+		if p.Remote != punches[1-i].Local {
+			t.Errorf("punch %d remote %s, peer has %s", i, p.Remote, punches[1-i].Local)
+		}
+		//Only the mapping towards the signalled endpoint is left
+		entries := servers[i].Table.Entries()
+		if len(entries) != 1 || entries[0].Remote != p.Remote || entries[0].External != p.Local {
+			t.Errorf("server %d holds %+v", i, entries)
+		}
+		mappings := sessionPeerMappings(clients[i])
+		if _, ok := mappings[MappingKey{Protocol: ProtocolUDP, InternalPort: p.InternalPort, Remote: p.Remote}]; !ok || len(mappings) != 1 {
+			t.Errorf("client %d holds %+v", i, mappings)
+		}
+	}
+
+	for i, p := range punches {
+		if err := p.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Close(ctx); err != nil {
+			t.Fatalf("second close: %s", err)
+		}
+		if entries := servers[i].Table.Entries(); len(entries) != 0 {
+			t.Errorf("server %d still holds %+v", i, entries)
+		}
+		if mappings := sessionPeerMappings(clients[i]); len(mappings) != 0 {
+			t.Errorf("client %d still holds %+v", i, mappings)
+		}
+	}
+}
+
+//sessionPeerMappings copies the peer mappings of the client's only session.
+func sessionPeerMappings(c *Client) map[MappingKey]PeerMap {
+	s := c.sessionList()[0]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mappings := make(map[MappingKey]PeerMap, len(s.PeerMappings))
+	for k, m := range s.PeerMappings {
+		mappings[k] = m
+	}
+	return mappings
+}
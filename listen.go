@@ -0,0 +1,206 @@
+package pcp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+//listenerCloseTimeout bounds deleting the mapping when a listener is closed,
+//as net.Listener.Close takes no context.
+const listenerCloseTimeout = 5 * time.Second
+
+//Listener is a net.Listener with a port mapping on the PCP server, kept
+//alive until the listener is closed.
+type Listener struct {
+	net.Listener
+	mapping *Mapping
+	release func()
+	once    sync.Once
+	err     error
+}
+
+//PacketConn is a net.PacketConn with a port mapping on the PCP server, kept
+//alive until the connection is closed.
+type PacketConn struct {
+	net.PacketConn
+	mapping *Mapping
+	release func()
+	once    sync.Once
+	err     error
+}
+
+//ExternalAddr returns the endpoint the PCP server assigned to the listener.
+func (l *Listener) ExternalAddr() netip.AddrPort { return l.mapping.ExternalAddr() }
+
+//Mapping returns the handle on the listener's mapping, e.g. to follow Updates.
+func (l *Listener) Mapping() *Mapping { return l.mapping }
+
+//Close closes the listener and deletes its mapping.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		l.err = closeMapped(l.Listener, l.mapping, l.release)
+	})
+	return l.err
+}
+
+//ExternalAddr returns the endpoint the PCP server assigned to the connection.
+func (p *PacketConn) ExternalAddr() netip.AddrPort { return p.mapping.ExternalAddr() }
+
+//Mapping returns the handle on the connection's mapping, e.g. to follow Updates.
+func (p *PacketConn) Mapping() *Mapping { return p.mapping }
+
+//Close closes the connection and deletes its mapping.
+func (p *PacketConn) Close() error {
+	p.once.Do(func() {
+		p.err = closeMapped(p.PacketConn, p.mapping, p.release)
+	})
+	return p.err
+}
+
+func closeMapped(c interface{ Close() error }, m *Mapping, release func()) (err error) {
+	err = c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), listenerCloseTimeout)
+	defer cancel()
+	//A closed mapping means the client was closed first, which deleted it
+	if e := m.Close(ctx); e != nil && e != ErrMappingClosed && err == nil {
+		err = e
+	}
+	if release != nil {
+		release()
+	}
+	return
+}
+
+//Listen is like net.Listen for "tcp", "tcp4" and "tcp6", but also maps the
+//port on the PCP server, suggesting the same external port. The mapping is
+//made from the client's internal address, so address should cover it.
+func (c *Client) Listen(ctx context.Context, network, address string) (*Listener, error) {
+	if protocolForNetwork(network) != ProtocolTCP {
+		return nil, net.UnknownNetworkError(network)
+	}
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.mapListener(ctx, ProtocolTCP, ln.Addr())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &Listener{Listener: ln, mapping: m}, nil
+}
+
+//ListenPacket is like net.ListenPacket for "udp", "udp4" and "udp6", but also
+//maps the port on the PCP server, suggesting the same external port.
+func (c *Client) ListenPacket(ctx context.Context, network, address string) (*PacketConn, error) {
+	if protocolForNetwork(network) != ProtocolUDP {
+		return nil, net.UnknownNetworkError(network)
+	}
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.mapListener(ctx, ProtocolUDP, pc.LocalAddr())
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &PacketConn{PacketConn: pc, mapping: m}, nil
+}
+
+func (c *Client) mapListener(ctx context.Context, protocol Protocol, addr net.Addr) (*Mapping, error) {
+	var port uint16
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		port = uint16(a.Port)
+	case *net.UDPAddr:
+		port = uint16(a.Port)
+	}
+	return c.OpenPortMapping(ctx, protocol, port, port, netip.Addr{}, DefaultLifetimeSeconds)
+}
+
+func protocolForNetwork(network string) Protocol {
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return ProtocolTCP
+	case strings.HasPrefix(network, "udp"):
+		return ProtocolUDP
+	}
+	return 0
+}
+
+//defaultClient is shared by the package level Listen and ListenPacket. It is
+//created for the first listener and closed with the last one.
+var defaultClient struct {
+	mu     sync.Mutex
+	client *Client
+	refs   int
+	//dial creates the client, NewClient if nil
+	dial func() (*Client, error)
+}
+
+func acquireDefaultClient() (*Client, error) {
+	defaultClient.mu.Lock()
+	defer defaultClient.mu.Unlock()
+	if defaultClient.client == nil {
+		dial := defaultClient.dial
+		if dial == nil {
+			dial = func() (*Client, error) { return NewClient() }
+		}
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		defaultClient.client = c
+	}
+	defaultClient.refs++
+	return defaultClient.client, nil
+}
+
+func releaseDefaultClient() {
+	defaultClient.mu.Lock()
+	defer defaultClient.mu.Unlock()
+	defaultClient.refs--
+	if defaultClient.refs == 0 {
+		defaultClient.client.Close(context.Background(), false)
+		defaultClient.client = nil
+	}
+}
+
+//Listen is Client.Listen on a client shared by the package level listeners,
+//which is created with NewClient on first use.
+func Listen(ctx context.Context, network, address string) (*Listener, error) {
+	c, err := acquireDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	l, err := c.Listen(ctx, network, address)
+	if err != nil {
+		releaseDefaultClient()
+		return nil, err
+	}
+	l.release = releaseDefaultClient
+	return l, nil
+}
+
+//ListenPacket is Client.ListenPacket on the client shared by the package
+//level listeners.
+func ListenPacket(ctx context.Context, network, address string) (*PacketConn, error) {
+	c, err := acquireDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := c.ListenPacket(ctx, network, address)
+	if err != nil {
+		releaseDefaultClient()
+		return nil, err
+	}
+	pc.release = releaseDefaultClient
+	return pc, nil
+}
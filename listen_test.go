@@ -0,0 +1,98 @@
+package pcp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//useDefaultClient makes the package level listeners dial srv, counting the
+//clients made.
+func useDefaultClient(t *testing.T, srv *testServer) (dials *int) {
+	dials = new(int)
+	defaultClient.mu.Lock()
+	defaultClient.dial = func() (*Client, error) {
+		*dials++
+		return dialTestClient(srv)
+	}
+	defaultClient.mu.Unlock()
+	t.Cleanup(func() {
+		defaultClient.mu.Lock()
+		defaultClient.dial = nil
+		defaultClient.mu.Unlock()
+	})
+	return dials
+}
+
+func defaultClientState() (*Client, int) {
+	defaultClient.mu.Lock()
+	defer defaultClient.mu.Unlock()
+	return defaultClient.client, defaultClient.refs
+}
+
+func TestDefaultClient(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	dials := useDefaultClient(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := Listen(ctx, "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := ListenPacket(ctx, "udp4", "127.0.0.1:0")
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	c, refs := defaultClientState()
+	if *dials != 1 || refs != 2 {
+		t.Fatalf("%d clients made, %d references; want 1 client shared by both", *dials, refs)
+	}
+	if l.Mapping().client != c || pc.Mapping().client != c {
+		t.Error("listeners do not use the default client")
+	}
+	if n := len(srv.Table.Entries()); n != 2 {
+		t.Errorf("server holds %d mappings, want one per listener", n)
+	}
+
+	//A failed listener gives its reference back
+	if _, err = Listen(ctx, "udp", "127.0.0.1:0"); err == nil {
+		t.Error("Listen accepted a UDP network")
+	}
+	if _, refs = defaultClientState(); refs != 2 {
+		t.Errorf("%d references after a failed Listen, want 2", refs)
+	}
+
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.isClosed() {
+		t.Fatal("closing the first listener closed the shared client")
+	}
+	if n := len(srv.Table.Entries()); n != 1 {
+		t.Errorf("server holds %d mappings after closing a listener, want 1", n)
+	}
+	if err = pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.isClosed() {
+		t.Error("closing the last listener left the shared client open")
+	}
+	if n := len(srv.Table.Entries()); n != 0 {
+		t.Errorf("server holds %d mappings after closing both listeners", n)
+	}
+	if cur, refs := defaultClientState(); cur != nil || refs != 0 {
+		t.Errorf("default client %p with %d references after closing both listeners", cur, refs)
+	}
+
+	//The next listener starts a new client
+	if l, err = Listen(ctx, "tcp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if cur, _ := defaultClientState(); *dials != 2 || cur == c {
+		t.Error("listener after the last was closed reused the closed client")
+	}
+}
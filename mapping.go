@@ -0,0 +1,313 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+)
+
+//Mapping is a handle on a port or peer mapping opened with OpenPortMapping
+//or OpenPeerMapping. The client renews it on every server until Close is
+//called, requesting it again if it expires. It reports the mapping held on
+//the primary server.
+type Mapping struct {
+	Protocol     Protocol
+	InternalPort uint16
+	//Remote is the peer of a PEER mapping, unset for a MAP mapping.
+	Remote netip.AddrPort
+
+	client   *Client
+	key      mappingKey
+	data     interface{}
+	lifetime uint32
+	updates  chan PortMap
+
+	mu      sync.Mutex
+	current PortMap
+	err     error
+	closed  bool
+}
+
+//ExternalAddr returns the external address and port the server assigned.
+func (m *Mapping) ExternalAddr() netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current.ExternalAddr()
+}
+
+//Lifetime returns the lifetime in seconds the server last granted.
+func (m *Mapping) Lifetime() uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current.Lifetime
+}
+
+//Updates delivers the mapping whenever the server answers for it, e.g. on
+//renewal or after a network change. Only the latest value is kept if the
+//reader falls behind. The channel is closed when the handle is.
+func (m *Mapping) Updates() <-chan PortMap {
+	return m.updates
+}
+
+//Err returns the last error seen for the mapping: a result error from the
+//server, ErrMappingExpired while it is being requested again, or the reason
+//the handle was closed. It is reset by the next successful response.
+func (m *Mapping) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+//Refresh renews the mapping on every server now and waits for the answers.
+func (m *Mapping) Refresh(ctx context.Context) error {
+	if m.isClosed() {
+		return ErrMappingClosed
+	}
+	c := m.client
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	return c.eachSession(func(s *Session) error {
+		_, err := c.request(ctx, s, m.key.op, m.lifetime, m.data)
+		return err
+	})
+}
+
+//Close stops renewing the mapping and deletes it on the servers. Later calls
+//return ErrMappingClosed.
+func (m *Mapping) Close(ctx context.Context) (err error) {
+	c := m.client
+	c.mu.Lock()
+	if c.handles[m.key] == m {
+		delete(c.handles, m.key)
+	}
+	c.mu.Unlock()
+	if !m.finish(ErrMappingClosed) {
+		return ErrMappingClosed
+	}
+	switch m.key.op {
+	case OpMap:
+		err = c.DeletePortMapping(ctx, m.Protocol, m.InternalPort)
+	case OpPeer:
+		err = c.DeletePeerMapping(ctx, m.Protocol, m.InternalPort, m.Remote)
+	}
+	if err == ErrMappingNotFound {
+		//Already gone, e.g. it expired while no server could be reached
+		err = nil
+	}
+	return
+}
+
+func (m *Mapping) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+//update records a response from the primary server. err is set when the
+//server refused or the mapping expired, in which case current is kept.
+func (m *Mapping) update(pm PortMap, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.err = err
+	if err != nil {
+		return
+	}
+	m.current = pm
+	select {
+	case m.updates <- pm:
+	default:
+		select {
+		case <-m.updates:
+		default:
+		}
+		m.updates <- pm
+	}
+}
+
+//finish closes the handle with err, reporting false if it was already closed.
+func (m *Mapping) finish(err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	m.closed = true
+	m.err = err
+	close(m.updates)
+	return true
+}
+
+//OpenPortMapping requests a mapping like AddPortMapping, but waits until a
+//server grants it and returns a handle on it.
+func (c *Client) OpenPortMapping(ctx context.Context, protocol Protocol, internalPort, requestedExternalPort uint16, requestedAddr netip.Addr, lifetime uint32) (m *Mapping, err error) {
+	if err = protocol.validatePorts(internalPort, requestedExternalPort); err != nil {
+		return
+	}
+	m = &Mapping{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		data: &OpDataMap{
+			Protocol:     protocol,
+			InternalPort: internalPort,
+			ExternalPort: requestedExternalPort,
+			ExternalIP:   requestedAddr,
+		},
+	}
+	return m, c.openHandle(ctx, m, OpMap, lifetime)
+}
+
+//OpenPeerMapping requests a peer mapping like AddPeerMapping, but waits until
+//a server grants it and returns a handle on it.
+func (c *Client) OpenPeerMapping(ctx context.Context, protocol Protocol, internalPort, requestedExternalPort uint16, requestedAddr netip.Addr, remote netip.AddrPort, lifetime uint32) (m *Mapping, err error) {
+	if err = protocol.validatePorts(internalPort, requestedExternalPort, remote.Port()); err != nil {
+		return
+	}
+	//Responses carry the remote address unmapped, so the key must match that
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	m = &Mapping{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		Remote:       remote,
+		data: &OpDataPeer{
+			OpDataMap: OpDataMap{
+				Protocol:     protocol,
+				InternalPort: internalPort,
+				ExternalPort: requestedExternalPort,
+				ExternalIP:   requestedAddr,
+			},
+			RemotePort: remote.Port(),
+			RemoteIP:   remote.Addr(),
+		},
+	}
+	return m, c.openHandle(ctx, m, OpPeer, lifetime)
+}
+
+//openHandle registers m, so responses reach it, and requests the mapping on
+//every server. m is unregistered again unless some server grants it.
+func (c *Client) openHandle(ctx context.Context, m *Mapping, op OpCode, lifetime uint32) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	if m.Remote.IsValid() && !m.Remote.Addr().IsValid() {
+		return ErrNoAddress
+	}
+	if err = c.registerHandle(m, op, lifetime); err != nil {
+		return
+	}
+	lifetime = m.lifetime
+
+	sessions := c.sessionList()
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			_, errs[i] = c.request(ctx, s, op, lifetime, m.data)
+		}(i, s)
+	}
+	wg.Wait()
+	var granted *PortMap
+	for i, s := range sessions {
+		if errs[i] != nil {
+			if err == nil {
+				err = errs[i]
+			}
+			continue
+		}
+		if granted == nil {
+			pm := c.sessionMapping(s, requestKey(s, op, m.data))
+			granted = &pm
+		}
+	}
+	if granted == nil {
+		c.mu.Lock()
+		delete(c.handles, m.key)
+		c.mu.Unlock()
+		m.finish(err)
+		return err
+	}
+	m.mu.Lock()
+	if !m.current.Active {
+		m.current = *granted
+	}
+	m.err = nil
+	m.mu.Unlock()
+	c.saveNow()
+	return nil
+}
+
+//registerHandle sets m up and registers it, so responses reach it. Only one
+//handle may be open for a mapping.
+func (c *Client) registerHandle(m *Mapping, op OpCode, lifetime uint32) error {
+	lifetime = clampLifetime(lifetime)
+	m.client = c
+	m.lifetime = lifetime
+	m.updates = make(chan PortMap, 1)
+	m.key = requestKey(nil, op, m.data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.handles[m.key]; exists {
+		return ErrMappingInUse
+	}
+	c.handles[m.key] = m
+	return nil
+}
+
+//sessionMapping returns the state of key on its session.
+func (c *Client) sessionMapping(s *Session, key mappingKey) PortMap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key.op == OpPeer {
+		return s.PeerMappings[key.MappingKey].PortMap
+	}
+	return s.Mappings[key.MappingKey]
+}
+
+//handleFor returns the open handle for key, and whether s is the primary
+//session whose state the handle reports.
+func (c *Client) handleFor(s *Session, key mappingKey) (m *Mapping, primary bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m = c.handles[mappingKey{op: key.op, MappingKey: key.MappingKey}]
+	if m == nil && key.op == OpPeer {
+		//A handle on an IPv4 peer reached through NAT64
+		if v4, ok := s.ipv4Key(key.MappingKey); ok {
+			m = c.handles[mappingKey{op: key.op, MappingKey: v4}]
+		}
+	}
+	primary = len(c.sessions) > 0 && c.sessions[0] == s
+	return
+}
+
+//updateHandle passes a response for key on s to its handle, if it has one.
+//A deletion the handle did not ask for closes it.
+func (c *Client) updateHandle(s *Session, key mappingKey, pm PortMap, err error) {
+	m, primary := c.handleFor(s, key)
+	if m == nil || !primary {
+		return
+	}
+	if err == nil && !pm.Active {
+		c.mu.Lock()
+		delete(c.handles, m.key)
+		c.mu.Unlock()
+		m.finish(ErrMappingNotFound)
+		return
+	}
+	m.update(pm, err)
+}
+
+//closeHandles ends every open handle when the client closes.
+func (c *Client) closeHandles() {
+	c.mu.Lock()
+	handles := c.handles
+	c.handles = make(map[mappingKey]*Mapping)
+	c.mu.Unlock()
+	for _, m := range handles {
+		m.finish(ErrClientClosed)
+	}
+}
@@ -0,0 +1,300 @@
+package pcp
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackpal/gateway"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//DefaultNetworkPollInterval is how often interfaces are checked when netlink is unavailable.
+	DefaultNetworkPollInterval = 5 * time.Second
+	//networkSettleTime lets a burst of change notifications (e.g. DHCP
+	//bringing up an interface) finish before the network is re-examined.
+	networkSettleTime = time.Second
+)
+
+//NetworkChange is the data of an ActionNetworkChanged event. It lists the
+//servers, and the internal address used with the primary one, before and
+//after the move.
+type NetworkChange struct {
+	OldServers  []netip.Addr
+	NewServers  []netip.Addr
+	OldInternal netip.Addr
+	NewInternal netip.Addr
+}
+
+//watchNetwork waits for interface or route changes and then calls
+//checkNetwork. Changes come from netlink where available; otherwise, or when
+//WithNetworkPolling is used or netlink fails, the interfaces are polled.
+func (c *Client) watchNetwork() {
+	defer c.wg.Done()
+	changed := make(chan struct{}, 1)
+	var poll Ticker
+	var pollC <-chan time.Time
+	defer func() {
+		if poll != nil {
+			poll.Stop()
+		}
+	}()
+	var failed chan error
+	var w *netlinkWatcher
+	var err error
+	if c.pollInterval == 0 {
+		w, err = newNetlinkWatcher()
+	}
+	if w != nil {
+		failed = make(chan error, 1)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			if err := w.run(c.done, changed); err != nil {
+				failed <- err
+			}
+		}()
+	} else {
+		if err != nil {
+			log.Debugf("Falling back to polling for network changes: %s", err)
+		}
+		poll = c.newPollTicker()
+		pollC = poll.C()
+	}
+
+	fingerprint := networkFingerprint()
+	var settle Timer
+	var settleC <-chan time.Time
+	for {
+		select {
+		case <-c.done:
+			if settle != nil {
+				settle.Stop()
+			}
+			return
+		case <-pollC:
+			if f := networkFingerprint(); f != fingerprint {
+				fingerprint = f
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		case err := <-failed:
+			log.Warnf("Netlink failed, polling for network changes instead: %s", err)
+			failed = nil
+			poll = c.newPollTicker()
+			pollC = poll.C()
+			//Changes may have been lost with the socket, so look now
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		case <-changed:
+			//Restart the settle time on every notification
+			if settle == nil {
+				settle = c.clock.NewTimer(networkSettleTime)
+				settleC = settle.C()
+			} else {
+				settle.Stop()
+				settle.Reset(networkSettleTime)
+			}
+		case <-settleC:
+			settle, settleC = nil, nil
+			c.checkNetwork()
+		}
+	}
+}
+
+//newPollTicker returns the ticker for polling the interfaces.
+func (c *Client) newPollTicker() Ticker {
+	interval := c.pollInterval
+	if interval <= 0 {
+		interval = DefaultNetworkPollInterval
+	}
+	return c.clock.NewTicker(interval)
+}
+
+//networkFingerprint summarises the interface addresses and default gateway,
+//so polling can tell when either changes.
+func networkFingerprint() string {
+	var parts []string
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			parts = append(parts, iface.Name+" "+a.String())
+		}
+	}
+	sort.Strings(parts)
+	if gw, err := gateway.DiscoverGateway(); err == nil {
+		parts = append(parts, "gw "+gw.String())
+	}
+	return strings.Join(parts, "\n")
+}
+
+//checkNetwork runs discovery again after a change. If the servers, or the
+//local addresses used to reach them, are different, new sessions replace the
+//old ones and every mapping is requested again on the new network.
+func (c *Client) checkNetwork() {
+	servers, err := c.discovery.Discover()
+	if err != nil {
+		//Probably between networks; the next change will try again
+		log.Debugf("Discovery after network change failed: %s", err)
+		return
+	}
+	old := c.sessionList()
+	if sameNetwork(old, servers) {
+		return
+	}
+	var sessions []*Session
+	for _, server := range servers {
+		serverAddr, conn, err := connectServer(server)
+		if err != nil {
+			log.Debugf("Could not connect to PCP server %v: %s", server.Addrs, err)
+			continue
+		}
+		sessions = append(sessions, newSession(server, serverAddr, conn))
+	}
+	if len(sessions) == 0 {
+		return
+	}
+	c.replaceSessions(old, sessions, servers)
+}
+
+//sameNetwork reports whether the sessions already cover servers, reached
+//from the local addresses the system would pick for them now. Dialing UDP
+//sends nothing, it only asks the kernel for a route.
+func sameNetwork(sessions []*Session, servers []Server) bool {
+	if len(sessions) != len(servers) {
+		return false
+	}
+	for i, s := range sessions {
+		if len(servers[i].Addrs) == 0 || len(s.Server.Addrs) == 0 || servers[i].Addrs[0] != s.Server.Addrs[0] {
+			return false
+		}
+		conn, err := dialServer(s.Addr)
+		if err != nil {
+			return false
+		}
+		now := localAddress(conn, s.Addr)
+		conn.Close()
+		if now != s.internal {
+			return false
+		}
+	}
+	return true
+}
+
+//replaceSessions swaps in sessions for a new network and requests the
+//mappings held on the old one again. External addresses from the old network
+//mean nothing on the new one, so only the external port is suggested.
+func (c *Client) replaceSessions(old, sessions []*Session, servers []Server) {
+	change := NetworkChange{NewServers: sessionAddrs(sessions)}
+	change.OldServers = sessionAddrs(old)
+	if len(old) > 0 {
+		change.OldInternal, _ = old[0].internalAddress()
+	}
+	change.NewInternal, _ = sessions[0].internalAddress()
+
+	var maps []PortMap
+	var peers []PeerMap
+	seen := make(map[mappingKey]bool)
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		for _, s := range sessions {
+			s.conn.Close()
+		}
+		return
+	}
+	for _, s := range old {
+		for k, m := range s.Mappings {
+			c.sched.remove(mappingKey{s, OpMap, k})
+			if !seen[mappingKey{op: OpMap, MappingKey: k}] {
+				seen[mappingKey{op: OpMap, MappingKey: k}] = true
+				maps = append(maps, m)
+			}
+		}
+		for k, m := range s.PeerMappings {
+			c.sched.remove(mappingKey{s, OpPeer, k})
+			if !seen[mappingKey{op: OpPeer, MappingKey: k}] {
+				seen[mappingKey{op: OpPeer, MappingKey: k}] = true
+				peers = append(peers, m)
+			}
+		}
+	}
+	primary := sessions[0]
+	c.sessions = sessions
+	c.Servers = servers
+	c.GatewayAddr = primary.Addr
+	c.Mappings = primary.Mappings
+	c.PeerMappings = primary.PeerMappings
+	c.gateway = netip.Addr{}
+	c.mu.Unlock()
+	c.stateChanged()
+
+	for _, s := range old {
+		s.close()
+	}
+	for _, s := range sessions {
+		c.startSession(s)
+	}
+	log.Debugf("Network changed, servers %v -> %v", change.OldServers, change.NewServers)
+	if c.newEAPPeer != nil {
+		//Failures are logged; mappings cannot be made again on a server
+		//that has not accepted the client yet
+		c.authenticateSessions(sessions)
+	}
+
+	for _, m := range maps {
+		mapData := &OpDataMap{
+			Protocol:     m.Protocol,
+			InternalPort: m.InternalPort,
+			ExternalPort: m.ExternalPort,
+			ThirdParty:   m.ThirdParty,
+			Description:  m.Description,
+			PortSet:      m.PortSet,
+		}
+		if err := c.addMapping(OpMap, remapLifetime(m), mapData); err != nil {
+			log.Errorf("Could not remap port %d: %s", m.InternalPort, err)
+		}
+	}
+	for _, m := range peers {
+		peerData := &OpDataPeer{
+			OpDataMap: OpDataMap{
+				Protocol:     m.Protocol,
+				InternalPort: m.InternalPort,
+				ExternalPort: m.ExternalPort,
+				ThirdParty:   m.ThirdParty,
+				Description:  m.Description,
+			},
+			RemotePort: m.RemotePort,
+			RemoteIP:   m.RemoteIP,
+		}
+		if err := c.addMapping(OpPeer, remapLifetime(m.PortMap), peerData); err != nil {
+			log.Errorf("Could not remap peer mapping for port %d: %s", m.InternalPort, err)
+		}
+	}
+	c.events.emit(Event{ActionNetworkChanged, change, primary.Addr})
+}
+
+func remapLifetime(m PortMap) uint32 {
+	if m.Lifetime == 0 {
+		return DefaultLifetimeSeconds
+	}
+	return m.Lifetime
+}
+
+func sessionAddrs(sessions []*Session) (addrs []netip.Addr) {
+	for _, s := range sessions {
+		addrs = append(addrs, s.Addr)
+	}
+	return
+}
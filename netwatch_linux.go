@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package pcp
+
+import (
+	"syscall"
+	"time"
+)
+
+//rtnetlink multicast groups from linux/rtnetlink.h, which syscall does not define.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+
+	//netlinkGroups are the groups for link, address and route changes.
+	netlinkGroups = rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv4Route | rtmgrpIPv6IfAddr | rtmgrpIPv6Route
+)
+
+//netlinkWatcher receives change notifications from the kernel routing subsystem.
+type netlinkWatcher struct {
+	fd int
+}
+
+func newNetlinkWatcher() (*netlinkWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: netlinkGroups}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	//A blocked recvfrom is not woken by closing the socket, so wake up
+	//regularly to notice the client closing.
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &netlinkWatcher{fd}, nil
+}
+
+//run signals changed for every link, address or route message until done is
+//closed, when it returns nil. If the socket fails, e.g. because the kernel
+//dropped messages, run returns the error so the caller can poll instead.
+func (w *netlinkWatcher) run(done <-chan struct{}, changed chan<- struct{}) error {
+	defer syscall.Close(w.fd)
+	buf := make([]byte, 1<<16)
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		n, _, err := syscall.Recvfrom(w.fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK,
+				syscall.RTM_NEWADDR, syscall.RTM_DELADDR,
+				syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package pcp
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+//TestNetlinkFailure checks that run reports a failed socket, so the client
+//can poll instead, and returns nil once done is closed.
+func TestNetlinkFailure(t *testing.T) {
+	w, err := newNetlinkWatcher()
+	if err != nil {
+		t.Skipf("netlink unavailable: %s", err)
+	}
+	//An invalid descriptor, so the deferred close cannot hit a reused one
+	syscall.Close(w.fd)
+	w.fd = -1
+	result := make(chan error, 1)
+	go func() { result <- w.run(make(chan struct{}), make(chan struct{}, 1)) }()
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Error("run returned nil for a closed socket")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the socket failed")
+	}
+
+	if w, err = newNetlinkWatcher(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	close(done)
+	if err = w.run(done, make(chan struct{}, 1)); err != nil {
+		t.Errorf("run after done: %s", err)
+	}
+}
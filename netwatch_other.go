@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package pcp
+
+import "errors"
+
+//netlinkWatcher is only available on Linux; elsewhere the client polls.
+type netlinkWatcher struct{}
+
+func newNetlinkWatcher() (*netlinkWatcher, error) {
+	return nil, errors.New("netlink is not supported on this platform")
+}
+
+func (w *netlinkWatcher) run(done <-chan struct{}, changed chan<- struct{}) error { return nil }
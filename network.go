@@ -1,196 +1,604 @@
 package pcp
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-//Potentially add deviceAddr at a later stage
-func NewClient() (client *Client, err error) {
-	gatewayAddr, err := client.GetGatewayAddress()
+const (
+	//Retransmission timings, see 8.1.1 of RFC6887
+	initialRetransmitTime = 3 * time.Second
+	maxRetransmitTime     = 1024 * time.Second
+	//DefaultRequestTimeout bounds requests made with a context that has no deadline.
+	DefaultRequestTimeout = 30 * time.Second
+	//receiveQueueSize lets the readers run ahead of response processing a little.
+	receiveQueueSize = 64
+)
+
+//NewClient discovers PCP servers (see Discovery) and opens a session with
+//each one, so mappings are made on every uplink of a multi-homed host.
+func NewClient(opts ...ClientOption) (client *Client, err error) {
+	//Options only set fields, so applying them to a throwaway client is a
+	//cheap way to read the discovery settings before connecting.
+	cfg := &Client{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	servers, err := cfg.discovery.Discover()
 	if err != nil {
 		return nil, err
 	}
-	udpAddr := &net.UDPAddr{IP: gatewayAddr, Port: 5351}
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	var sessions []*Session
+	for _, server := range servers {
+		serverAddr, conn, e := connectServer(server)
+		if e != nil {
+			log.Debugf("Could not connect to PCP server %v: %s", server.Addrs, e)
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		sessions = append(sessions, newSession(server, serverAddr, conn))
+	}
+	if len(sessions) == 0 {
+		return nil, err
+	}
+	client, err = newClient(sessions, opts...)
 	if err != nil {
 		return nil, err
 	}
-	cancelChan, eventChan := make(chan bool), make(chan Event)
-
-	mappings := make(map[uint16]PortMap)
-	peerMappings := make(map[uint16]PeerMap)
+	client.Servers = servers
+	if !client.noWatch {
+		client.wg.Add(1)
+		go client.watchNetwork()
+	}
+	return client, nil
+}
 
-	clientEpoch := &ClientEpoch{}
+//newClient sets up a client around already connected sessions and starts
+//its goroutines. The first session is the primary one.
+func newClient(sessions []*Session, opts ...ClientOption) (client *Client, err error) {
+	events := newEventBus()
+	defaultSub := events.subscribe(DefaultEventBufferSize, OverflowDropOldest, 0)
 
 	nonce, err := genRandomBytes(12)
 	if err != nil {
+		for _, s := range sessions {
+			s.conn.Close()
+		}
 		return nil, ErrNonceGeneration
 	}
 
-	client = &Client{gatewayAddr, eventChan, mappings, peerMappings, conn, cancelChan, clientEpoch, nonce}
+	primary := sessions[0]
+	client = &Client{
+		GatewayAddr:  primary.Addr,
+		Event:        defaultSub.C,
+		Mappings:     primary.Mappings,
+		PeerMappings: primary.PeerMappings,
+		sessions:     sessions,
+		recv:         make(chan received, receiveQueueSize),
+		waiters:      make(map[mappingKey][]*waiter),
+		handles:      make(map[mappingKey]*Mapping),
+		sched:        newScheduler(),
+		clock:        realClock{},
+		events:       events,
+		requestRate:  DefaultRequestRate,
+		maxInFlight:  DefaultMaxInFlight,
+		done:         make(chan struct{}),
+		nonce:        nonce,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	if client.rand == nil {
+		client.rand = newLockedRand(newRandSource())
+	}
+	var deletions []mappingKey
+	var datas []interface{}
+	if client.store != nil {
+		client.stateDirty = make(chan struct{}, 1)
+		deletions, datas, err = client.restoreState()
+		if err != nil {
+			for _, s := range sessions {
+				s.conn.Close()
+			}
+			return nil, err
+		}
+	}
 
+	client.wg.Add(1)
 	go client.handleMessage()
+	if client.newEAPPeer != nil {
+		if err = client.authenticateSessions(sessions); err != nil {
+			close(client.done)
+			for _, s := range sessions {
+				s.close()
+			}
+			client.wg.Wait()
+			return nil, err
+		}
+	}
+	client.wg.Add(1)
 	go client.checkMappings()
+	if client.store != nil {
+		client.wg.Add(1)
+		go client.saveState()
+		//Save straight away, so the nonce is stored before any mapping is made
+		client.persist()
+		if len(deletions) > 0 {
+			client.wg.Add(1)
+			go client.deleteRestored(deletions, datas)
+		}
+	}
 	return client, nil
 }
 
-func (c *Client) checkMappings() (err error) {
+//checkMappings sleeps until the next mapping is due for renewal or expiry,
+//rather than polling the whole table.
+func (c *Client) checkMappings() {
+	defer c.wg.Done()
+	timer := c.clock.NewTimer(time.Hour)
+	defer timer.Stop()
 	for {
-		for k, v := range c.Mappings {
-			t := time.Now()
-			if v.Active && v.Refresh.Time <= t.Unix() {
-				log.Debugf("Refreshing mapping for port: %d", k)
-				err = c.RefreshPortMapping(v.InternalPort, v.Lifetime)
-				if err != nil {
-					log.Errorf("Error occured whilst refreshing mapping: %s", err)
-				}
+		now := c.clock.Now().Unix()
+		for _, key := range c.sched.due(now) {
+			c.refreshDue(key, now)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
 			}
 		}
-		time.Sleep(time.Second)
+		if at, ok := c.sched.next(); ok {
+			timer.Reset(time.Unix(at, 0).Sub(c.clock.Now()))
+		} else {
+			timer.Reset(time.Hour)
+		}
+		select {
+		case <-c.done:
+			return
+		case <-c.sched.wake:
+		case <-timer.C():
+		}
 	}
 }
 
-func (c *Client) handleMessage() (err error) {
-	ch := make(chan []byte)
-	go func() {
-		for {
-			select {
-			case <- c.cancelled:
-				close(ch)
-				break
-			case <-time.After(10 * time.Millisecond):
-				msg := make([]byte, 2048)
-				len, from, err := c.conn.ReadFromUDP(msg)
-				if err != nil {
-					log.Debugf("Error occurred when receiving UDP packet: %s\n", err)
-					continue
-				}
-				//Seems to be the only thing that works. Should fix proerly in future.
-				if fmt.Sprintf("%x", from.IP) != fmt.Sprintf("%x", c.GatewayAddr) {
-					log.Debug(ErrAddressMismatch)
-					continue
-				}
-				msg = msg[:len]
-				ch <- msg
-			}
-			time.Sleep(time.Millisecond)
-		}
-	}()
+//received is a packet read from a session's socket. buf goes back to
+//packetBuffers once the packet has been handled.
+type received struct {
+	session *Session
+	msg     []byte
+	buf     *[]byte
+}
+
+//packetBuffers holds receive buffers, so reading a packet does not allocate.
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 2048)
+		return &b
+	},
+}
+
+//startSession starts reading responses from the session's server.
+func (c *Client) startSession(s *Session) {
+	c.wg.Add(1)
+	go c.readSession(s, c.recv)
+}
+
+//readSession passes packets from the session's server to ch. The read
+//blocks until a packet arrives; closing the socket, when the session is
+//replaced or the client closes, ends the loop.
+func (c *Client) readSession(s *Session, ch chan<- received) {
+	defer c.wg.Done()
 	for {
+		buf := packetBuffers.Get().(*[]byte)
+		len, from, err := s.conn.ReadFromUDPAddrPort(*buf)
+		if err != nil {
+			packetBuffers.Put(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			//e.g. ICMP port unreachable while the server is down
+			log.Debugf("Error occurred when receiving UDP packet: %s", err)
+			continue
+		}
+		if !sameAddr(from.Addr(), s.Addr) {
+			packetBuffers.Put(buf)
+			log.Debug(ErrAddressMismatch)
+			continue
+		}
 		select {
-		case msg := <-ch:
-			var res ResponsePacket
-			err = res.unmarshal(msg)
+		case ch <- received{s, (*buf)[:len], buf}:
+		case <-s.done:
+			packetBuffers.Put(buf)
+			return
+		case <-c.done:
+			packetBuffers.Put(buf)
+			return
+		}
+	}
+}
+
+func (c *Client) handleMessage() {
+	defer c.wg.Done()
+	for _, s := range c.sessionList() {
+		c.startSession(s)
+	}
+	for {
+		select {
+		case <-c.done:
+			return
+		case r := <-c.recv:
+			c.handleResponse(r.session, r.msg)
+			packetBuffers.Put(r.buf)
+		}
+	}
+}
+
+//handleResponse processes one packet from the server of s. msg is only
+//valid until it returns.
+func (c *Client) handleResponse(s *Session, msg []byte) {
+	var res ResponsePacket
+	err := res.unmarshal(msg)
+	if err != nil {
+		if err == ErrUnsupportedVersion {
+			log.Fatal("Server uses an unsupported PCP version.")
+			os.Exit(1)
+		} else {
+			log.Error(err)
+		}
+		return
+	}
+	if c.newEAPPeer != nil {
+		if res.opCode == OpAuthentication {
+			c.handlePA(s, &res, msg)
+			return
+		}
+		if !c.verifyResponse(s, &res, msg) {
+			return
+		}
+	}
+	switch res.resultCode {
+	case ResultSuccess:
+		//Process ResponsePacket here and send events.
+		switch res.opCode {
+		case OpAnnounce:
+			log.Debug("Announce Opcode received.")
+			c.events.emit(Event{ActionReceivedAnnounce, nil, s.Addr})
+		case OpMap:
+			data, err := res.mapData()
 			if err != nil {
-				if err == ErrUnsupportedVersion {
-					log.Fatal("Server uses an unsupported PCP version.")
-					os.Exit(1)
-				} else {
-					log.Error(err)
-				}
-				continue
-			}
-			//Need to add check for resultcode here and handle errors.
-			switch res.resultCode {
-			case ResultSuccess:
-				//Process ResponsePacket here and send events.
-				switch res.opCode {
-				case OpAnnounce:
-					log.Debug("Announce Opcode received.")
-					c.Event <- Event{ActionReceivedAnnounce, nil}
-				case OpMap:
-					var data OpDataMap
-					err = data.unmarshal(res.opData)
-					if err != nil {
-						log.Errorf("Could not parse Map OpData: %s\n", err)
-						continue
-					}
-
-					rt := RefreshTime{
-						Attempt: 0,
-						Time:    getRefreshTime(0, res.lifetime),
-					}
-					m := PortMap{
-						OpDataMap: OpDataMap{
-							Protocol:     data.Protocol,
-							InternalPort: data.InternalPort,
-							ExternalPort: data.ExternalPort,
-							ExternalIP:   data.ExternalIP,
-						},
-						Active:   true,
-						Lifetime: res.lifetime,
-						Refresh:  rt,
-					}
-					c.Mappings[data.InternalPort] = m
-					c.Event <- Event{ActionReceivedMapping, m}
-				case OpPeer:
-					var data OpDataPeer
-					err = data.unmarshal(res.opData)
-					if err != nil {
-						log.Errorf("Could not parse Peer OpData: %s\n", err)
-						continue
-					}
-
-					rt := RefreshTime{
-						Attempt: 0,
-						Time:    getRefreshTime(0, res.lifetime),
-					}
-					m := PeerMap{
-						PortMap: PortMap{
-							OpDataMap: OpDataMap{
-								Protocol:     data.Protocol,
-								InternalPort: data.InternalPort,
-								ExternalPort: data.ExternalPort,
-								ExternalIP:   data.ExternalIP,
-							},
-							Active:   true,
-							Lifetime: res.lifetime,
-							Refresh:  rt,
-						},
-						RemotePort: data.RemotePort,
-						RemoteIP: data.RemoteIP,
-					}
-					c.PeerMappings[data.InternalPort] = m
-					c.Event <- Event{ActionReceivedPeer, m}
-				default:
-					log.Warnf("Unrecognised OpCode: %d", res.opCode)
-				}
-			case ResultUnsupportedVersion:
-				log.Fatal("Server uses an unsupported PCP version.")
-				os.Exit(1)
-			default:
-				log.Debugf("Non success ResultCode received. ResultCode %s", res.resultCode)
+				log.Errorf("Could not parse Map OpData: %s\n", err)
+				return
+			}
+
+			expires := c.clock.Now().Unix() + int64(res.lifetime)
+			rt := RefreshTime{
+				Attempt: 0,
+				Time:    c.getRefreshTime(0, res.lifetime, expires),
+			}
+			m := PortMap{
+				OpDataMap: OpDataMap{
+					Protocol:     data.Protocol,
+					InternalPort: data.InternalPort,
+					ExternalPort: data.ExternalPort,
+					ExternalIP:   data.ExternalIP,
+					ThirdParty:   data.ThirdParty,
+					Description:  data.Description,
+					PortSet:      data.PortSet,
+				},
+				Active:   res.lifetime > 0,
+				Lifetime: res.lifetime,
+				Expires:  expires,
+				Refresh:  rt,
+			}
+			key := mappingKey{s, OpMap, data.key()}
+			c.mu.Lock()
+			if m.Description == "" {
+				//Servers that ignore the description do not echo it
+				m.Description = c.requestedDescription(key)
+			}
+			if res.lifetime == 0 {
+				delete(s.Mappings, key.MappingKey)
+				c.sched.remove(key)
+			} else {
+				s.Mappings[key.MappingKey] = m
+				c.sched.schedule(key, nextDue(rt.Time, expires))
+			}
+			c.mu.Unlock()
+			c.stateChanged()
+			c.updateHandle(s, key, m, nil)
+			c.events.emit(Event{ActionReceivedMapping, m, s.Addr})
+		case OpPeer:
+			data, err := res.peerData()
+			if err != nil {
+				log.Errorf("Could not parse Peer OpData: %s\n", err)
+				return
 			}
 
-			t := time.Now()
-			valid := c.epochValid(t.Unix(), res.epoch)
-			if !valid {
-				log.Debug("Invalid epoch received. Refreshing mappings.")
-				c.refreshMappings()
+			expires := c.clock.Now().Unix() + int64(res.lifetime)
+			rt := RefreshTime{
+				Attempt: 0,
+				Time:    c.getRefreshTime(0, res.lifetime, expires),
+			}
+			m := PeerMap{
+				PortMap: PortMap{
+					OpDataMap: OpDataMap{
+						Protocol:     data.Protocol,
+						InternalPort: data.InternalPort,
+						ExternalPort: data.ExternalPort,
+						ExternalIP:   data.ExternalIP,
+						ThirdParty:   data.ThirdParty,
+						Description:  data.Description,
+					},
+					Active:   res.lifetime > 0,
+					Lifetime: res.lifetime,
+					Expires:  expires,
+					Refresh:  rt,
+				},
+				RemotePort: data.RemotePort,
+				RemoteIP:   data.RemoteIP,
+			}
+			key := mappingKey{s, OpPeer, data.key()}
+			c.mu.Lock()
+			if m.Description == "" {
+				m.Description = c.requestedDescription(key)
+			}
+			if res.lifetime == 0 {
+				delete(s.PeerMappings, key.MappingKey)
+				c.sched.remove(key)
 			} else {
-				log.Debugf("Epoch valid. Server Time: %d, Client Time: %d", res.epoch, t.Unix())
+				s.PeerMappings[key.MappingKey] = m
+				c.sched.schedule(key, nextDue(rt.Time, expires))
 			}
+			c.mu.Unlock()
+			c.stateChanged()
+			c.updateHandle(s, key, m.PortMap, nil)
+			c.events.emit(Event{ActionReceivedPeer, m, s.Addr})
+		default:
+			log.Warnf("Unrecognised OpCode: %d", res.opCode)
+		}
+	case ResultUnsupportedVersion:
+		log.Fatal("Server uses an unsupported PCP version.")
+		os.Exit(1)
+	default:
+		log.Debugf("Non success ResultCode received. ResultCode %s", res.resultCode)
+		if key, err := responseKey(s, &res); err == nil {
+			c.updateHandle(s, key, PortMap{}, &ResultError{res.resultCode})
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
+	c.notifyWaiters(s, &res)
+
+	t := c.clock.Now()
+	c.mu.Lock()
+	valid := c.epochValid(s.epoch, t.Unix(), res.epoch)
+	c.mu.Unlock()
+	if !valid {
+		log.Debugf("Invalid epoch received from %s. Refreshing mappings.", s.Addr)
+		c.refreshMappings(s)
+	} else {
+		log.Debugf("Epoch valid. Server Time: %d, Client Time: %d", res.epoch, t.Unix())
+	}
+}
+
+//mappingKey identifies the mapping a request or response refers to on one
+//server, so that responses can be correlated with the request waiting on them.
+type mappingKey struct {
+	session *Session
+	op      OpCode
+	MappingKey
 }
 
-func (c *Client) sendMessage(msg []byte) (err error) {
-	_, err = c.conn.Write(msg)
+type waiter struct {
+	ch       chan *ResponsePacket
+	deletion bool
+	//description is the one sent, see requestedDescription
+	description string
+}
+
+func requestKey(s *Session, op OpCode, data interface{}) (key mappingKey) {
+	switch op {
+	case OpMap:
+		key = mappingKey{s, op, data.(*OpDataMap).key()}
+	case OpPeer:
+		key = mappingKey{s, op, data.(*OpDataPeer).key()}
+		if s != nil {
+			//Held under the remote sent, see nat64Data
+			key.MappingKey = s.peerKey(key.MappingKey)
+		}
+	default:
+		key = mappingKey{session: s, op: op}
+	}
 	return
 }
 
-//Closes connection to PCP server and returns close event
-func (c *Client) Close() {
-	c.cancelled <- true
-	c.Event <- Event{
-		Action: ActionClose,
-		Data: nil,
+func responseKey(s *Session, res *ResponsePacket) (key mappingKey, err error) {
+	switch res.opCode {
+	case OpMap:
+		var data OpDataMap
+		data, err = res.mapData()
+		key = mappingKey{s, res.opCode, data.key()}
+	case OpPeer:
+		var data OpDataPeer
+		data, err = res.peerData()
+		key = mappingKey{s, res.opCode, data.key()}
+	default:
+		key = mappingKey{session: s, op: res.opCode}
+	}
+	return
+}
+
+//notifyWaiters hands the response to any request waiting for it. Deletions
+//only complete on a lifetime zero response (or an error), so a late refresh
+//response does not confirm a delete.
+func (c *Client) notifyWaiters(s *Session, res *ResponsePacket) {
+	key, err := responseKey(s, res)
+	if err != nil {
+		return
+	}
+	failed := res.resultCode != ResultSuccess
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var remaining []*waiter
+	var detached *ResponsePacket
+	for _, w := range c.waiters[key] {
+		if failed || w.deletion == (res.lifetime == 0) {
+			//res refers to the receive buffer, which is reused after this returns
+			if detached == nil {
+				detached = res.detach()
+			}
+			w.ch <- detached
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	if len(remaining) > 0 {
+		c.waiters[key] = remaining
+	} else {
+		delete(c.waiters, key)
+	}
+}
+
+func (c *Client) removeWaiter(key mappingKey, w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ws := c.waiters[key]
+	for i, x := range ws {
+		if x == w {
+			c.waiters[key] = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[key]) == 0 {
+		delete(c.waiters, key)
+	}
+}
+
+//request sends a request to the server of s and waits for the matching
+//response, retransmitting as described in 8.1.1 of RFC6887. If ctx has no
+//deadline, DefaultRequestTimeout applies.
+func (c *Client) request(ctx context.Context, s *Session, op OpCode, lifetime uint32, data interface{}) (res *ResponsePacket, err error) {
+	if data, err = c.nat64Data(ctx, s, op, data); err != nil {
+		return nil, err
+	}
+	buf := requestBuffers.Get().(*[]byte)
+	defer requestBuffers.Put(buf)
+	msg, err := c.buildRequest((*buf)[:0], s, op, lifetime, data)
+	if err != nil {
+		return nil, err
+	}
+	key := requestKey(s, op, data)
+	res, err = c.exchange(ctx, s, key, msg, lifetime == 0, c.dataDescription(data))
+	if err == nil && res.resultCode != ResultSuccess {
+		return res, &ResultError{res.resultCode}
 	}
 	return
 }
+
+//exchange sends msg until a response for key arrives, whatever its result.
+//description is the one msg carries, if any.
+func (c *Client) exchange(ctx context.Context, s *Session, key mappingKey, msg []byte, deletion bool, description string) (res *ResponsePacket, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	w := &waiter{make(chan *ResponsePacket, 1), deletion, description}
+	c.mu.Lock()
+	c.waiters[key] = append(c.waiters[key], w)
+	c.mu.Unlock()
+	defer c.removeWaiter(key, w)
+
+	rt := initialRetransmitTime
+	for {
+		err = c.sendMessage(s, msg)
+		if err == ErrNotAuthenticated {
+			return nil, err
+		}
+		if err != nil {
+			return nil, ErrNetworkSend
+		}
+		t := c.clock.NewTimer(rt)
+		select {
+		case res = <-w.ch:
+			t.Stop()
+			return res, nil
+		case <-c.done:
+			t.Stop()
+			return nil, ErrClientClosed
+		case <-ctx.Done():
+			t.Stop()
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrNetworkTimeout
+			}
+			return nil, ctx.Err()
+		case <-t.C():
+		}
+		rt *= 2
+		if rt > maxRetransmitTime {
+			rt = maxRetransmitTime
+		}
+	}
+}
+
+func (c *Client) sendMessage(s *Session, msg []byte) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	if c.newEAPPeer != nil && OpCode(msg[1]&^responseBit) != OpAuthentication {
+		return c.sendSigned(s, msg)
+	}
+	_, err = s.conn.Write(msg)
+	return
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Close shuts the client down. If release is true every mapping is deleted on
+//the server first, bounded by ctx. All goroutines are stopped and the socket
+//closed before Close returns; later calls on the client return ErrClientClosed.
+func (c *Client) Close(ctx context.Context, release bool) (err error) {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.closing = true
+	c.mu.Unlock()
+	c.closeHandles()
+
+	if release {
+		err = c.DeleteAll(ctx)
+	}
+	close(c.done)
+	//Closing the sockets unblocks any pending reads
+	for _, s := range c.sessionList() {
+		s.close()
+	}
+	c.wg.Wait()
+	if c.store != nil {
+		c.persist()
+	}
+
+	c.events.emit(Event{
+		Action: ActionClose,
+		Data:   nil,
+	})
+	c.events.close()
+	return
+}
@@ -0,0 +1,120 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	before := runtime.NumGoroutine()
+
+	c, err := dialTestClient(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = c.AddPortMapping(ProtocolTCP, 8080, 0, netip.Addr{}, 600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.OpenPortMapping(ctx, ProtocolUDP, 8081, 0, netip.Addr{}, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OnMappingChanged(func(Event) {})
+	eventually(t, "both mappings", func() bool { return len(srv.Table.Entries()) == 2 })
+
+	if err = c.Close(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if entries := srv.Table.Entries(); len(entries) != 0 {
+		t.Errorf("mappings not released: %+v", entries)
+	}
+	eventually(t, "the client's goroutines to end", func() bool { return runtime.NumGoroutine() <= before })
+
+	if err = c.Close(ctx, true); err != ErrClientClosed {
+		t.Errorf("Close: %v", err)
+	}
+	if err = c.AddPortMapping(ProtocolTCP, 8082, 0, netip.Addr{}, 600); err != ErrClientClosed {
+		t.Errorf("AddPortMapping: %v", err)
+	}
+	if _, err = c.MapPort(ctx, ProtocolTCP, 8082, 0, netip.Addr{}, 600); err != ErrClientClosed {
+		t.Errorf("MapPort: %v", err)
+	}
+	if _, err = c.OpenPortMapping(ctx, ProtocolTCP, 8082, 0, netip.Addr{}, 600); err != ErrClientClosed {
+		t.Errorf("OpenPortMapping: %v", err)
+	}
+	if err = m.Refresh(ctx); err != ErrMappingClosed && err != ErrClientClosed {
+		t.Errorf("Mapping.Refresh: %v", err)
+	}
+	if _, err = c.GetExternalAddress(); err != ErrClientClosed {
+		t.Errorf("GetExternalAddress: %v", err)
+	}
+}
+
+//requestLoad sends n MAP requests from each of workers goroutines, each
+//renewing a mapping of its own, and returns how long the responses took.
+func requestLoad(t testing.TB, c *Client, workers, n int) time.Duration {
+	s := c.sessionList()[0]
+	var failed int32
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(port uint16) {
+			defer wg.Done()
+			data := &OpDataMap{Protocol: ProtocolUDP, InternalPort: port}
+			for i := 0; i < n; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err := c.request(ctx, s, OpMap, 600, data)
+				cancel()
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}(uint16(10000 + w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if failed > 0 {
+		t.Fatalf("%d of %d requests failed", failed, workers*n)
+	}
+	return elapsed
+}
+
+//TestResponseThroughput checks that responses are handled as they arrive,
+//with 64 requests in flight to a loopback server.
+func TestResponseThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	srv := newTestServer(t, nil)
+	srv.start(t)
+	c := newTestClient(t, srv)
+	const workers, n = 64, 100
+	elapsed := requestLoad(t, c, workers, n)
+	rate := float64(workers*n) / elapsed.Seconds()
+	t.Logf("%d responses in %s, %.0f/s", workers*n, elapsed, rate)
+	if rate < 1000 {
+		t.Errorf("only %.0f responses/s", rate)
+	}
+}
+
+func BenchmarkRequestRoundTrip(b *testing.B) {
+	srv := newTestServer(b, nil)
+	srv.start(b)
+	c := newTestClient(b, srv)
+	const workers = 64
+	n := (b.N + workers - 1) / workers
+	b.ReportAllocs()
+	b.ResetTimer()
+	elapsed := requestLoad(b, c, workers, n)
+	b.ReportMetric(float64(workers*n)/elapsed.Seconds(), "responses/s")
+}
@@ -0,0 +1,106 @@
+package pcp
+
+import (
+	"math/rand"
+	"time"
+)
+
+//ClientOption configures optional behaviour when creating a Client.
+type ClientOption func(*Client)
+
+//WithClock makes the client read time and create timers through clock
+//instead of the time package. Mostly useful with a FakeClock in tests.
+func WithClock(clock Clock) ClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+//WithRandSource sets the source used to jitter refresh times. By default each
+//client gets its own source seeded from crypto/rand.
+func WithRandSource(src rand.Source) ClientOption {
+	return func(c *Client) {
+		c.rand = newLockedRand(src)
+	}
+}
+
+//WithDiscovery replaces the default server discovery, e.g. to add configured
+//servers or lease file locations. It only affects NewClient.
+func WithDiscovery(d Discovery) ClientOption {
+	return func(c *Client) {
+		c.discovery = d
+	}
+}
+
+//WithNetworkPolling makes the client poll the interfaces for network changes
+//every interval instead of listening on netlink.
+func WithNetworkPolling(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pollInterval = interval
+	}
+}
+
+//WithoutNetworkWatch stops NewClient from following network changes. The
+//client then keeps using the servers it found at start up.
+func WithoutNetworkWatch() ClientOption {
+	return func(c *Client) {
+		c.noWatch = true
+	}
+}
+
+//WithRequestRate sets how many requests per second MapMany sends to each
+//server. Retransmissions are not counted, see MapMany. Zero removes the limit.
+func WithRequestRate(perSecond float64) ClientOption {
+	return func(c *Client) {
+		c.requestRate = perSecond
+	}
+}
+
+//WithMaxInFlight sets how many MapMany requests may await a response from
+//each server at once.
+func WithMaxInFlight(n int) ClientOption {
+	return func(c *Client) {
+		if n < 1 {
+			n = 1
+		}
+		c.maxInFlight = n
+	}
+}
+
+//WithStateStore saves the client's nonce, mappings and epochs to store
+//whenever they change. Calls that make or delete mappings save before they
+//return; other changes are saved in the background. On start, mappings saved
+//by a previous run are renewed or deleted according to mode.
+func WithStateStore(store StateStore, mode RestoreMode) ClientOption {
+	return func(c *Client) {
+		c.store = store
+		c.restoreMode = mode
+	}
+}
+
+//WithAuthentication makes the client authenticate with each server as
+//described in RFC7652, and tag every request with the session key. newPeer
+//returns the client side of the EAP method for each authentication, e.g.
+//NewPSKPeer. Requests fail with ErrNotAuthenticated while a server has not
+//accepted the client.
+func WithAuthentication(newPeer func() EAPPeer) ClientOption {
+	return func(c *Client) {
+		c.newEAPPeer = newPeer
+	}
+}
+
+//WithDescription labels every mapping without a description of its own,
+//e.g. with the application name, so they can be told apart on the server
+//(RFC7220). Requests fail with ErrDescriptionTooLong or
+//ErrDescriptionUTF8 if it is not valid.
+func WithDescription(description string) ClientOption {
+	return func(c *Client) {
+		c.description = description
+	}
+}
+
+//WithRandSeed is shorthand for WithRandSource(rand.NewSource(seed)), giving
+//repeatable refresh times.
+func WithRandSeed(seed int64) ClientOption {
+	return WithRandSource(rand.NewSource(seed))
+}
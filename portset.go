@@ -0,0 +1,306 @@
+package pcp
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+//portSetSize is the length of the PORT_SET option data, see 4 of RFC7753.
+const portSetSize = 5
+
+//PortSet makes a MAP mapping cover Size consecutive ports (RFC7753). The
+//internal ports from FirstInternalPort map in order to the external ports
+//from the mapping's ExternalPort. Parity asks for the first external port
+//to be odd or even like the first internal port, as RTP needs. The zero
+//PortSet is a mapping of a single port.
+type PortSet struct {
+	Size              uint16
+	FirstInternalPort uint16
+	Parity            bool
+}
+
+//IsSet reports whether the mapping covers a port set.
+func (ps PortSet) IsSet() bool {
+	return ps.Size != 0
+}
+
+//PortCount returns how many ports the mapping covers.
+func (data OpDataMap) PortCount() int {
+	if data.PortSet.IsSet() {
+		return int(data.PortSet.Size)
+	}
+	return 1
+}
+
+func (ps PortSet) validate() error {
+	if ps.Size == 0 || ps.FirstInternalPort == 0 || int(ps.FirstInternalPort)+int(ps.Size) > 65536 {
+		return ErrPortSetRange
+	}
+	return nil
+}
+
+//appendPortSet appends the PORT_SET option, if ps is set.
+func appendPortSet(b []byte, ps PortSet) ([]byte, error) {
+	if !ps.IsSet() {
+		return b, nil
+	}
+	if err := ps.validate(); err != nil {
+		return b, err
+	}
+	data := make([]byte, portSetSize)
+	binary.BigEndian.PutUint16(data, ps.Size)
+	binary.BigEndian.PutUint16(data[2:], ps.FirstInternalPort)
+	if ps.Parity {
+		data[4] = 1
+	}
+	return appendOptions(b, []PCPOption{{OptionOpPortSet, data}}), nil
+}
+
+//readPortSet reads the PORT_SET option. In a response it holds the ports the
+//server allocated, which may be fewer than requested.
+func readPortSet(options []PCPOption) (ps PortSet, err error) {
+	for _, o := range options {
+		if o.opCode != OptionOpPortSet {
+			continue
+		}
+		if len(o.data) != portSetSize {
+			return PortSet{}, ErrMalformedOption
+		}
+		ps = PortSet{
+			Size:              binary.BigEndian.Uint16(o.data),
+			FirstInternalPort: binary.BigEndian.Uint16(o.data[2:]),
+			Parity:            o.data[4]&1 == 1,
+		}
+		if ps.validate() != nil {
+			return PortSet{}, ErrMalformedOption
+		}
+	}
+	return
+}
+
+//PortSetMapping is a handle on a port set mapped with MapPortSet. A server
+//may grant the set in several blocks, each a MAP mapping of its own keyed by
+//its first internal port; the handle owns them all. The client renews every
+//block on the servers that granted it, requesting it again if it expires,
+//until Close deletes them together.
+type PortSetMapping struct {
+	Protocol          Protocol
+	FirstInternalPort uint16
+	//Size is the number of ports asked for. Blocks tells how many were granted.
+	Size uint16
+
+	client   *Client
+	lifetime uint32
+	//blocks is ordered by internal port, and fixed once MapPortSet returns.
+	blocks []*Mapping
+
+	mu     sync.Mutex
+	closed bool
+}
+
+//Blocks returns the blocks of the set in port order, as last granted. Each
+//maps PortCount internal ports from InternalPort to as many external ports
+//from ExternalPort. A block is reported as held on the primary server, if
+//that server granted it.
+func (ps *PortSetMapping) Blocks() []PortMap {
+	blocks := make([]PortMap, len(ps.blocks))
+	for i, m := range ps.blocks {
+		m.mu.Lock()
+		blocks[i] = m.current
+		m.mu.Unlock()
+	}
+	return blocks
+}
+
+//PortCount returns how many ports the blocks cover.
+func (ps *PortSetMapping) PortCount() (n int) {
+	for _, pm := range ps.Blocks() {
+		n += pm.PortCount()
+	}
+	return
+}
+
+//Refresh renews every block now on the servers holding it, and waits for the
+//answers.
+func (ps *PortSetMapping) Refresh(ctx context.Context) error {
+	if ps.isClosed() {
+		return ErrMappingClosed
+	}
+	c := ps.client
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	return c.eachSession(func(s *Session) (err error) {
+		held := false
+		for _, m := range ps.blocks {
+			c.mu.Lock()
+			pm, exists := s.Mappings[m.key.MappingKey]
+			c.mu.Unlock()
+			if !exists {
+				continue
+			}
+			held = true
+			if _, e := c.request(ctx, s, OpMap, ps.lifetime, &pm.OpDataMap); e != nil && err == nil {
+				err = e
+			}
+		}
+		if !held {
+			return ErrMappingNotFound
+		}
+		return
+	})
+}
+
+//Close stops renewing the blocks and deletes them on the servers. Later calls
+//return ErrMappingClosed.
+func (ps *PortSetMapping) Close(ctx context.Context) (err error) {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return ErrMappingClosed
+	}
+	ps.closed = true
+	ps.mu.Unlock()
+	for _, m := range ps.blocks {
+		//A block whose handle already ended, e.g. with the client, is skipped
+		if e := m.Close(ctx); e != nil && e != ErrMappingClosed && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (ps *PortSetMapping) isClosed() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.closed
+}
+
+//addBlock takes on pm, a block granted by a server, unless the handle owns
+//it already. The block is requested again as granted if it expires.
+func (ps *PortSetMapping) addBlock(pm PortMap) {
+	for _, m := range ps.blocks {
+		if m.InternalPort == pm.InternalPort {
+			return
+		}
+	}
+	data := pm.OpDataMap
+	m := &Mapping{
+		Protocol:     ps.Protocol,
+		InternalPort: pm.InternalPort,
+		data:         &data,
+		current:      pm,
+	}
+	if ps.client.registerHandle(m, OpMap, ps.lifetime) != nil {
+		//Another handle owns the mapping; it stays with that one
+		return
+	}
+	ps.blocks = append(ps.blocks, m)
+}
+
+//MapPortSet maps size consecutive internal ports from firstInternal to
+//consecutive external ports on every server, waits for the answers and
+//returns a handle on the set. parity asks the server to keep the parity of
+//the first port.
+//
+//A server may grant fewer ports than asked; the rest are then requested
+//again, so a set can end up in several blocks. A server that does not
+//support PORT_SET maps the first port alone, and the others are then
+//requested one block at a time. err is only set when no server granted any
+//port; a server that refused the remaining ports leaves the set short, as
+//PortCount shows.
+func (c *Client) MapPortSet(ctx context.Context, protocol Protocol, firstInternal, size uint16, parity bool, lifetime uint32) (ps *PortSetMapping, err error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if err = protocol.validatePorts(firstInternal); err != nil {
+		return
+	}
+	if !protocol.HasPorts() {
+		return nil, ErrPortNotAllowed
+	}
+	set := PortSet{Size: size, FirstInternalPort: firstInternal, Parity: parity}
+	if err = set.validate(); err != nil {
+		return
+	}
+	lifetime = clampLifetime(lifetime)
+	first := requestKey(nil, OpMap, &OpDataMap{Protocol: protocol, InternalPort: firstInternal})
+	c.mu.Lock()
+	_, inUse := c.handles[first]
+	c.mu.Unlock()
+	if inUse {
+		return nil, ErrMappingInUse
+	}
+
+	sessions := c.sessionList()
+	granted := make([][]PortMap, len(sessions))
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			granted[i], errs[i] = c.mapPortSet(ctx, s, protocol, set, lifetime)
+		}(i, s)
+	}
+	wg.Wait()
+	ps = &PortSetMapping{
+		Protocol:          protocol,
+		FirstInternalPort: firstInternal,
+		Size:              size,
+		client:            c,
+		lifetime:          lifetime,
+	}
+	//The primary server comes first, so the blocks report its view
+	for i := range sessions {
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+		for _, pm := range granted[i] {
+			ps.addBlock(pm)
+		}
+	}
+	if len(ps.blocks) == 0 {
+		if err == nil {
+			err = ErrServerNotFound
+		}
+		return nil, err
+	}
+	sort.Slice(ps.blocks, func(i, j int) bool { return ps.blocks[i].InternalPort < ps.blocks[j].InternalPort })
+	return ps, nil
+}
+
+//mapPortSet requests want on s until every port is mapped or the server
+//refuses the rest, and returns the blocks granted. err tells why the set is
+//short, if it is.
+func (c *Client) mapPortSet(ctx context.Context, s *Session, protocol Protocol, want PortSet, lifetime uint32) (blocks []PortMap, err error) {
+	for {
+		data := &OpDataMap{
+			Protocol:     protocol,
+			InternalPort: want.FirstInternalPort,
+			PortSet:      want,
+		}
+		if _, err = c.request(ctx, s, OpMap, lifetime, data); err != nil {
+			return
+		}
+		c.mu.Lock()
+		pm := s.Mappings[data.key()]
+		c.mu.Unlock()
+		blocks = append(blocks, pm)
+
+		//A partial allocation keeps the first port and shrinks the size; the
+		//rest is requested as a new block
+		n := uint16(pm.PortCount())
+		got := pm.PortSet
+		if got.IsSet() && got.FirstInternalPort != want.FirstInternalPort || n > want.Size {
+			return blocks, ErrMalformedResponse
+		}
+		if n == want.Size {
+			return
+		}
+		want.FirstInternalPort += n
+		want.Size -= n
+	}
+}
@@ -0,0 +1,102 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMapPortSet(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newTestServer(t, clock)
+	srv.Table.MinPort, srv.Table.MaxPort = 40000, 40019
+	srv.start(t)
+	c := newTestClient(t, srv, WithClock(clock))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	//Taking 40001 and 40006 leaves runs of 1, 4 and 13 free ports
+	for _, port := range []uint16{40001, 40006} {
+		if _, err := c.MapPort(ctx, ProtocolUDP, port-31000, port, netip.Addr{}, 600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	even, err := c.MapPortSet(ctx, ProtocolUDP, 5000, 8, true, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := even.Blocks(); len(blocks) != 1 || blocks[0].PortCount() != 8 || blocks[0].ExternalPort%2 != 0 {
+		t.Fatalf("want one even block of 8, got %+v", blocks)
+	}
+	if _, err = c.MapPortSet(ctx, ProtocolUDP, 5000, 2, false, 600); err != ErrMappingInUse {
+		t.Fatalf("second handle on the set: %v", err)
+	}
+
+	//The 10 ports left are scattered, so they are granted in several blocks
+	ps, err := c.MapPortSet(ctx, ProtocolUDP, 6000, 10, false, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := ps.Blocks()
+	if len(blocks) < 2 || ps.PortCount() != 10 {
+		t.Fatalf("want 10 ports in several blocks, got %+v", blocks)
+	}
+	next := uint16(6000)
+	for _, b := range blocks {
+		if b.InternalPort != next || b.Lifetime != 300 {
+			t.Errorf("block %+v, want internal port %d and lifetime 300", b.OpDataMap, next)
+		}
+		next += uint16(b.PortCount())
+	}
+	expires := func() (at []int64) {
+		for _, e := range srv.Table.Entries() {
+			if e.InternalPort >= 6000 && e.InternalPort < 6010 {
+				at = append(at, e.Expires)
+			}
+		}
+		return
+	}
+	for _, at := range expires() {
+		if at != clock.Now().Unix()+300 {
+			t.Errorf("block expires at %d", at)
+		}
+	}
+
+	clock.Advance(100 * time.Second)
+	if err = ps.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	at := expires()
+	if len(at) != len(blocks) {
+		t.Fatalf("%d blocks on the server", len(at))
+	}
+	for _, at := range at {
+		if at != clock.Now().Unix()+300 {
+			t.Errorf("after refresh a block expires at %d", at)
+		}
+	}
+
+	if err = ps.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if at := expires(); len(at) != 0 {
+		t.Errorf("%d blocks left after close", len(at))
+	}
+	if err = ps.Close(ctx); err != ErrMappingClosed {
+		t.Errorf("second close: %v", err)
+	}
+	if err = ps.Refresh(ctx); err != ErrMappingClosed {
+		t.Errorf("refresh after close: %v", err)
+	}
+	c.mu.Lock()
+	handles := len(c.handles)
+	c.mu.Unlock()
+	if handles != 1 {
+		t.Errorf("%d handles open, want only the first set's", handles)
+	}
+	//The freed ports can be mapped again
+	if ps, err = c.MapPortSet(ctx, ProtocolUDP, 7000, 10, false, 600); err != nil || ps.PortCount() != 10 {
+		t.Fatalf("mapping the freed ports: %v", err)
+	}
+}
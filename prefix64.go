@@ -0,0 +1,319 @@
+package pcp
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+const (
+	//prefix64Retry is how long a failure to learn the NAT64 prefixes is
+	//returned before the server is asked again. It doubles with each failure
+	//up to maxPrefix64Retry.
+	prefix64Retry    = 30 * time.Second
+	maxPrefix64Retry = 30 * time.Minute
+)
+
+//WellKnownPrefix64 is the NAT64 prefix reserved by RFC6052.
+var WellKnownPrefix64 = netip.MustParsePrefix("64:ff9b::/96")
+
+//Prefix64 is a NAT64 prefix learned from a PCP server (RFC7225). IPv4
+//addresses are reached through it as IPv4-embedded IPv6 addresses (RFC6052).
+type Prefix64 struct {
+	Prefix netip.Prefix
+	//Suffix fills the bytes after the prefix that do not hold the IPv4
+	//address, including the u-octet. It is usually all zeros.
+	Suffix []byte
+	//IPv4Prefixes restricts the prefix to these IPv4 destinations. It is
+	//empty if the prefix serves every IPv4 address.
+	IPv4Prefixes []netip.Prefix
+}
+
+//Covers reports whether addr is reached through the prefix.
+func (p Prefix64) Covers(addr netip.Addr) bool {
+	if len(p.IPv4Prefixes) == 0 {
+		return true
+	}
+	for _, v4 := range p.IPv4Prefixes {
+		if v4.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+//Synthesize returns the IPv4-embedded IPv6 address for addr.
+func (p Prefix64) Synthesize(addr netip.Addr) (netip.Addr, error) {
+	return synthesize(p.Prefix, p.Suffix, addr)
+}
+
+//Extract returns the IPv4 address embedded in addr.
+func (p Prefix64) Extract(addr netip.Addr) (netip.Addr, error) {
+	return ExtractIPv4(p.Prefix, addr)
+}
+
+//SynthesizeIPv6 embeds the IPv4 address addr in prefix as described in 2.2
+//of RFC6052. The prefix must be 32, 40, 48, 56, 64 or 96 bits long.
+func SynthesizeIPv6(prefix netip.Prefix, addr netip.Addr) (netip.Addr, error) {
+	return synthesize(prefix, nil, addr)
+}
+
+//ExtractIPv4 returns the IPv4 address embedded in addr by SynthesizeIPv6.
+func ExtractIPv4(prefix netip.Prefix, addr netip.Addr) (netip.Addr, error) {
+	positions, err := v4Positions(prefix)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !addr.Is6() || addr.Is4In6() || !prefix.Contains(addr) {
+		return netip.Addr{}, ErrAddressFamily
+	}
+	b := addr.As16()
+	var v4 [4]byte
+	for i, pos := range positions {
+		v4[i] = b[pos]
+	}
+	return netip.AddrFrom4(v4), nil
+}
+
+func synthesize(prefix netip.Prefix, suffix []byte, addr netip.Addr) (netip.Addr, error) {
+	positions, err := v4Positions(prefix)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return netip.Addr{}, ErrAddressFamily
+	}
+	b := prefix.Masked().Addr().As16()
+	v4 := addr.As4()
+	next := 0
+	for pos := prefix.Bits() / 8; pos < 16; pos++ {
+		if i := indexOf(positions, pos); i >= 0 {
+			b[pos] = v4[i]
+		} else if next < len(suffix) {
+			b[pos] = suffix[next]
+			next++
+		}
+	}
+	return netip.AddrFrom16(b), nil
+}
+
+//v4Positions returns where the four bytes of the IPv4 address go after
+//prefix. Bits 64 to 71, the u-octet, are skipped, see 2.2 of RFC6052.
+func v4Positions(prefix netip.Prefix) (positions [4]int, err error) {
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return positions, ErrPrefix64Length
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return positions, ErrPrefix64Length
+	}
+	start := prefix.Bits() / 8
+	for i := range positions {
+		positions[i] = start + i
+		if start <= 8 && positions[i] >= 8 {
+			positions[i]++
+		}
+	}
+	return
+}
+
+func indexOf(positions [4]int, pos int) int {
+	for i, p := range positions {
+		if p == pos {
+			return i
+		}
+	}
+	return -1
+}
+
+//readPrefix64s reads the PREFIX64 options, one per prefix, see 4 of RFC7225.
+//Each holds the prefix length in bytes and the prefix, the suffix that
+//completes it to 12 bytes, and a count of IPv4 prefixes, each a length byte
+//and an IPv4 address.
+func readPrefix64s(options []PCPOption) (prefixes []Prefix64, err error) {
+	for _, o := range options {
+		if o.opCode != OptionOpPrefix64 {
+			continue
+		}
+		b := o.data
+		if len(b) < 2 {
+			return nil, ErrMalformedOption
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if n > 12 || len(b) < 2+12 {
+			return nil, ErrMalformedOption
+		}
+		var raw [16]byte
+		copy(raw[:], b[2:2+n])
+		p := Prefix64{
+			Prefix: netip.PrefixFrom(netip.AddrFrom16(raw), n*8),
+			Suffix: append([]byte(nil), b[2+n:2+12]...),
+		}
+		if _, err = v4Positions(p.Prefix); err != nil {
+			return nil, ErrMalformedOption
+		}
+		b = b[2+12:]
+		if len(b) > 0 {
+			if len(b) < 2 {
+				return nil, ErrMalformedOption
+			}
+			count := int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+			if len(b) != count*5 {
+				return nil, ErrMalformedOption
+			}
+			for ; len(b) > 0; b = b[5:] {
+				addr, _ := netip.AddrFromSlice(b[1:5])
+				v4, err := addr.Prefix(int(b[0]))
+				if err != nil {
+					return nil, ErrMalformedOption
+				}
+				p.IPv4Prefixes = append(p.IPv4Prefixes, v4)
+			}
+		}
+		prefixes = append(prefixes, p)
+	}
+	return
+}
+
+//Prefix64 asks the primary server for its NAT64 prefixes, with an ANNOUNCE
+//request carrying an empty PREFIX64 option. It returns ErrNoPrefix64 if the
+//server has none.
+func (c *Client) Prefix64(ctx context.Context) (prefixes []Prefix64, err error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	sessions := c.sessionList()
+	if len(sessions) == 0 {
+		return nil, ErrServerNotFound
+	}
+	return c.learnPrefix64(ctx, sessions[0])
+}
+
+//learnPrefix64 asks the server of s for its NAT64 prefixes and keeps them on
+//the session. A failure is kept too, with a backoff, see nat64Data.
+func (c *Client) learnPrefix64(ctx context.Context, s *Session) (prefixes []Prefix64, err error) {
+	if prefixes, err = c.askPrefix64(ctx, s); err != nil {
+		s.mu.Lock()
+		s.prefix64Wait *= 2
+		if s.prefix64Wait < prefix64Retry {
+			s.prefix64Wait = prefix64Retry
+		} else if s.prefix64Wait > maxPrefix64Retry {
+			s.prefix64Wait = maxPrefix64Retry
+		}
+		s.prefix64Err, s.prefix64Retry = err, c.clock.Now().Add(s.prefix64Wait)
+		s.mu.Unlock()
+		return nil, err
+	}
+	//Having none is kept too, so the server is not asked for every peer
+	s.mu.Lock()
+	s.prefix64 = append([]Prefix64{}, prefixes...)
+	s.prefix64Err, s.prefix64Wait = nil, 0
+	s.mu.Unlock()
+	if len(prefixes) == 0 {
+		return nil, ErrNoPrefix64
+	}
+	return prefixes, nil
+}
+
+//askPrefix64 sends an ANNOUNCE request with an empty PREFIX64 option to the
+//server of s.
+func (c *Client) askPrefix64(ctx context.Context, s *Session) (prefixes []Prefix64, err error) {
+	addr, err := s.internalAddress()
+	if err != nil {
+		return nil, ErrNoInternalAddress
+	}
+	msg := appendRequestHeader(nil, OpAnnounce, 0, addr)
+	msg = appendOptions(msg, []PCPOption{{OptionOpPrefix64, nil}})
+	//ANNOUNCE responses have lifetime zero, so wait as for a deletion
+	res, err := c.exchange(ctx, s, mappingKey{session: s, op: OpAnnounce}, msg, true, "")
+	if err != nil {
+		return nil, err
+	}
+	if res.resultCode != ResultSuccess {
+		return nil, &ResultError{res.resultCode}
+	}
+	return readPrefix64s(res.pcpOptions)
+}
+
+//nat64 returns the address s reaches the IPv4 address remote through, from
+//the prefixes learned from its server. Sessions over IPv4 use remote as is.
+func (s *Session) nat64(remote netip.Addr) (netip.Addr, error) {
+	if !remote.Is4() || !s.internal.Is6() {
+		return remote, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.prefix64 {
+		if p.Covers(remote) {
+			return p.Synthesize(remote)
+		}
+	}
+	return remote, ErrNoPrefix64
+}
+
+//nat64Data returns the request to send on s for data. On an IPv6-only
+//network the IPv4 remote of a PEER request is only reachable through NAT64,
+//so it is replaced by its IPv4-embedded IPv6 address, learning the prefix
+//from the server first if need be. After a failure to learn it, requests
+//fail straight away with the same error until the backoff is over.
+func (c *Client) nat64Data(ctx context.Context, s *Session, op OpCode, data interface{}) (interface{}, error) {
+	if op != OpPeer {
+		return data, nil
+	}
+	d := data.(*OpDataPeer)
+	if !d.RemoteIP.Is4() || !s.internal.Is6() {
+		return data, nil
+	}
+	s.mu.Lock()
+	learned, err, retry := s.prefix64 != nil, s.prefix64Err, s.prefix64Retry
+	s.mu.Unlock()
+	if !learned {
+		if err != nil && c.clock.Now().Before(retry) {
+			return nil, err
+		}
+		if _, err = c.learnPrefix64(ctx, s); err != nil && err != ErrNoPrefix64 {
+			return nil, err
+		}
+	}
+	remote, err := s.nat64(d.RemoteIP)
+	if err != nil {
+		return nil, err
+	}
+	translated := *d
+	translated.RemoteIP = remote
+	return &translated, nil
+}
+
+//peerKey returns the key s holds the peer mapping key under: an IPv4 remote
+//is replaced by its NAT64 address on an IPv6-only network.
+func (s *Session) peerKey(key MappingKey) MappingKey {
+	if remote, err := s.nat64(key.Remote.Addr()); err == nil {
+		key.Remote = netip.AddrPortFrom(remote, key.Remote.Port())
+	}
+	return key
+}
+
+//ipv4Key is the reverse of peerKey: a remote in one of the NAT64 prefixes of
+//s is replaced by the IPv4 address embedded in it.
+func (s *Session) ipv4Key(key MappingKey) (MappingKey, bool) {
+	remote := key.Remote.Addr()
+	if !remote.Is6() || remote.Is4In6() {
+		return key, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.prefix64 {
+		if !p.Prefix.Contains(remote) {
+			continue
+		}
+		if v4, err := p.Extract(remote); err == nil && p.Covers(v4) {
+			key.Remote = netip.AddrPortFrom(v4, key.Remote.Port())
+			return key, true
+		}
+	}
+	return key, false
+}
@@ -0,0 +1,136 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+//nat64Client returns a client of srv that takes itself to be on an
+//IPv6-only network.
+func nat64Client(t *testing.T, srv *testServer, opts ...ClientOption) *Client {
+	c := newTestClient(t, srv, opts...)
+	c.sessionList()[0].internal = netip.MustParseAddr("2001:db8::2")
+	return c
+}
+
+//tableRemotes returns the remote of every PEER mapping srv holds.
+func tableRemotes(srv *testServer) map[netip.AddrPort]bool {
+	remotes := make(map[netip.AddrPort]bool)
+	for _, e := range srv.Table.Entries() {
+		if e.Remote.IsValid() {
+			remotes[e.Remote] = true
+		}
+	}
+	return remotes
+}
+
+func TestNAT64PeerPaths(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.NAT64 = netip.MustParsePrefix("64:ff9b::/96")
+	srv.start(t)
+	c := nat64Client(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	handled := netip.MustParseAddrPort("198.51.100.1:4000")
+	m, err := c.OpenPeerMapping(ctx, ProtocolUDP, 7000, 0, netip.Addr{}, handled, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.ExternalAddr().IsValid() {
+		t.Errorf("OpenPeerMapping granted %s", m.ExternalAddr())
+	}
+	<-m.Updates()
+	if err = m.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.Updates():
+	case <-ctx.Done():
+		t.Fatal("renewal did not reach the handle")
+	}
+
+	batched := netip.MustParseAddrPort("198.51.100.2:4000")
+	results, err := c.MapMany(ctx, []MappingRequest{{Protocol: ProtocolUDP, InternalPort: 7001, Remote: batched, Lifetime: 600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || !results[0].Servers[0].Mapping.Active {
+		t.Errorf("MapMany: %+v", results[0])
+	}
+
+	punched := netip.MustParseAddrPort("198.51.100.3:4000")
+	p, err := c.HolePunch(ctx, ProtocolUDP, 7002, punched, 600, func(ctx context.Context, local netip.AddrPort) (netip.AddrPort, error) {
+		return punched, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remotes := tableRemotes(srv)
+	for _, remote := range []netip.AddrPort{handled, batched, punched} {
+		want, _ := SynthesizeIPv6(srv.NAT64, remote.Addr())
+		if !remotes[netip.AddrPortFrom(want, remote.Port())] {
+			t.Errorf("%s not sent as %s: server holds %v", remote, want, remotes)
+		}
+	}
+
+	if err = m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeletePeerMapping(ctx, ProtocolUDP, 7001, batched); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if remotes = tableRemotes(srv); len(remotes) != 0 {
+		t.Errorf("server still holds %v", remotes)
+	}
+	if mappings := sessionPeerMappings(c); len(mappings) != 0 {
+		t.Errorf("client still holds %+v", mappings)
+	}
+}
+
+//TestNAT64Backoff checks that a failure to learn the NAT64 prefix is
+//returned without asking the server again until the backoff is over.
+func TestNAT64Backoff(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newTestServer(t, clock)
+	srv.start(t)
+	c := nat64Client(t, srv, WithClock(clock))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	remote := netip.MustParseAddrPort("198.51.100.1:4000")
+
+	_, err := c.OpenPeerMapping(ctx, ProtocolUDP, 7000, 0, netip.Addr{}, remote, 600)
+	if _, ok := err.(*ResultError); !ok {
+		t.Fatalf("first attempt: %v", err)
+	}
+	asked := srv.requestCount()
+	_, err2 := c.OpenPeerMapping(ctx, ProtocolUDP, 7000, 0, netip.Addr{}, remote, 600)
+	if err2 == nil || err2.Error() != err.Error() {
+		t.Errorf("second attempt: %v", err2)
+	}
+	results, _ := c.MapMany(ctx, []MappingRequest{{Protocol: ProtocolUDP, InternalPort: 7001, Remote: remote, Lifetime: 600}})
+	if results[0].Err == nil {
+		t.Error("MapMany succeeded")
+	}
+	if n := srv.requestCount(); n != asked {
+		t.Errorf("server asked %d more times during the backoff", n-asked)
+	}
+
+	clock.Advance(prefix64Retry)
+	c.OpenPeerMapping(ctx, ProtocolUDP, 7000, 0, netip.Addr{}, remote, 600)
+	if n := srv.requestCount(); n != asked+1 {
+		t.Errorf("server asked %d times after the backoff", n-asked)
+	}
+	//The second failure backs off for longer
+	clock.Advance(prefix64Retry)
+	c.OpenPeerMapping(ctx, ProtocolUDP, 7000, 0, netip.Addr{}, remote, 600)
+	if n := srv.requestCount(); n != asked+1 {
+		t.Errorf("server asked %d times before the longer backoff ended", n-asked)
+	}
+}
@@ -0,0 +1,103 @@
+package pcp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//go:generate go run gen_protocols.go
+
+//Protocol is an upper-layer protocol number from the IANA Assigned Internet
+//Protocol Numbers registry. In PCP, zero (ProtocolAll) means all protocols.
+type Protocol uint8
+
+//Common alternative names for registry entries.
+const (
+	ProtocolICMPv6 = ProtocolIPv6ICMP
+	ProtocolIPinIP = ProtocolIPIP
+)
+
+//protocolAliases maps lower case alternative spellings accepted by ParseProtocol.
+var protocolAliases = map[string]Protocol{
+	"icmpv6":   ProtocolIPv6ICMP,
+	"icmp6":    ProtocolIPv6ICMP,
+	"udp-lite": ProtocolUDPLite,
+	"ipip":     ProtocolIPIP,
+	"isis":     ProtocolISIS,
+	"mobility": ProtocolMobilityHeader,
+	"*":        ProtocolAll,
+}
+
+//String returns the constant name, e.g. "ProtocolSCTP". Numbers without an
+//assignment are formatted as "Protocol(146)".
+func (p Protocol) String() string {
+	if name := protocolNames[p]; name != "" {
+		return "Protocol" + name
+	}
+	return "Protocol(" + strconv.Itoa(int(p)) + ")"
+}
+
+//Keyword returns the IANA keyword for the protocol, e.g. "SCTP" or "IPv6-ICMP".
+//It is empty for unassigned numbers.
+func (p Protocol) Keyword() string {
+	return protocolKeywords[p]
+}
+
+//Known reports whether the number is assigned in the registry. Reserved (255) is not.
+func (p Protocol) Known() bool {
+	return protocolNames[p] != "" && p != ProtocolReserved
+}
+
+//HasPorts reports whether the protocol carries 16-bit port numbers, and so
+//whether port fields in MAP and PEER requests are meaningful.
+func (p Protocol) HasPorts() bool {
+	switch p {
+	case ProtocolTCP, ProtocolUDP, ProtocolSCTP, ProtocolDCCP, ProtocolUDPLite:
+		return true
+	}
+	return false
+}
+
+//ParseProtocol parses a protocol from its IANA keyword ("sctp", "ipv6-icmp"),
+//constant name ("ProtocolSCTP"), a common alias ("icmpv6", "udp-lite") or its
+//decimal number. Matching is case insensitive.
+func ParseProtocol(s string) (Protocol, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil {
+		return Protocol(n), nil
+	}
+	lower := strings.ToLower(s)
+	if p, exists := protocolAliases[lower]; exists {
+		return p, nil
+	}
+	trimmed := strings.TrimPrefix(lower, "protocol")
+	for i := range protocolNames {
+		if protocolNames[i] == "" {
+			continue
+		}
+		if strings.ToLower(protocolKeywords[i]) == lower || strings.ToLower(protocolNames[i]) == trimmed {
+			return Protocol(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownProtocol, s)
+}
+
+//validatePorts applies the port rules from 11.1 and 12.1 of RFC6887. All
+//protocols, and protocols without ports, must leave every port as zero. For
+//other protocols an internal port of zero means all ports: with a lifetime
+//it maps every port, and with lifetime zero it deletes the mappings of every
+//port (11.3 of RFC6887).
+func (p Protocol) validatePorts(ports ...uint16) error {
+	if !p.Known() {
+		return ErrUnknownProtocol
+	}
+	if p == ProtocolAll || !p.HasPorts() {
+		for _, port := range ports {
+			if port != 0 {
+				return ErrPortNotAllowed
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package pcp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseProtocol(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want Protocol
+	}{
+		{"tcp", ProtocolTCP},
+		{" UDP ", ProtocolUDP},
+		{"SCTP", ProtocolSCTP},
+		{"ipv6-icmp", ProtocolIPv6ICMP},
+		{"icmpv6", ProtocolIPv6ICMP},
+		{"udp-lite", ProtocolUDPLite},
+		{"UDPLite", ProtocolUDPLite},
+		{"ProtocolDCCP", ProtocolDCCP},
+		{"protocoldccp", ProtocolDCCP},
+		{"*", ProtocolAll},
+		{"0", ProtocolAll},
+		{"132", ProtocolSCTP},
+		{"200", Protocol(200)},
+	} {
+		got, err := ParseProtocol(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("ParseProtocol(%q) = %v, %v, want %v", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{"", "tcpp", "256", "-1", "Protocol"} {
+		if p, err := ParseProtocol(in); !errors.Is(err, ErrUnknownProtocol) {
+			t.Errorf("ParseProtocol(%q) = %v, %v", in, p, err)
+		}
+	}
+}
+
+func TestProtocolString(t *testing.T) {
+	for p, want := range map[Protocol]string{
+		ProtocolAll:      "ProtocolAll",
+		ProtocolTCP:      "ProtocolTCP",
+		ProtocolIPv6ICMP: "ProtocolIPv6ICMP",
+		Protocol(200):    "Protocol(200)",
+	} {
+		if got := p.String(); got != want {
+			t.Errorf("%d: %q, want %q", uint8(p), got, want)
+		}
+		if parsed, err := ParseProtocol(p.String()); p.Known() && (err != nil || parsed != p) {
+			t.Errorf("ParseProtocol(%q) = %v, %v", p.String(), parsed, err)
+		}
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	for _, c := range []struct {
+		protocol Protocol
+		ports    []uint16
+		err      error
+	}{
+		{ProtocolTCP, []uint16{8080, 0}, nil},
+		{ProtocolUDP, []uint16{5000, 0, 6000}, nil},
+		//All ports, 11.1 of RFC6887
+		{ProtocolTCP, []uint16{0, 0}, nil},
+		{ProtocolSCTP, []uint16{0}, nil},
+		{ProtocolDCCP, []uint16{0, 0, 0}, nil},
+		{ProtocolAll, []uint16{0, 0}, nil},
+		{ProtocolAll, []uint16{8080, 0}, ErrPortNotAllowed},
+		{ProtocolICMP, []uint16{0, 0, 0}, nil},
+		{ProtocolICMP, []uint16{0, 7}, ErrPortNotAllowed},
+		{ProtocolICMP, []uint16{0, 0, 53}, ErrPortNotAllowed},
+		{Protocol(200), []uint16{0}, ErrUnknownProtocol},
+		{ProtocolReserved, nil, ErrUnknownProtocol},
+	} {
+		if err := c.protocol.validatePorts(c.ports...); err != c.err {
+			t.Errorf("%s %v: %v, want %v", c.protocol, c.ports, err, c.err)
+		}
+	}
+}
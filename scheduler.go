@@ -0,0 +1,114 @@
+package pcp
+
+import (
+	"container/heap"
+	"sync"
+)
+
+//scheduleEntry is a mapping waiting for its next refresh or expiry, at Unix time at.
+type scheduleEntry struct {
+	key   mappingKey
+	at    int64
+	index int
+}
+
+//refreshQueue is a min-heap of entries ordered by the time they are due.
+type refreshQueue []*scheduleEntry
+
+func (q refreshQueue) Len() int           { return len(q) }
+func (q refreshQueue) Less(i, j int) bool { return q[i].at < q[j].at }
+
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*q = old[:n-1]
+	return e
+}
+
+//scheduler tracks when each mapping next needs attention. The client's
+//refresh goroutine sleeps until the earliest entry is due, and is woken
+//through wake whenever an earlier entry is added.
+type scheduler struct {
+	mu      sync.Mutex
+	queue   refreshQueue
+	entries map[mappingKey]*scheduleEntry
+	wake    chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		entries: make(map[mappingKey]*scheduleEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+//schedule sets (or moves) the time at which key is next due.
+func (s *scheduler) schedule(key mappingKey, at int64) {
+	s.mu.Lock()
+	if e, exists := s.entries[key]; exists {
+		e.at = at
+		heap.Fix(&s.queue, e.index)
+	} else {
+		e = &scheduleEntry{key: key, at: at}
+		heap.Push(&s.queue, e)
+		s.entries[key] = e
+	}
+	first := s.queue[0].key == key
+	s.mu.Unlock()
+	if first {
+		s.notify()
+	}
+}
+
+func (s *scheduler) remove(key mappingKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, exists := s.entries[key]; exists {
+		heap.Remove(&s.queue, e.index)
+		delete(s.entries, key)
+	}
+}
+
+//next returns the time the earliest entry is due, and false if nothing is scheduled.
+func (s *scheduler) next() (at int64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return 0, false
+	}
+	return s.queue[0].at, true
+}
+
+//due removes and returns every entry due at or before now.
+func (s *scheduler) due(now int64) (keys []mappingKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 && s.queue[0].at <= now {
+		e := heap.Pop(&s.queue).(*scheduleEntry)
+		delete(s.entries, e.key)
+		keys = append(keys, e.key)
+	}
+	return
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
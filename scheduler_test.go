@@ -0,0 +1,189 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler()
+	key := func(port uint16) mappingKey {
+		return mappingKey{op: OpMap, MappingKey: MappingKey{Protocol: ProtocolTCP, InternalPort: port}}
+	}
+	s.schedule(key(1), 300)
+	s.schedule(key(2), 100)
+	s.schedule(key(3), 200)
+	s.schedule(key(4), 50)
+	//Moving an entry and removing another keep the heap in order
+	s.schedule(key(2), 400)
+	s.remove(key(4))
+	s.remove(key(5))
+	if at, ok := s.next(); !ok || at != 200 {
+		t.Errorf("next: %d %v", at, ok)
+	}
+	if keys := s.due(199); len(keys) != 0 {
+		t.Errorf("due before anything: %v", keys)
+	}
+	keys := s.due(300)
+	if len(keys) != 2 || keys[0] != key(3) || keys[1] != key(1) {
+		t.Errorf("due at 300: %v", keys)
+	}
+	if keys = s.due(1000); len(keys) != 1 || keys[0] != key(2) {
+		t.Errorf("due at 1000: %v", keys)
+	}
+	if _, ok := s.next(); ok || len(s.entries) != 0 {
+		t.Errorf("left %v", s.entries)
+	}
+
+	//Only a new earliest entry wakes the refresh goroutine
+	s.schedule(key(1), 100)
+	<-s.wake
+	s.schedule(key(2), 200)
+	select {
+	case <-s.wake:
+		t.Error("woken for a later entry")
+	default:
+	}
+}
+
+//scheduledMapping maps a port with a lifetime of 600 seconds on a client
+//driven by a FakeClock, and returns the mapping as first granted.
+func scheduledMapping(t *testing.T) (*testServer, *Client, *FakeClock, *Mapping) {
+	clock := NewFakeClock(time.Unix(1000000, 0))
+	srv := newTestServer(t, clock)
+	srv.start(t)
+	c := newTestClient(t, srv, WithClock(clock), WithRandSeed(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := c.OpenPortMapping(ctx, ProtocolTCP, 8080, 0, netip.Addr{}, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-m.Updates()
+	return srv, c, clock, m
+}
+
+func clientMapping(c *Client) PortMap {
+	return c.GetMappings()[MappingKey{Protocol: ProtocolTCP, InternalPort: 8080}]
+}
+
+//advanceTo moves clock to the Unix time at.
+func advanceTo(clock *FakeClock, at int64) {
+	clock.Set(time.Unix(at, 0))
+}
+
+//checkQuiet fails if srv receives a request within a short while.
+func checkQuiet(t *testing.T, srv *testServer, requests int, when string) {
+	t.Helper()
+	time.Sleep(20 * time.Millisecond)
+	if n := srv.requestCount(); n != requests {
+		t.Fatalf("%d requests sent %s", n-requests, when)
+	}
+}
+
+//TestRefreshAtHalfLifetime checks that a mapping is renewed between 1/2 and
+//5/8 of its lifetime, and that the renewal is scheduled again from the
+//response.
+func TestRefreshAtHalfLifetime(t *testing.T) {
+	srv, c, clock, m := scheduledMapping(t)
+	granted := clock.Now().Unix()
+	pm := clientMapping(c)
+	if pm.Expires != granted+600 || pm.Refresh.Attempt != 0 || pm.Refresh.Time < granted+300 || pm.Refresh.Time > granted+375 {
+		t.Fatalf("granted %+v at %d", pm, granted)
+	}
+	requests := srv.requestCount()
+	advanceTo(clock, pm.Refresh.Time-1)
+	checkQuiet(t, srv, requests, "before the refresh time")
+	advanceTo(clock, pm.Refresh.Time)
+	eventually(t, "the renewal", func() bool { return srv.requestCount() == requests+1 })
+	select {
+	case renewed := <-m.Updates():
+		if renewed.Expires != pm.Refresh.Time+600 || renewed.Refresh.Attempt != 0 {
+			t.Errorf("renewed %+v", renewed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response to the renewal")
+	}
+}
+
+//TestRefreshBackoff checks the renewal attempts of 11.2.1 of RFC6887 while
+//the server does not answer: attempt n is sent between 1-1/2^(n+1) and
+//1-1/2^(n+1)+1/2^(n+3) of the lifetime.
+func TestRefreshBackoff(t *testing.T) {
+	srv, c, clock, _ := scheduledMapping(t)
+	srv.setMute(true)
+	granted := clientMapping(c).Expires - 600
+	for attempt := 0; attempt < 4; attempt++ {
+		pm := clientMapping(c)
+		min := granted + 600 - 600>>uint(attempt+1)
+		max := min + 600>>uint(attempt+3)
+		if pm.Refresh.Attempt != attempt || pm.Refresh.Time < min || pm.Refresh.Time > max {
+			t.Fatalf("attempt %d due at %d, want %d to %d", pm.Refresh.Attempt, pm.Refresh.Time-granted, min-granted, max-granted)
+		}
+		requests := srv.requestCount()
+		advanceTo(clock, pm.Refresh.Time-1)
+		checkQuiet(t, srv, requests, "before the attempt")
+		advanceTo(clock, pm.Refresh.Time)
+		eventually(t, "the attempt", func() bool {
+			return srv.requestCount() == requests+1 && clientMapping(c).Refresh.Attempt == attempt+1
+		})
+	}
+}
+
+//TestExpiry checks that a mapping the server stops answering for expires at
+//its lifetime, with an event and ErrMappingExpired on its handle.
+func TestExpiry(t *testing.T) {
+	srv, c, clock, m := scheduledMapping(t)
+	events := c.Subscribe(64, OverflowDropNewest, 0)
+	defer events.Close()
+	srv.setMute(true)
+	expires := clientMapping(c).Expires
+
+	advanceTo(clock, expires-1)
+	eventually(t, "the last attempts", func() bool { return clientMapping(c).Refresh.Time >= expires })
+	if !clientMapping(c).Active {
+		t.Fatal("expired early")
+	}
+	advanceTo(clock, expires)
+	eventually(t, "the expiry", func() bool { return m.Err() == ErrMappingExpired })
+	//The handle asks for the mapping again, which stays inactive until granted
+	if pm := clientMapping(c); pm.Active {
+		t.Errorf("expired mapping kept: %+v", pm)
+	}
+	for {
+		select {
+		case e := <-events.C:
+			if e.Action != ActionMappingExpired {
+				continue
+			}
+			if pm := e.Data.(PortMap); pm.InternalPort != 8080 || pm.Active {
+				t.Errorf("expired %+v", pm)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no ActionMappingExpired event")
+		}
+	}
+}
+
+//TestDeleteUnschedules checks that a deleted mapping is no longer renewed.
+func TestDeleteUnschedules(t *testing.T) {
+	srv, c, clock, m := scheduledMapping(t)
+	refresh := clientMapping(c).Refresh.Time
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.sched.mu.Lock()
+	left := len(c.sched.entries)
+	c.sched.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d entries still scheduled", left)
+	}
+	requests := srv.requestCount()
+	advanceTo(clock, refresh+600)
+	checkQuiet(t, srv, requests, "for a deleted mapping")
+}
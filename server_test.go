@@ -0,0 +1,249 @@
+package pcp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testServer is a PCP server on the loopback interface. MAP and PEER requests
+//are answered from a MappingTable and, if PA is set, clients must
+//authenticate first and every response is tagged. Table, PA and the other
+//exported fields are set up before start.
+type testServer struct {
+	conn  *net.UDPConn
+	Table *MappingTable
+	PA    *PAServer
+	//ThirdParty lets clients make mappings for other hosts.
+	ThirdParty bool
+	//NAT64, if set, is a /96 announced in reply to a PREFIX64 option. The
+	//client is then taken to be on the IPv6 address its requests carry.
+	NAT64 netip.Prefix
+	Clock Clock
+	boot  int64
+
+	mu sync.Mutex
+	//mute drops requests without answering; tamper flips a bit of every
+	//common response after it is tagged; strip removes the DESCRIPTION
+	//option from requests, as a server that does not know it would, and
+	//stripped records what it held
+	mute, tamper, strip bool
+	stripped            []string
+	client              *net.UDPAddr
+	last                []byte
+	requests            int
+}
+
+func newTestServer(t testing.TB, clock Clock) *testServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	srv := &testServer{
+		conn:  conn,
+		Table: &MappingTable{ExternalIP: netip.MustParseAddr("203.0.113.7"), Clock: clock},
+		Clock: clock,
+		boot:  clock.Now().Unix(),
+	}
+	t.Cleanup(func() { conn.Close() })
+	return srv
+}
+
+//start serves requests, once the server is set up.
+func (srv *testServer) start(t testing.TB) {
+	go srv.serve(t)
+}
+
+func (srv *testServer) serve(t testing.TB) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := srv.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.client = from
+		srv.requests++
+		mute, tamper := srv.mute, srv.tamper
+		srv.mu.Unlock()
+		if mute {
+			continue
+		}
+		if res := srv.handle(t, buf[:n], from, tamper); res != nil {
+			srv.mu.Lock()
+			srv.last = res
+			srv.mu.Unlock()
+			srv.conn.WriteToUDP(res, from)
+		}
+	}
+}
+
+func (srv *testServer) handle(t testing.TB, req []byte, from *net.UDPAddr, tamper bool) []byte {
+	epoch := srv.epoch()
+	if len(req) > 1 && OpCode(req[1]&0x7f) == OpAuthentication {
+		res, err := srv.PA.HandlePA(req, epoch)
+		if err != nil {
+			t.Logf("HandlePA: %s", err)
+		}
+		return res
+	}
+	var sessionID uint32
+	if srv.PA != nil {
+		id, result, err := srv.PA.Verify(req)
+		if err != nil {
+			t.Logf("Verify: %s", err)
+			return nil
+		}
+		if result != ResultSuccess {
+			v, _ := parseRequest(req)
+			return errorResponse(v, result, nil, epoch)
+		}
+		sessionID = id
+	}
+	client := from.AddrPort().Addr()
+	if srv.NAT64.IsValid() {
+		v, err := parseRequest(req)
+		if err != nil {
+			return nil
+		}
+		if v.opCode() == OpAnnounce {
+			prefix := srv.NAT64.Addr().As16()
+			option := append([]byte{0, 12}, prefix[:12]...)
+			res := appendResponseHeader(nil, OpAnnounce, ResultSuccess, 0, epoch)
+			return appendOptions(res, []PCPOption{{OptionOpPrefix64, option}})
+		}
+		client = v.clientAddr()
+	}
+	srv.mu.Lock()
+	if srv.strip {
+		var description string
+		if req, description = withoutDescription(req); description != "" {
+			srv.stripped = append(srv.stripped, description)
+		}
+	}
+	srv.mu.Unlock()
+	res, err := srv.Table.Handle(req, client, srv.ThirdParty, epoch)
+	if err != nil {
+		t.Logf("Handle: %s", err)
+		return nil
+	}
+	if srv.PA != nil {
+		if res, err = srv.PA.Sign(sessionID, res); err != nil {
+			t.Logf("Sign: %s", err)
+			return nil
+		}
+		if tamper {
+			res[10] ^= 1
+		}
+	}
+	return res
+}
+
+func (srv *testServer) epoch() uint32 {
+	return uint32(srv.Clock.Now().Unix() - srv.boot)
+}
+
+//send delivers msg to the last client heard from, as the server would
+//send an unsolicited message.
+func (srv *testServer) send(msg []byte) {
+	srv.mu.Lock()
+	to := srv.client
+	srv.mu.Unlock()
+	srv.conn.WriteToUDP(msg, to)
+}
+
+func (srv *testServer) setMute(mute bool) {
+	srv.mu.Lock()
+	srv.mute = mute
+	srv.mu.Unlock()
+}
+
+func (srv *testServer) setTamper(tamper bool) {
+	srv.mu.Lock()
+	srv.tamper = tamper
+	srv.mu.Unlock()
+}
+
+func (srv *testServer) lastResponse() []byte {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]byte(nil), srv.last...)
+}
+
+func (srv *testServer) setStrip(strip bool) {
+	srv.mu.Lock()
+	srv.strip = strip
+	srv.mu.Unlock()
+}
+
+//strippedDescriptions returns the descriptions removed from requests.
+func (srv *testServer) strippedDescriptions() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.stripped...)
+}
+
+//withoutDescription returns a copy of req without its DESCRIPTION option,
+//and the description it held.
+func withoutDescription(req []byte) ([]byte, string) {
+	v, err := parseRequest(req)
+	if err != nil {
+		return req, ""
+	}
+	var options []PCPOption
+	var description string
+	for rest := v.options(); len(rest) > 0; {
+		var option PCPOption
+		if option, rest, err = nextOption(rest); err != nil {
+			return req, ""
+		}
+		if option.opCode == OptionOpDescription {
+			description = string(option.data)
+			continue
+		}
+		options = append(options, option)
+	}
+	head := append([]byte(nil), req[:len(req)-len(v.options())]...)
+	return appendOptions(head, options), description
+}
+
+func (srv *testServer) requestCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.requests
+}
+
+//newTestClient returns a client of srv alone, closed when the test ends.
+func newTestClient(t testing.TB, srv *testServer, opts ...ClientOption) *Client {
+	c, err := dialTestClient(srv, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(context.Background(), false) })
+	return c
+}
+
+func dialTestClient(srv *testServer, opts ...ClientOption) (*Client, error) {
+	conn, err := net.DialUDP("udp", nil, srv.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return nil, err
+	}
+	return newClient([]*Session{newSession(Server{}, netip.MustParseAddr("127.0.0.1"), conn)}, opts...)
+}
+
+//eventually polls cond until it holds, failing the test after a few seconds.
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,216 @@
+package pcp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+//Session is the client's state with one PCP server. Every server keeps its own
+//epoch and mapping table, so a host with several uplinks holds its mappings on
+//each server it can reach (4 of RFC7488). Mappings and PeerMappings are
+//updated by the client's goroutines, like Client.Mappings.
+type Session struct {
+	Server Server
+	//Addr is the address of the server in use.
+	Addr         netip.Addr
+	Mappings     map[MappingKey]PortMap
+	PeerMappings map[MappingKey]PeerMap
+
+	conn  *net.UDPConn
+	epoch *ClientEpoch
+	//internal is the client address sent in requests. It is fixed for the
+	//life of the session; a network change replaces the session instead.
+	internal netip.Addr
+	//done is closed when the session is replaced or the client closes.
+	done chan struct{}
+	//auth is the PCP authentication session with the server, used when the
+	//client is configured with WithAuthentication. reauth asks for it to be
+	//renewed straight away.
+	auth   *paState
+	reauth chan struct{}
+	//mu guards prefix64, the NAT64 prefixes learned from the server, which is
+	//nil until learned, and the backoff after failing to learn them: the
+	//error is returned until retry, and wait is the backoff that follows.
+	mu            sync.Mutex
+	prefix64      []Prefix64
+	prefix64Err   error
+	prefix64Retry time.Time
+	prefix64Wait  time.Duration
+}
+
+//ServerResult is the outcome of a request on one server.
+type ServerResult struct {
+	Server  netip.Addr
+	Mapping PortMap
+	Err     error
+}
+
+func newSession(server Server, addr netip.Addr, conn *net.UDPConn) *Session {
+	return &Session{
+		Server:       server,
+		Addr:         addr,
+		Mappings:     make(map[MappingKey]PortMap),
+		PeerMappings: make(map[MappingKey]PeerMap),
+		conn:         conn,
+		epoch:        &ClientEpoch{},
+		internal:     localAddress(conn, addr),
+		done:         make(chan struct{}),
+		auth:         &paState{},
+		reauth:       make(chan struct{}, 1),
+	}
+}
+
+//close stops the session's reader and closes its socket, which unblocks any pending read.
+func (s *Session) close() {
+	close(s.done)
+	s.conn.Close()
+}
+
+//internalAddress is the address the session sends from.
+func (s *Session) internalAddress() (addr netip.Addr, err error) {
+	if !s.internal.IsValid() {
+		return netip.Addr{}, ErrNoInternalAddress
+	}
+	return s.internal, nil
+}
+
+//localAddress returns the address a connected socket sends from, which the
+//kernel chose by routing to the server. Only if the socket has none does it
+//fall back to searching the interfaces for the server's network.
+func localAddress(conn *net.UDPConn, serverAddr netip.Addr) netip.Addr {
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		if addr := AddrPortFromUDPAddr(local).Addr(); addr.IsValid() && !addr.IsUnspecified() {
+			return addr
+		}
+	}
+	addr, _ := internalAddressFor(serverAddr)
+	return addr
+}
+
+//dialServer connects to a server, binding to the local address on the
+//server's network when there is one, so that each server of a multi-homed
+//host is reached through its own interface.
+func dialServer(addr netip.Addr) (*net.UDPConn, error) {
+	var laddr *net.UDPAddr
+	if local, err := internalAddressFor(addr); err == nil {
+		laddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(local, 0))
+	}
+	return net.DialUDP("udp", laddr, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 5351)))
+}
+
+//Sessions returns the session with each server, the primary one first. The
+//set changes when the host moves to a different network.
+func (c *Client) Sessions() []*Session {
+	return c.sessionList()
+}
+
+func (c *Client) sessionList() []*Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Session(nil), c.sessions...)
+}
+
+//primarySession returns the session with the primary server, for the calls
+//that ask only one server.
+func (c *Client) primarySession() (*Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sessions) == 0 {
+		return nil, ErrServerNotFound
+	}
+	return c.sessions[0], nil
+}
+
+//eachSession runs fn on every session concurrently. It returns the first
+//error other than ErrMappingNotFound, or ErrMappingNotFound if no session
+//knew the mapping.
+func (c *Client) eachSession(fn func(s *Session) error) (err error) {
+	sessions := c.sessionList()
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			errs[i] = fn(s)
+		}(i, s)
+	}
+	wg.Wait()
+	found := false
+	for _, e := range errs {
+		if e == ErrMappingNotFound {
+			continue
+		}
+		found = true
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	if !found {
+		return ErrMappingNotFound
+	}
+	return
+}
+
+//MapPort requests a mapping on every server and waits for the answers, so
+//applications can publish each external endpoint. err is only set when no
+//server granted the mapping.
+func (c *Client) MapPort(ctx context.Context, protocol Protocol, internalPort, requestedExternalPort uint16, requestedAddr netip.Addr, lifetime uint32) (results []ServerResult, err error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if err = protocol.validatePorts(internalPort, requestedExternalPort); err != nil {
+		return
+	}
+	lifetime = clampLifetime(lifetime)
+	mapData := &OpDataMap{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: requestedExternalPort,
+		ExternalIP:   requestedAddr,
+	}
+	sessions := c.sessionList()
+	results = make([]ServerResult, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			r := ServerResult{Server: s.Addr}
+			_, r.Err = c.request(ctx, s, OpMap, lifetime, mapData)
+			if r.Err == nil {
+				c.mu.Lock()
+				r.Mapping = s.Mappings[mapData.key()]
+				c.mu.Unlock()
+			}
+			results[i] = r
+		}(i, s)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r.Err == nil {
+			return results, nil
+		}
+		if err == nil {
+			err = r.Err
+		}
+	}
+	return
+}
+
+//Endpoints returns the external address and port of the active mapping for
+//protocol and internalPort on every server that has granted it.
+func (c *Client) Endpoints(protocol Protocol, internalPort uint16) (endpoints []netip.AddrPort) {
+	key := MappingKey{Protocol: protocol, InternalPort: internalPort}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.sessions {
+		if m, exists := s.Mappings[key]; exists && m.Active {
+			endpoints = append(endpoints, m.ExternalAddr())
+		}
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package pcp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+//The client address is taken from the session's socket when it is set up;
+//BenchmarkInternalAddress is what a request pays for it now, the lookups
+//below what every request used to pay.
+
+func BenchmarkInternalAddress(b *testing.B) {
+	srv := newTestServer(b, nil)
+	c := newTestClient(b, srv)
+	s := c.sessionList()[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.internalAddress(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInternalAddressLookup(b *testing.B) {
+	server := netip.MustParseAddr("127.0.0.1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := internalAddressFor(server); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiscoverGateway(b *testing.B) {
+	if _, err := discoverGateway(); err != nil {
+		b.Skip(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		discoverGateway()
+	}
+}
@@ -0,0 +1,250 @@
+package pcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//RestoreMode decides what a client does with mappings loaded from its StateStore.
+type RestoreMode uint8
+
+const (
+	//RestoreResume takes the mappings over and renews them straight away.
+	RestoreResume RestoreMode = iota
+	//RestoreDelete asks the servers to delete the mappings.
+	RestoreDelete
+)
+
+//StateStore keeps a client's state across restarts. The server only lets the
+//client that created a mapping renew or delete it, identified by its nonce,
+//so without the saved nonce a restarted process leaves its ports open until
+//they expire. Load returns nil and no error when nothing has been saved.
+type StateStore interface {
+	Load() (*State, error)
+	Save(*State) error
+}
+
+//State is what a StateStore saves: the nonce sent with every mapping, and the
+//mappings and epoch held with each server.
+type State struct {
+	Nonce   []byte
+	Servers []ServerState
+}
+
+//ServerState is the part of State held with one server. Internal is the
+//address the mappings were made from; only that address can manage them.
+type ServerState struct {
+	Server       netip.Addr
+	Internal     netip.Addr
+	Epoch        EpochState
+	Mappings     []PortMap
+	PeerMappings []PeerMap
+}
+
+//EpochState is the last epoch time received from a server, with the client
+//time it arrived at, so a server reboot during the restart is still noticed.
+type EpochState struct {
+	ServerTime uint32
+	ClientTime int64
+}
+
+//FileStore is a StateStore keeping the state as JSON in a file.
+type FileStore struct {
+	Path string
+}
+
+//NewFileStore returns a FileStore saving to path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+func (f *FileStore) Load() (state *State, err error) {
+	b, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state = &State{}
+	if err = json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+//Save writes the state to a temporary file and renames it over Path, so a
+//crash while saving leaves the previous state intact. The file is only
+//readable by its owner, as the nonce lets anyone delete the mappings.
+func (f *FileStore) Save(state *State) (err error) {
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+//snapshot returns the client's current state.
+func (c *Client) snapshot() *State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := &State{Nonce: append([]byte(nil), c.nonce...)}
+	for _, s := range c.sessions {
+		ss := ServerState{
+			Server:   s.Addr,
+			Internal: s.internal,
+			Epoch:    EpochState{s.epoch.prevServerTime, s.epoch.prevClientTime},
+		}
+		for _, m := range s.Mappings {
+			ss.Mappings = append(ss.Mappings, m)
+		}
+		for _, m := range s.PeerMappings {
+			ss.PeerMappings = append(ss.PeerMappings, m)
+		}
+		state.Servers = append(state.Servers, ss)
+	}
+	return state
+}
+
+//stateChanged asks the saver goroutine to save the state. Changes arriving
+//while a save is pending are covered by it, so bursts are written once.
+func (c *Client) stateChanged() {
+	if c.store == nil {
+		return
+	}
+	select {
+	case c.stateDirty <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) saveState() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.stateDirty:
+			c.persist()
+		}
+	}
+}
+
+//saveNow saves the state before a mapping call returns. Left to the saver
+//goroutine, a crash straight after the call would lose the only record of a
+//mapping the server holds for the nonce, orphaning it until it expires. A
+//crash while the request is still on its way can still do so.
+func (c *Client) saveNow() {
+	if c.store != nil {
+		c.persist()
+	}
+}
+
+//persist saves a snapshot. Saves are serialised, so an older snapshot never
+//replaces a newer one.
+func (c *Client) persist() {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	if err := c.store.Save(c.snapshot()); err != nil {
+		log.Errorf("Could not save client state: %s", err)
+	}
+}
+
+//restoreState loads the saved state before the client starts. The nonce is
+//taken over so the servers accept the client as the owner of the mappings.
+//Mappings that have not expired are put back on the session with the same
+//server for renewal, and returned if they are to be deleted instead.
+func (c *Client) restoreState() (deletions []mappingKey, datas []interface{}, err error) {
+	state, err := c.store.Load()
+	if err != nil || state == nil {
+		return nil, nil, err
+	}
+	if len(state.Nonce) == len(c.nonce) {
+		c.nonce = state.Nonce
+	}
+	now := c.clock.Now().Unix()
+	for _, ss := range state.Servers {
+		var s *Session
+		for _, x := range c.sessions {
+			if x.Addr == ss.Server {
+				s = x
+				break
+			}
+		}
+		if s == nil {
+			log.Warnf("PCP server %s from the saved state was not found, its mappings are left to expire", ss.Server)
+			continue
+		}
+		if ss.Internal != s.internal {
+			log.Warnf("Mappings with %s were made from %s, not %s, and are left to expire", ss.Server, ss.Internal, s.internal)
+			continue
+		}
+		s.epoch.prevServerTime = ss.Epoch.ServerTime
+		s.epoch.prevClientTime = ss.Epoch.ClientTime
+		for _, m := range ss.Mappings {
+			if m.Expires <= now {
+				continue
+			}
+			key := mappingKey{s, OpMap, m.Key()}
+			if c.restoreMode == RestoreDelete {
+				data := m.OpDataMap
+				deletions, datas = append(deletions, key), append(datas, &data)
+				continue
+			}
+			s.Mappings[key.MappingKey] = resetRefresh(m, now)
+			c.sched.schedule(key, now)
+		}
+		for _, m := range ss.PeerMappings {
+			if m.Expires <= now {
+				continue
+			}
+			key := mappingKey{s, OpPeer, m.Key()}
+			if c.restoreMode == RestoreDelete {
+				data := &OpDataPeer{OpDataMap: m.OpDataMap, RemotePort: m.RemotePort, RemoteIP: m.RemoteIP}
+				deletions, datas = append(deletions, key), append(datas, data)
+				continue
+			}
+			m.PortMap = resetRefresh(m.PortMap, now)
+			s.PeerMappings[key.MappingKey] = m
+			c.sched.schedule(key, now)
+		}
+	}
+	return
+}
+
+//deleteRestored deletes the mappings restoreState returned, then saves the
+//state without them.
+func (c *Client) deleteRestored(keys []mappingKey, datas []interface{}) {
+	defer c.wg.Done()
+	for i, key := range keys {
+		_, err := c.request(context.Background(), key.session, key.op, 0, datas[i])
+		if err != nil {
+			log.Errorf("Could not delete mapping for port %d left by a previous run: %s", key.InternalPort, err)
+		}
+	}
+	c.stateChanged()
+}
@@ -0,0 +1,215 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(filepath.Join(dir, "state.json"))
+	state, err := store.Load()
+	if state != nil || err != nil {
+		t.Fatalf("Load() before any save = %v, %v; want nil, nil", state, err)
+	}
+
+	want := &State{
+		Nonce: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		Servers: []ServerState{{
+			Server:   netip.MustParseAddr("192.0.2.1"),
+			Internal: netip.MustParseAddr("192.168.1.2"),
+			Epoch:    EpochState{ServerTime: 100, ClientTime: 1700000000},
+			Mappings: []PortMap{{
+				OpDataMap: OpDataMap{
+					Protocol:     ProtocolTCP,
+					InternalPort: 8080,
+					ExternalPort: 40000,
+					ExternalIP:   netip.MustParseAddr("203.0.113.7"),
+					Description:  "web",
+				},
+				Active:   true,
+				Lifetime: 600,
+				Expires:  1700000600,
+				Refresh:  RefreshTime{Attempt: 1, Time: 1700000300},
+			}},
+			PeerMappings: []PeerMap{{
+				PortMap: PortMap{
+					OpDataMap: OpDataMap{
+						Protocol:     ProtocolUDP,
+						InternalPort: 5000,
+						ExternalPort: 40001,
+						ExternalIP:   netip.MustParseAddr("203.0.113.7"),
+					},
+					Lifetime: 120,
+					Expires:  1700000120,
+				},
+				RemotePort: 3478,
+				RemoteIP:   netip.MustParseAddr("198.51.100.9"),
+			}},
+		}},
+	}
+	for i := 0; i < 2; i++ {
+		if err = store.Save(want); err != nil {
+			t.Fatal(err)
+		}
+		if state, err = store.Load(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(state, want) {
+			t.Fatalf("save %d: Load() = %+v, want %+v", i, state, want)
+		}
+		want.Servers[0].Epoch.ServerTime++
+	}
+
+	//The temporary file is renamed over the state, not left beside it
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "state.json" {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("directory holds %v, want only state.json", names)
+	}
+	info, err := os.Stat(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file mode = %v, want 0600", perm)
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err := os.WriteFile(store.Path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Fatal("Load() of a truncated file succeeded")
+	}
+}
+
+//savedMapping returns the mapping for port the store holds, if any.
+func savedMapping(t *testing.T, store StateStore, port uint16) (m PortMap, ok bool) {
+	t.Helper()
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil {
+		return PortMap{}, false
+	}
+	for _, ss := range state.Servers {
+		for _, m := range ss.Mappings {
+			if m.InternalPort == port {
+				return m, true
+			}
+		}
+	}
+	return PortMap{}, false
+}
+
+func TestSaveBeforeReturn(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.setMute(true)
+	srv.start(t)
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	c := newTestClient(t, srv, WithStateStore(store, RestoreResume))
+
+	//No response is needed: the request may already have made the mapping
+	if err := c.AddPortMapping(ProtocolTCP, 8080, 0, netip.Addr{}, 600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := savedMapping(t, store, 8080); !ok {
+		t.Fatal("AddPortMapping returned before saving the mapping")
+	}
+
+	srv.setMute(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := c.OpenPortMapping(ctx, ProtocolUDP, 5000, 0, netip.Addr{}, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, ok := savedMapping(t, store, 5000); !ok || !saved.Active {
+		t.Fatalf("OpenPortMapping returned before saving the granted mapping: %+v", saved)
+	}
+	if err = m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := savedMapping(t, store, 5000); ok {
+		t.Fatal("Mapping.Close returned before saving the deletion")
+	}
+}
+
+//restartedClient makes a mapping with one client, closes it without
+//releasing the mapping, and starts another client with the same store.
+func restartedClient(t *testing.T, mode RestoreMode) (srv *testServer, c *Client, external uint16) {
+	srv = newTestServer(t, nil)
+	srv.start(t)
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	old, err := dialTestClient(srv, WithStateStore(store, mode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := old.OpenPortMapping(ctx, ProtocolTCP, 8080, 0, netip.Addr{}, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	external = m.ExternalAddr().Port()
+	if err = old.Close(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if entries := srv.Table.Entries(); len(entries) != 1 {
+		t.Fatalf("server holds %d mappings after the first run, want 1", len(entries))
+	}
+	return srv, newTestClient(t, srv, WithStateStore(store, mode)), external
+}
+
+func TestRestoreResume(t *testing.T) {
+	srv, c, external := restartedClient(t, RestoreResume)
+	key := MappingKey{Protocol: ProtocolTCP, InternalPort: 8080}
+	if _, ok := c.GetMappings()[key]; !ok {
+		t.Fatal("restored mapping is missing")
+	}
+	//Restored mappings are renewed straight away, not when their refresh is due
+	eventually(t, "the restored mapping to be renewed", func() bool {
+		return srv.requestCount() == 2
+	})
+	eventually(t, "the renewal response", func() bool {
+		return c.GetMappings()[key].Active
+	})
+	m := c.GetMappings()[key]
+	if m.ExternalPort != external {
+		t.Errorf("renewed mapping has external port %d, want %d", m.ExternalPort, external)
+	}
+	//The saved nonce makes the renewal update the old mapping, not add one
+	entries := srv.Table.Entries()
+	if len(entries) != 1 || entries[0].External.Port() != external {
+		t.Errorf("server holds %+v after the restart, want only the first mapping", entries)
+	}
+}
+
+func TestRestoreDelete(t *testing.T) {
+	srv, c, _ := restartedClient(t, RestoreDelete)
+	eventually(t, "the restored mapping to be deleted", func() bool {
+		return len(srv.Table.Entries()) == 0
+	})
+	if m := c.GetMappings(); len(m) != 0 {
+		t.Errorf("client holds %+v after deleting the restored mappings", m)
+	}
+	eventually(t, "the deletion to be saved", func() bool {
+		_, ok := savedMapping(t, c.store, 8080)
+		return !ok
+	})
+}
@@ -0,0 +1,407 @@
+package pcp
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+const (
+	//DefaultMaxLifetime caps the lifetime a MappingTable grants, in seconds.
+	DefaultMaxLifetime = 24 * 3600
+	//errorLifetime is how long error responses of a MappingTable hold, see
+	//7.2 of RFC6887.
+	errorLifetime  = 30
+	defaultMinPort = 1024
+)
+
+//MappingTable holds the mappings of a PCP server built on this package and
+//answers MAP and PEER requests for them (11 and 12 of RFC6887). Mappings
+//belong to a subscriber: the internal address, together with the
+//THIRD_PARTY_ID if the request had one (RFC7843), so hosts behind a shared
+//address are kept apart. Each internal endpoint of a subscriber gets one
+//external port, shared by its MAP and PEER mappings.
+type MappingTable struct {
+	//ExternalIP is the address external ports are allocated on.
+	ExternalIP netip.Addr
+	//MinPort and MaxPort bound the external ports allocated. Zero means
+	//1024 to 65535.
+	MinPort, MaxPort uint16
+	//MaxLifetime caps the lifetime granted, in seconds. Zero means
+	//DefaultMaxLifetime.
+	MaxLifetime uint32
+	//Clock is the system clock if nil.
+	Clock Clock
+
+	mu        sync.Mutex
+	entries   map[MappingKey]*TableEntry
+	endpoints map[MappingKey]*tableEndpoint
+	ports     map[tablePort]bool
+	next      uint16
+	lastSweep int64
+}
+
+//TableEntry is a mapping held by a MappingTable. The ThirdParty of its key
+//is the subscriber, and is set for every entry: a host mapping for itself
+//is the subscriber at its own address.
+type TableEntry struct {
+	MappingKey
+	External netip.AddrPort
+	//Expires is the Unix time the mapping ends unless renewed.
+	Expires int64
+	//Description is the label the client gave the mapping (RFC7220), so
+	//listings show which application owns it.
+	Description string
+	//PortSet is set for a MAP mapping of consecutive ports, which are
+	//allocated from External on.
+	PortSet PortSet
+	nonce   [12]byte
+}
+
+//tableEndpoint is the external ports of an internal endpoint, size of them
+//from port on, and how many entries use them.
+type tableEndpoint struct {
+	port uint16
+	size uint16
+	refs int
+}
+
+type tablePort struct {
+	protocol Protocol
+	port     uint16
+}
+
+func (t *MappingTable) now() int64 {
+	if t.Clock == nil {
+		return realClock{}.Now().Unix()
+	}
+	return t.Clock.Now().Unix()
+}
+
+//Handle processes a MAP or PEER request received from the address from and
+//returns the response. thirdParty tells whether from may manage mappings for
+//other hosts, e.g. because its request passed PAServer.Verify; requests with
+//a THIRD_PARTY option are refused otherwise (13.1 of RFC6887). epoch is the
+//server's current epoch time. Requests too malformed to answer return an
+//error and should be dropped.
+func (t *MappingTable) Handle(req []byte, from netip.Addr, thirdParty bool, epoch uint32) (res []byte, err error) {
+	v, err := parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	op := v.opCode()
+	if op != OpMap && op != OpPeer {
+		return errorResponse(v, ResultUnsupportedOpcode, nil, epoch), nil
+	}
+	//Options are read first so that error responses can echo them
+	var options []PCPOption
+	for rest := v.options(); len(rest) > 0; {
+		var option PCPOption
+		if option, rest, err = nextOption(rest); err != nil {
+			return errorResponse(v, ResultMalformedOption, options, epoch), nil
+		}
+		switch option.opCode {
+		case OptionOpThirdParty, OptionOpThirdPartyId, OptionOpDescription, OptionOpPortSet:
+			options = append(options, option)
+		case OptionOpAuthenticationTag:
+			//Checked by PAServer.Verify
+		default:
+			//Options from 128 up are optional to process
+			if option.opCode < 128 {
+				return errorResponse(v, ResultUnsupportedOption, options, epoch), nil
+			}
+		}
+	}
+	if v.clientAddr() != from.Unmap() {
+		return errorResponse(v, ResultAddressMismatch, options, epoch), nil
+	}
+	var data OpDataPeer
+	if op == OpMap {
+		err = data.OpDataMap.unmarshal(v.opData())
+	} else {
+		err = data.unmarshal(v.opData())
+	}
+	if err != nil {
+		return errorResponse(v, ResultMalformedRequest, options, epoch), nil
+	}
+	ports := []uint16{data.InternalPort, data.ExternalPort}
+	if op == OpPeer {
+		ports = append(ports, data.RemotePort)
+	}
+	switch data.Protocol.validatePorts(ports...) {
+	case nil:
+	case ErrUnknownProtocol:
+		return errorResponse(v, ResultUnsupportedProtocol, options, epoch), nil
+	default:
+		//Ports given for a protocol without them
+		return errorResponse(v, ResultMalformedRequest, options, epoch), nil
+	}
+	var nonce [12]byte
+	copy(nonce[:], v.opData())
+	if data.ThirdParty, err = readThirdParty(options); err != nil {
+		return errorResponse(v, ResultMalformedOption, options, epoch), nil
+	}
+	if data.Description, err = readDescription(options); err != nil {
+		return errorResponse(v, ResultMalformedOption, options, epoch), nil
+	}
+	if op == OpMap {
+		//The set starts at the internal port of the request
+		data.PortSet, err = readPortSet(options)
+		if err != nil || data.PortSet.IsSet() && data.PortSet.FirstInternalPort != data.InternalPort {
+			return errorResponse(v, ResultMalformedOption, options, epoch), nil
+		}
+	}
+	subscriber := ThirdParty{Addr: from.Unmap()}
+	if data.ThirdParty.IsSet() {
+		if !thirdParty {
+			return errorResponse(v, ResultNotAuthorised, options, epoch), nil
+		}
+		subscriber = data.ThirdParty
+	}
+	key := MappingKey{Protocol: data.Protocol, InternalPort: data.InternalPort, ThirdParty: subscriber}
+	if op == OpPeer {
+		key.Remote = data.RemoteAddr()
+	}
+
+	lifetime := v.lifetime()
+	if max := t.maxLifetime(); lifetime > max {
+		lifetime = max
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.sweep(now)
+	e := t.entries[key]
+	if e != nil && e.nonce != nonce {
+		//Only the client that created a mapping may change it
+		return errorResponse(v, ResultNotAuthorised, options, epoch), nil
+	}
+	if lifetime == 0 {
+		if e != nil {
+			t.remove(e)
+		}
+		if op == OpMap && data.InternalPort == 0 {
+			//Also deletes the subscriber's mappings of every port of the
+			//protocol, or of every protocol, that this client made
+			for _, other := range t.entries {
+				if other.ThirdParty == subscriber && !other.Remote.IsValid() && other.nonce == nonce &&
+					(key.Protocol == ProtocolAll || other.Protocol == key.Protocol) {
+					t.remove(other)
+				}
+			}
+		}
+	} else {
+		if e == nil {
+			port, size, ok := t.allocate(key, data.ExternalPort, data.PortSet)
+			if !ok {
+				return errorResponse(v, ResultNoResources, options, epoch), nil
+			}
+			e = &TableEntry{MappingKey: key, External: netip.AddrPortFrom(t.ExternalIP, port), nonce: nonce}
+			if data.PortSet.IsSet() {
+				//Possibly fewer ports than asked, see 5 of RFC7753
+				e.PortSet = PortSet{size, data.PortSet.FirstInternalPort, data.PortSet.Parity}
+			}
+			t.entries[key] = e
+		}
+		e.Expires = now + int64(lifetime)
+		e.Description = data.Description
+		data.ExternalPort, data.ExternalIP = e.External.Port(), e.External.Addr()
+		data.PortSet = e.PortSet
+	}
+
+	res = appendResponseHeader(nil, op, ResultSuccess, lifetime, epoch)
+	if op == OpMap {
+		res = data.OpDataMap.appendTo(res, nonce[:], from)
+	} else if res, err = data.appendTo(res, nonce[:], from); err != nil {
+		return errorResponse(v, ResultMalformedRequest, options, epoch), nil
+	}
+	if res, err = data.ThirdParty.appendOptions(res); err != nil {
+		return nil, err
+	}
+	if res, err = appendDescription(res, data.Description); err != nil {
+		return nil, err
+	}
+	return appendPortSet(res, data.PortSet)
+}
+
+//errorResponse answers a request with result, copying its opcode data as
+//7.2 of RFC6887 asks, and the options processed so the client can match it.
+func errorResponse(v requestView, result ResultCode, options []PCPOption, epoch uint32) []byte {
+	res := appendResponseHeader(nil, v.opCode(), result, errorLifetime, epoch)
+	return appendOptions(append(res, v.opData()...), options)
+}
+
+func (t *MappingTable) maxLifetime() uint32 {
+	if t.MaxLifetime == 0 {
+		return DefaultMaxLifetime
+	}
+	return t.MaxLifetime
+}
+
+func (t *MappingTable) portRange() (min, max uint16) {
+	min, max = t.MinPort, t.MaxPort
+	if min == 0 {
+		min = defaultMinPort
+	}
+	if max == 0 {
+		max = 65535
+	}
+	return
+}
+
+//allocate returns the external ports for the internal endpoint of key: the
+//ones its other mappings use, else suggested if it is free, else the next
+//free ports. A port set gets a run of consecutive ports, or the longest run
+//there is if none is long enough, and keeps the parity of its first port if
+//asked. Mappings of protocols without ports get port zero.
+//t.mu must be held.
+func (t *MappingTable) allocate(key MappingKey, suggested uint16, set PortSet) (port, size uint16, ok bool) {
+	if t.entries == nil {
+		t.entries = make(map[MappingKey]*TableEntry)
+		t.endpoints = make(map[MappingKey]*tableEndpoint)
+		t.ports = make(map[tablePort]bool)
+	}
+	endpoint := MappingKey{Protocol: key.Protocol, InternalPort: key.InternalPort, ThirdParty: key.ThirdParty}
+	if ep := t.endpoints[endpoint]; ep != nil {
+		ep.refs++
+		return ep.port, ep.size, true
+	}
+	size = 1
+	if key.InternalPort != 0 {
+		parity := -1
+		if set.IsSet() {
+			size = set.Size
+			if set.Parity {
+				parity = int(set.FirstInternalPort % 2)
+			}
+		}
+		switch {
+		case t.free(key.Protocol, suggested, size) && (parity < 0 || int(suggested%2) == parity):
+			port = suggested
+		case size == 1 && parity < 0:
+			if port = t.nextFree(key.Protocol); port == 0 {
+				return 0, 0, false
+			}
+		default:
+			if port, size = t.findRun(key.Protocol, size, parity); size == 0 {
+				return 0, 0, false
+			}
+		}
+		for i := uint16(0); i < size; i++ {
+			t.ports[tablePort{key.Protocol, port + i}] = true
+		}
+	}
+	t.endpoints[endpoint] = &tableEndpoint{port: port, size: size, refs: 1}
+	return port, size, true
+}
+
+//free reports whether the size ports from port on are in range and unused.
+func (t *MappingTable) free(protocol Protocol, port, size uint16) bool {
+	min, max := t.portRange()
+	if port < min || int(port)+int(size)-1 > int(max) {
+		return false
+	}
+	for i := uint16(0); i < size; i++ {
+		if t.ports[tablePort{protocol, port + i}] {
+			return false
+		}
+	}
+	return true
+}
+
+//nextFree returns the next unused port after the last one allocated, or zero
+//if all are in use.
+func (t *MappingTable) nextFree(protocol Protocol) uint16 {
+	min, max := t.portRange()
+	if t.next < min || t.next > max {
+		t.next = min
+	}
+	for i := 0; i <= int(max-min); i++ {
+		p := t.next
+		if t.next == max {
+			t.next = min
+		} else {
+			t.next++
+		}
+		if !t.ports[tablePort{protocol, p}] {
+			return p
+		}
+	}
+	return 0
+}
+
+//findRun returns the lowest run of size unused ports, or the longest shorter
+//one if there is none. parity, unless negative, is that of its first port.
+func (t *MappingTable) findRun(protocol Protocol, size uint16, parity int) (start, n uint16) {
+	min, max := t.portRange()
+	for p := int(min); p <= int(max); p++ {
+		if t.ports[tablePort{protocol, uint16(p)}] || parity >= 0 && p%2 != parity {
+			continue
+		}
+		run := 1
+		for run < int(size) && p+run <= int(max) && !t.ports[tablePort{protocol, uint16(p + run)}] {
+			run++
+		}
+		if run > int(n) {
+			start, n = uint16(p), uint16(run)
+			if n == size {
+				return
+			}
+		}
+		//Later starts in this run only give shorter runs
+		p += run - 1
+	}
+	return
+}
+
+//remove deletes e, freeing its external port once no other mapping of the
+//endpoint uses it. t.mu must be held.
+func (t *MappingTable) remove(e *TableEntry) {
+	delete(t.entries, e.MappingKey)
+	endpoint := MappingKey{Protocol: e.Protocol, InternalPort: e.InternalPort, ThirdParty: e.ThirdParty}
+	ep := t.endpoints[endpoint]
+	if ep == nil {
+		return
+	}
+	if ep.refs--; ep.refs == 0 {
+		delete(t.endpoints, endpoint)
+		for i := uint16(0); i < ep.size; i++ {
+			delete(t.ports, tablePort{e.Protocol, ep.port + i})
+		}
+	}
+}
+
+//sweep drops expired mappings, at most once a second. t.mu must be held.
+func (t *MappingTable) sweep(now int64) {
+	if now == t.lastSweep {
+		return
+	}
+	t.lastSweep = now
+	for _, e := range t.entries {
+		if e.Expires <= now {
+			t.remove(e)
+		}
+	}
+}
+
+//Entries returns the mappings held, with their descriptions, ordered by
+//protocol and external port, e.g. for an administrative listing.
+func (t *MappingTable) Entries() (entries []TableEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(t.now())
+	for _, e := range t.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.External.Port() != b.External.Port() {
+			return a.External.Port() < b.External.Port()
+		}
+		return a.Remote.String() < b.Remote.String()
+	})
+	return
+}
@@ -0,0 +1,185 @@
+package pcp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTablePortRules(t *testing.T) {
+	from := netip.MustParseAddr("192.0.2.1")
+	remote := netip.MustParseAddr("198.51.100.7")
+	nonce := make([]byte, 12)
+	for _, c := range []struct {
+		name     string
+		op       OpCode
+		protocol Protocol
+		internal uint16
+		external uint16
+		remote   uint16
+		result   ResultCode
+	}{
+		{"TCP", OpMap, ProtocolTCP, 8080, 0, 0, ResultSuccess},
+		{"ICMP without ports", OpMap, ProtocolICMP, 0, 0, 0, ResultSuccess},
+		{"all protocols without ports", OpMap, ProtocolAll, 0, 0, 0, ResultSuccess},
+		{"all protocols with a port", OpMap, ProtocolAll, 8080, 0, 0, ResultMalformedRequest},
+		{"ICMP with a port", OpMap, ProtocolICMP, 7, 0, 0, ResultMalformedRequest},
+		{"ICMP with an external port", OpMap, ProtocolICMP, 0, 7, 0, ResultMalformedRequest},
+		{"TCP all ports", OpMap, ProtocolTCP, 0, 0, 0, ResultSuccess},
+		{"unassigned protocol", OpMap, Protocol(200), 0, 0, 0, ResultUnsupportedProtocol},
+		{"reserved protocol", OpMap, ProtocolReserved, 0, 0, 0, ResultUnsupportedProtocol},
+		{"UDP peer", OpPeer, ProtocolUDP, 5000, 0, 6000, ResultSuccess},
+		{"ICMP peer with a remote port", OpPeer, ProtocolICMP, 0, 0, 53, ResultMalformedRequest},
+		{"unassigned protocol peer", OpPeer, Protocol(200), 0, 0, 0, ResultUnsupportedProtocol},
+	} {
+		table := &MappingTable{ExternalIP: netip.MustParseAddr("203.0.113.7")}
+		data := OpDataPeer{
+			OpDataMap:  OpDataMap{Protocol: c.protocol, InternalPort: c.internal, ExternalPort: c.external},
+			RemotePort: c.remote,
+			RemoteIP:   remote,
+		}
+		r, err := tableRequest(table, c.op, 600, data, from, nonce, false)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if r.resultCode != c.result {
+			t.Errorf("%s: %s, want %s", c.name, r.resultCode, c.result)
+		}
+		if entries := table.Entries(); (c.result == ResultSuccess) != (len(entries) == 1) {
+			t.Errorf("%s: table holds %+v", c.name, entries)
+		}
+	}
+}
+
+//tableRequest sends a MAP or PEER request for data from from to table and
+//returns the response.
+func tableRequest(table *MappingTable, op OpCode, lifetime uint32, data OpDataPeer, from netip.Addr, nonce []byte, thirdParty bool) (r ResponsePacket, err error) {
+	req := appendRequestHeader(nil, op, lifetime, from)
+	if op == OpMap {
+		req = data.OpDataMap.appendTo(req, nonce, from)
+	} else if req, err = data.appendTo(req, nonce, from); err != nil {
+		return
+	}
+	if req, err = data.ThirdParty.appendOptions(req); err != nil {
+		return
+	}
+	if req, err = appendDescription(req, data.Description); err != nil {
+		return
+	}
+	res, err := table.Handle(req, from, thirdParty, 1)
+	if err != nil {
+		return
+	}
+	err = r.unmarshal(res)
+	return
+}
+
+//TestTableDeleteAllPorts checks that a deletion with internal port zero
+//removes the client's mappings of every port of the protocol, or of every
+//protocol, as 11.3 of RFC6887 describes.
+func TestTableDeleteAllPorts(t *testing.T) {
+	from := netip.MustParseAddr("192.0.2.1")
+	nonce, other := make([]byte, 12), make([]byte, 12)
+	other[0] = 1
+	mapping := func(protocol Protocol, port uint16) OpDataPeer {
+		return OpDataPeer{OpDataMap: OpDataMap{Protocol: protocol, InternalPort: port}}
+	}
+	table := &MappingTable{ExternalIP: netip.MustParseAddr("203.0.113.7")}
+	for _, m := range []OpDataPeer{mapping(ProtocolTCP, 80), mapping(ProtocolTCP, 443), mapping(ProtocolUDP, 53)} {
+		if r, err := tableRequest(table, OpMap, 600, m, from, nonce, false); err != nil || r.resultCode != ResultSuccess {
+			t.Fatalf("mapping %d: %v %v", m.InternalPort, r.resultCode, err)
+		}
+	}
+	//Another client on the same host keeps its mapping
+	if r, err := tableRequest(table, OpMap, 600, mapping(ProtocolTCP, 8080), from, other, false); err != nil || r.resultCode != ResultSuccess {
+		t.Fatalf("other client: %v %v", r.resultCode, err)
+	}
+
+	if r, err := tableRequest(table, OpMap, 0, mapping(ProtocolTCP, 0), from, nonce, false); err != nil || r.resultCode != ResultSuccess {
+		t.Fatalf("delete all TCP: %v %v", r.resultCode, err)
+	}
+	left := make(map[uint16]bool)
+	for _, e := range table.Entries() {
+		left[e.InternalPort] = true
+	}
+	if len(left) != 2 || !left[53] || !left[8080] {
+		t.Errorf("after deleting TCP: %v", left)
+	}
+
+	if r, err := tableRequest(table, OpMap, 0, mapping(ProtocolAll, 0), from, nonce, false); err != nil || r.resultCode != ResultSuccess {
+		t.Fatalf("delete all: %v %v", r.resultCode, err)
+	}
+	if entries := table.Entries(); len(entries) != 1 || entries[0].InternalPort != 8080 {
+		t.Errorf("after deleting everything: %+v", entries)
+	}
+}
+
+//TestTableThirdParty checks that an interworking function may map ports for
+//subscribers sharing one internal address, told apart by THIRD_PARTY_ID, and
+//that clients not allowed to act for others are refused.
+func TestTableThirdParty(t *testing.T) {
+	iwf := netip.MustParseAddr("192.0.2.1")
+	subscriber := netip.MustParseAddr("10.0.0.5")
+	nonce := make([]byte, 12)
+	table := &MappingTable{ExternalIP: netip.MustParseAddr("203.0.113.7")}
+	mapping := func(tp ThirdParty) OpDataPeer {
+		return OpDataPeer{OpDataMap: OpDataMap{Protocol: ProtocolTCP, InternalPort: 8080, ThirdParty: tp}}
+	}
+	a := ThirdParty{subscriber, "subscriber-a"}
+	b := ThirdParty{subscriber, "subscriber-b"}
+
+	external := make(map[ThirdParty]uint16)
+	for _, tp := range []ThirdParty{a, b, {}} {
+		r, err := tableRequest(table, OpMap, 600, mapping(tp), iwf, nonce, true)
+		if err != nil || r.resultCode != ResultSuccess {
+			t.Fatalf("%+v: %v %v", tp, r.resultCode, err)
+		}
+		echoed, err := readThirdParty(r.pcpOptions)
+		if err != nil || echoed != tp {
+			t.Errorf("%+v echoed as %+v, %v", tp, echoed, err)
+		}
+		data, _ := r.mapData()
+		external[tp] = data.ExternalPort
+	}
+	if external[a] == external[b] || external[a] == external[ThirdParty{}] {
+		t.Errorf("subscribers share external ports: %v", external)
+	}
+	entries := table.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("table holds %+v", entries)
+	}
+	for _, e := range entries {
+		tp := e.ThirdParty
+		if tp.Addr == iwf {
+			tp = ThirdParty{}
+		}
+		if e.External.Port() != external[tp] {
+			t.Errorf("entry %+v, want external port %d", e, external[tp])
+		}
+	}
+
+	//Without the server's permission the option is refused
+	c := ThirdParty{subscriber, "subscriber-c"}
+	if r, err := tableRequest(table, OpMap, 600, mapping(c), iwf, nonce, false); err != nil || r.resultCode != ResultNotAuthorised {
+		t.Errorf("unauthorised third party: %v %v", r.resultCode, err)
+	}
+	if r, err := tableRequest(table, OpMap, 0, mapping(a), iwf, nonce, false); err != nil || r.resultCode != ResultNotAuthorised {
+		t.Errorf("unauthorised deletion: %v %v", r.resultCode, err)
+	}
+	if entries = table.Entries(); len(entries) != 3 {
+		t.Errorf("table holds %+v", entries)
+	}
+
+	//Deleting one subscriber's mapping leaves the other's
+	if r, err := tableRequest(table, OpMap, 0, mapping(a), iwf, nonce, true); err != nil || r.resultCode != ResultSuccess {
+		t.Fatalf("deletion: %v %v", r.resultCode, err)
+	}
+	for _, e := range table.Entries() {
+		if e.ThirdParty == a {
+			t.Errorf("deleted mapping kept: %+v", e)
+		}
+	}
+	if entries = table.Entries(); len(entries) != 2 {
+		t.Errorf("table holds %+v", entries)
+	}
+}
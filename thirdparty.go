@@ -0,0 +1,119 @@
+package pcp
+
+import (
+	"context"
+	"encoding/base64"
+	"net/netip"
+)
+
+//ThirdParty names another host a mapping is made for, e.g. by a CGN or an
+//interworking function acting for its subscribers. Addr goes in a
+//THIRD_PARTY option (13.1 of RFC6887). ID, sent in a THIRD_PARTY_ID option
+//(RFC7843), tells apart hosts using the same address on different
+//networks behind the server. The zero ThirdParty is the client itself.
+type ThirdParty struct {
+	Addr netip.Addr
+	ID   ThirdPartyID
+}
+
+//ThirdPartyID is an opaque subscriber identifier. It is a string so mapping
+//keys stay comparable, and marshals as base64 so that IDs which are not
+//UTF-8 survive a StateStore.
+type ThirdPartyID string
+
+func (id ThirdPartyID) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString([]byte(id))), nil
+}
+
+func (id *ThirdPartyID) UnmarshalText(b []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil {
+		return err
+	}
+	*id = ThirdPartyID(raw)
+	return nil
+}
+
+//IsSet reports whether the mapping is for another host.
+func (tp ThirdParty) IsSet() bool {
+	return tp.Addr.IsValid()
+}
+
+func (tp ThirdParty) validate() error {
+	if !tp.IsSet() && tp.ID != "" {
+		return ErrThirdPartyID
+	}
+	return nil
+}
+
+//appendOptions appends the THIRD_PARTY and THIRD_PARTY_ID options, if any.
+func (tp ThirdParty) appendOptions(b []byte) ([]byte, error) {
+	if err := tp.validate(); err != nil {
+		return b, err
+	}
+	if !tp.IsSet() {
+		return b, nil
+	}
+	options := []PCPOption{{OptionOpThirdParty, appendAddr(nil, tp.Addr)}}
+	if tp.ID != "" {
+		options = append(options, PCPOption{OptionOpThirdPartyId, []byte(tp.ID)})
+	}
+	return appendOptions(b, options), nil
+}
+
+//readThirdParty reads the THIRD_PARTY and THIRD_PARTY_ID options, which a
+//server echoes in its response.
+func readThirdParty(options []PCPOption) (tp ThirdParty, err error) {
+	for _, o := range options {
+		switch o.opCode {
+		case OptionOpThirdParty:
+			if len(o.data) != 16 {
+				return ThirdParty{}, ErrMalformedOption
+			}
+			tp.Addr = getAddr(o.data)
+		case OptionOpThirdPartyId:
+			if len(o.data) == 0 {
+				return ThirdParty{}, ErrMalformedOption
+			}
+			tp.ID = ThirdPartyID(o.data)
+		}
+	}
+	return tp, tp.validate()
+}
+
+//MapThirdParty requests a mapping for tp on every server and waits for the
+//answers, like MapPort. The server only accepts it from clients allowed to
+//act for other hosts, usually after authentication (see WithAuthentication).
+//The mapping is renewed like the client's own, under a key with ThirdParty set.
+func (c *Client) MapThirdParty(ctx context.Context, tp ThirdParty, protocol Protocol, internalPort, requestedExternalPort uint16, lifetime uint32) (results []ServerResult, err error) {
+	if !tp.IsSet() {
+		return nil, ErrNoAddress
+	}
+	r := MappingRequest{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: requestedExternalPort,
+		ThirdParty:   tp,
+		Lifetime:     lifetime,
+	}
+	res, err := c.MapMany(ctx, []MappingRequest{r})
+	if err != nil {
+		return nil, err
+	}
+	return res[0].Servers, res[0].Err
+}
+
+//DeleteThirdPartyMapping deletes the mapping made for tp, or the peer
+//mapping towards remote if it is valid, on every server holding it.
+func (c *Client) DeleteThirdPartyMapping(ctx context.Context, tp ThirdParty, protocol Protocol, internalPort uint16, remote netip.AddrPort) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	tp.Addr = tp.Addr.Unmap()
+	key := MappingKey{Protocol: protocol, InternalPort: internalPort, ThirdParty: tp}
+	if remote.IsValid() {
+		key.Remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+		return c.deleteMapping(ctx, OpPeer, key)
+	}
+	return c.deleteMapping(ctx, OpMap, key)
+}
@@ -0,0 +1,55 @@
+package pcp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMapThirdParty(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	subscriber := netip.MustParseAddr("10.0.0.5")
+	a := ThirdParty{subscriber, "subscriber-a"}
+	b := ThirdParty{subscriber, "subscriber-b"}
+
+	srv := newTestServer(t, nil)
+	srv.ThirdParty = true
+	srv.start(t)
+	c := newTestClient(t, srv)
+	external := make(map[uint16]bool)
+	for _, tp := range []ThirdParty{a, b} {
+		results, err := c.MapThirdParty(ctx, tp, ProtocolTCP, 8080, 0, 600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := results[0].Mapping; !m.Active || m.ThirdParty != tp {
+			t.Errorf("%+v: %+v", tp, m)
+		}
+		external[results[0].Mapping.ExternalPort] = true
+	}
+	if len(external) != 2 {
+		t.Errorf("subscribers share an external port: %v", external)
+	}
+	if mappings := c.GetMappings(); len(mappings) != 2 {
+		t.Errorf("client holds %+v", mappings)
+	}
+	if err := c.DeleteThirdPartyMapping(ctx, a, ProtocolTCP, 8080, netip.AddrPort{}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := srv.Table.Entries(); len(entries) != 1 || entries[0].ThirdParty != b {
+		t.Errorf("server holds %+v", entries)
+	}
+
+	refusing := newTestServer(t, nil)
+	refusing.start(t)
+	c = newTestClient(t, refusing)
+	_, err := c.MapThirdParty(ctx, a, ProtocolTCP, 8080, 0, 600)
+	if re, ok := err.(*ResultError); !ok || re.Code != ResultNotAuthorised {
+		t.Errorf("refused third party: %v", err)
+	}
+	if entries := refusing.Table.Entries(); len(entries) != 0 {
+		t.Errorf("server holds %+v", entries)
+	}
+}
@@ -2,34 +2,36 @@ package pcp
 
 import (
 	crand "crypto/rand"
+	"encoding/binary"
 	"math/rand"
-	"time"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
-//Necessary for padding all messages to multiple of 4 octets
-func addPadding(data []byte) (out []byte) {
-	length := len(data)
-	padding := 4 - (length % 4)
-	if padding > 0 {
-		empty := make([]byte, padding)
-		out = append(data, empty...)
+//appendPadding pads b with zeros to a multiple of 4 octets, as all PCP
+//messages and options must be.
+func appendPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
 	}
-	return out
+	return b
 }
 
-func concatCopyPreAllocate(slices [][]byte) []byte {
-	var totalLen int
-	for _, s := range slices {
-		totalLen += len(s)
-	}
-	tmp := make([]byte, totalLen)
-	var i int
-	for _, s := range slices {
-		i += copy(tmp[i:], s)
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//clampLifetime raises lifetime to minLifetime if it is shorter.
+func clampLifetime(lifetime uint32) uint32 {
+	if lifetime < minLifetime {
+		return minLifetime
 	}
-	return tmp
+	return lifetime
 }
 
 func genRandomBytes(size int) (blk []byte, err error) {
@@ -38,22 +40,50 @@ func genRandomBytes(size int) (blk []byte, err error) {
 	return
 }
 
-func getRefreshTime(attempt int, lifetime uint32) int64 {
-	//Reset seed on each call to avoid non-pseudorandom intervals over prolonged usage
-	rand.Seed(time.Now().UnixNano())
-	t := time.Now()
-	//See 11.2.1 of RFC6887
-	max := t.Unix() + (5*int64(lifetime))/(1<<(attempt+3))
-	min := t.Unix() + (int64(lifetime))/(1<<(attempt+1))
-	var interval int64
+//lockedRand makes a rand.Rand safe to share between the client's goroutines.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	return &lockedRand{r: rand.New(src)}
+}
+
+//newRandSource seeds a source from crypto/rand, so separate clients do not
+//synchronise their refresh intervals.
+func newRandSource() rand.Source {
+	seed := make([]byte, 8)
+	if _, err := crand.Read(seed); err != nil {
+		log.Warnf("Could not seed random source: %s", err)
+	}
+	return rand.NewSource(int64(binary.BigEndian.Uint64(seed)))
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
+
+//getRefreshTime returns the Unix time at which renewal attempt number attempt
+//should be sent for a mapping with the given lifetime that expires at expires.
+//See 11.2.1 of RFC6887: the first attempt is made between 1/2 and 5/8 of the
+//lifetime, the next between 3/4 and 3/4 + 1/16, then 7/8 and 7/8 + 1/32 and so
+//on, never less than four seconds from now.
+func (c *Client) getRefreshTime(attempt int, lifetime uint32, expires int64) int64 {
+	t := c.clock.Now()
+	l := int64(lifetime)
+	granted := expires - l
+	min := granted + l - l>>uint(attempt+1)
+	max := min + l>>uint(attempt+3)
+	interval := min
 	if (max - min) > 0 {
-		interval = rand.Int63n(max-min) + min
+		interval += c.rand.Int63n(max - min)
 	}
-	if interval < 4 {
+	if interval < t.Unix()+4 {
 		interval = t.Unix() + 4
 	}
-	log.Debug(max, min, max-min)
-	log.Debugf("max - current: %d min - current: %d random int: %d, lifetime: %d", max-t.Unix(), min-t.Unix(), interval-t.Unix(), lifetime)
-	log.Debugf("Refresh max: %d Refresh min: %d Time now: %d Interval: %d", max, min, t.Unix(), interval)
+	log.Debugf("Refresh attempt: %d min: %d max: %d Time now: %d Interval: %d", attempt, min, max, t.Unix(), interval)
 	return interval
 }